@@ -0,0 +1,65 @@
+package main
+
+import (
+	"bufio"
+	"log/slog"
+	"net"
+	"net/http"
+	"time"
+)
+
+// statusRecorder captures the status code written to the client. It
+// keeps Flush and Hijack working so streaming and WebSocket responses
+// pass through untouched.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (s *statusRecorder) WriteHeader(code int) {
+	if s.status == 0 {
+		s.status = code
+	}
+	s.ResponseWriter.WriteHeader(code)
+}
+
+func (s *statusRecorder) Write(p []byte) (int, error) {
+	if s.status == 0 {
+		s.status = http.StatusOK
+	}
+	return s.ResponseWriter.Write(p)
+}
+
+func (s *statusRecorder) Flush() {
+	http.NewResponseController(s.ResponseWriter).Flush()
+}
+
+func (s *statusRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	conn, rw, err := http.NewResponseController(s.ResponseWriter).Hijack()
+	if err == nil && s.status == 0 {
+		s.status = http.StatusSwitchingProtocols
+	}
+	return conn, rw, err
+}
+
+func (s *statusRecorder) Unwrap() http.ResponseWriter {
+	return s.ResponseWriter
+}
+
+func logAccess(r *http.Request, b *BackEnd, status, retries int, start time.Time) {
+	backend := ""
+	if b != nil {
+		backend = b.url.String()
+	}
+
+	slog.Info("Request served",
+		"event", "access",
+		"method", r.Method,
+		"path", r.URL.Path,
+		"client_ip", clientIP(r),
+		"backend", backend,
+		"status", status,
+		"retries", retries,
+		"latency", time.Since(start),
+	)
+}
@@ -0,0 +1,24 @@
+package main
+
+import "time"
+
+// adaptiveWeightOptions scales backend weights by health check latency.
+// A zero target disables the adjustment.
+type adaptiveWeightOptions struct {
+	//Average probe latency at which a backend gets its configured weight
+	target time.Duration
+	//Bounds of the weight factor
+	min float64
+	max float64
+}
+
+// factor returns the weight multiplier for a backend whose recent health
+// checks took avg on average: target/avg clamped to [min, max], so a
+// backend twice as slow as the target gets half its weight.
+func (o adaptiveWeightOptions) factor(avg time.Duration) float64 {
+	if o.target <= 0 || avg <= 0 {
+		return 1
+	}
+	f := float64(o.target) / float64(avg)
+	return min(max(f, o.min), o.max)
+}
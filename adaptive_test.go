@@ -0,0 +1,68 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestAdaptiveWeightFactor(t *testing.T) {
+	opts := adaptiveWeightOptions{target: 10 * time.Millisecond, min: 0.25, max: 1.5}
+	for _, tc := range []struct {
+		avg  time.Duration
+		want float64
+	}{
+		{0, 1},
+		{10 * time.Millisecond, 1},
+		{20 * time.Millisecond, 0.5},
+		{time.Second, 0.25},
+		{5 * time.Millisecond, 1.5},
+		{time.Millisecond, 1.5},
+	} {
+		if got := opts.factor(tc.avg); got != tc.want {
+			t.Errorf("factor(%v) = %v, want %v", tc.avg, got, tc.want)
+		}
+	}
+	if f := (adaptiveWeightOptions{}).factor(time.Second); f != 1 {
+		t.Errorf("factor with adaptive weights off = %v, want 1", f)
+	}
+}
+
+func TestAdaptiveWeightFollowsHealthLatency(t *testing.T) {
+	var delay atomic.Int64
+	srv := newTestServer(t, func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(time.Duration(delay.Load()))
+	})
+	l := newTestLB(t)
+	l.backendOpts.adaptive = adaptiveWeightOptions{target: 20 * time.Millisecond, min: 0.25, max: 1}
+	b := newTestBackEnd(t, BackendConfig{URL: srv.URL, Weight: ptr(2)}, l.backendOpts)
+	if err := l.addBackend(b); err != nil {
+		t.Fatal(err)
+	}
+	probe := func(n int) {
+		for range n {
+			l.checkHealth(context.Background(), b, l.healthOpts)
+		}
+	}
+
+	probe(3)
+	if w := b.effectiveWeight(); w != 2*weightScale {
+		t.Fatalf("effective weight = %d with fast probes, want the full %d", w, 2*weightScale)
+	}
+
+	//Probes slowing to four times the target pull the weight down to the floor
+	delay.Store(int64(80 * time.Millisecond))
+	probe(10)
+	slow := b.effectiveWeight()
+	if slow >= 2*weightScale || slow < 2*weightScale/4 {
+		t.Fatalf("effective weight = %d with slow probes, want it between %d and %d", slow, 2*weightScale/4, 2*weightScale)
+	}
+
+	delay.Store(0)
+	probe(20)
+	if w := b.effectiveWeight(); w <= slow {
+		t.Fatalf("effective weight = %d after latency recovered, want it above %d", w, slow)
+	}
+}
@@ -0,0 +1,373 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+var errDuplicateBackend = errors.New("backend already exists")
+
+// backendStatus is the JSON view of a backend returned by admin endpoints.
+type backendStatus struct {
+	//ID addresses the backend in /admin/backends/{id}/... paths
+	ID     string `json:"id"`
+	URL    string `json:"url"`
+	Weight int    `json:"weight"`
+	//Weight after slow start and adaptive adjustment
+	EffectiveWeight float64           `json:"effective_weight"`
+	Tags            map[string]string `json:"tags,omitempty"`
+	Alive           bool              `json:"alive"`
+	Enabled         bool              `json:"enabled"`
+	Flapping        bool              `json:"flapping,omitempty"`
+	InFlight        int64             `json:"in_flight"`
+	TotalRequests   uint64            `json:"total_requests"`
+	LastHealthCheck *time.Time        `json:"last_health_check,omitempty"`
+	//Probe latency in milliseconds, last and averaged over recent checks
+	HealthCheckLatencyMS    float64 `json:"health_check_latency_ms,omitempty"`
+	HealthCheckLatencyAvgMS float64 `json:"health_check_latency_avg_ms,omitempty"`
+	//Moving average of proxied request latency in milliseconds
+	LatencyEWMAMS float64 `json:"latency_ewma_ms,omitempty"`
+	//Unset when circuit breakers are disabled
+	Breaker *breakerStatus `json:"breaker,omitempty"`
+}
+
+func newBackendStatus(b *BackEnd) backendStatus {
+	s := backendStatus{
+		ID:              b.id,
+		URL:             b.url.String(),
+		Weight:          b.weight,
+		EffectiveWeight: float64(b.effectiveWeight()) / weightScale,
+		Tags:            b.tags,
+		Alive:           b.isAlive(),
+		Enabled:         !b.disabled.Load(),
+		Flapping:        b.flapping.Load(),
+		InFlight:        b.activeConns(),
+		TotalRequests:   b.served.Load(),
+		Breaker:         b.breaker.status(),
+	}
+	if t := b.lastHealthCheck(); !t.IsZero() {
+		s.LastHealthCheck = &t
+	}
+	if last, avg := b.checkLatency(); last > 0 {
+		s.HealthCheckLatencyMS = float64(last.Microseconds()) / 1000
+		s.HealthCheckLatencyAvgMS = float64(avg.Microseconds()) / 1000
+	}
+	if d := b.latency.value(); d > 0 {
+		s.LatencyEWMAMS = float64(d.Microseconds()) / 1000
+	}
+	return s
+}
+
+// adminHandler serves the admin API. It runs on its own listener so the
+// endpoints that reconfigure the load balancer are never reachable
+// through the proxy port. A non-empty token is required as a bearer
+// token on every request.
+func (l *LoadBalancer) adminHandler(token string) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /admin/backends", l.handleAddBackend)
+	mux.HandleFunc("DELETE /admin/backends", l.handleRemoveBackend)
+	mux.HandleFunc("POST /admin/backends/health", l.handleForceHealth)
+	mux.HandleFunc("POST /admin/backends/{id}/health", l.handleForceHealth)
+	mux.HandleFunc("POST /admin/backends/enable", l.handleSetEnabled(true))
+	mux.HandleFunc("POST /admin/backends/disable", l.handleSetEnabled(false))
+	mux.HandleFunc("GET /admin/stats", l.handleStats)
+	mux.HandleFunc("POST /admin/maintenance", l.handleMaintenance)
+	mux.HandleFunc("POST /admin/strategy", l.handleStrategy)
+	mux.HandleFunc("GET /admin/version", handleVersion)
+	if token == "" {
+		return mux
+	}
+	return requireBearer(mux, token)
+}
+
+// requireBearer answers 401 to requests without "Authorization: Bearer token".
+func requireBearer(next http.Handler, token string) http.Handler {
+	want := []byte("Bearer " + token)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), want) != 1 {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		slog.Error("Error writing admin response", "event", "admin_error", "error", err)
+	}
+}
+
+// adminPool returns the pool named by the request's pool query
+// parameter, answering 404 when there is none.
+func (l *LoadBalancer) adminPool(w http.ResponseWriter, r *http.Request) *pool {
+	name := r.URL.Query().Get("pool")
+	p := l.poolByName(name)
+	if p == nil {
+		http.Error(w, "pool not found: "+name, http.StatusNotFound)
+	}
+	return p
+}
+
+// handleAddBackend serves POST /admin/backends[?pool=...]. The body uses
+// the same fields as a backend entry in the config file.
+func (l *LoadBalancer) handleAddBackend(w http.ResponseWriter, r *http.Request) {
+	p := l.adminPool(w, r)
+	if p == nil {
+		return
+	}
+
+	var bc BackendConfig
+	if err := json.NewDecoder(r.Body).Decode(&bc); err != nil {
+		http.Error(w, "invalid JSON body: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := bc.validate(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	b, err := newBackEnd(bc, l.backendOpts)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	//Probe before the backend is visible to strategies
+	l.checkHealth(r.Context(), b, p.healthOpts)
+
+	if err := p.addBackend(b); err != nil {
+		if errors.Is(err, errDuplicateBackend) {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		}
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	slog.Info("Added server via admin API", "event", "backend_added", "pool", p.name, "backend", b.url.String(), "alive", b.isAlive())
+	writeJSON(w, http.StatusCreated, newBackendStatus(b))
+}
+
+// handleRemoveBackend serves
+// DELETE /admin/backends?url=...[&drain=true][&pool=...]. With drain set
+// the backend stops receiving new requests and is only removed once its
+// in-flight requests have finished, or the admin request is cancelled.
+// The response reports the requests in flight when draining started and
+// those still running at removal.
+func (l *LoadBalancer) handleRemoveBackend(w http.ResponseWriter, r *http.Request) {
+	p := l.adminPool(w, r)
+	if p == nil {
+		return
+	}
+
+	rawURL := r.URL.Query().Get("url")
+	b := p.findBackend(rawURL)
+	if b == nil {
+		http.Error(w, "backend not found: "+rawURL, http.StatusNotFound)
+		return
+	}
+
+	drain, _ := strconv.ParseBool(r.URL.Query().Get("drain"))
+
+	var inFlight int64
+	if drain {
+		b.draining.Store(true)
+		inFlight = b.activeConns()
+		slog.Info("Draining server", "event", "backend_draining", "backend", b.url.String(), "in_flight", inFlight)
+		waitDrained(r.Context(), b)
+	}
+
+	if !p.removeBackend(b) {
+		http.Error(w, "backend not found: "+rawURL, http.StatusNotFound)
+		return
+	}
+
+	remaining := b.activeConns()
+	slog.Info("Removed server via admin API", "event", "backend_removed", "pool", p.name, "backend", b.url.String(), "remaining", remaining)
+	writeJSON(w, http.StatusOK, map[string]any{
+		"url":       b.url.String(),
+		"in_flight": inFlight,
+		"remaining": remaining,
+	})
+}
+
+// handleForceHealth serves POST /admin/backends/{id}/health and
+// POST /admin/backends/health, both with [?pool=...]. It probes the
+// backend with that id, as listed by /admin/stats, or every backend of
+// the pool, right away with the pool's health check timeout and answers
+// with the resulting status. The operator asked for it, so a single probe is enough to flip
+// the backend without waiting for the fall or rise threshold.
+func (l *LoadBalancer) handleForceHealth(w http.ResponseWriter, r *http.Request) {
+	p := l.adminPool(w, r)
+	if p == nil {
+		return
+	}
+
+	opts := p.healthOpts
+	opts.fall, opts.rise = 1, 1
+
+	if id := r.PathValue("id"); id != "" {
+		b := p.findBackendByID(id)
+		if b == nil {
+			http.Error(w, "backend not found: "+id, http.StatusNotFound)
+			return
+		}
+		l.checkHealth(r.Context(), b, opts)
+		writeJSON(w, http.StatusOK, newBackendStatus(b))
+		return
+	}
+
+	backends := p.snapshot()
+	var wg sync.WaitGroup
+	for _, b := range backends {
+		wg.Add(1)
+		go func(b *BackEnd) {
+			defer wg.Done()
+			l.checkHealth(r.Context(), b, opts)
+		}(b)
+	}
+	wg.Wait()
+
+	stats := make([]backendStatus, 0, len(backends))
+	for _, b := range backends {
+		stats = append(stats, newBackendStatus(b))
+	}
+	writeJSON(w, http.StatusOK, stats)
+}
+
+// handleSetEnabled serves POST /admin/backends/enable and
+// POST /admin/backends/disable with ?url=...[&pool=...]. A disabled
+// backend gets no new requests whatever its health, and stays out of
+// rotation until it is enabled again.
+func (l *LoadBalancer) handleSetEnabled(enabled bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		p := l.adminPool(w, r)
+		if p == nil {
+			return
+		}
+
+		rawURL := r.URL.Query().Get("url")
+		b := p.findBackend(rawURL)
+		if b == nil {
+			http.Error(w, "backend not found: "+rawURL, http.StatusNotFound)
+			return
+		}
+
+		if b.disabled.Swap(!enabled) == enabled {
+			slog.Warn("Backend toggled via admin API", "event", "backend_enabled", "pool", p.name, "backend", b.url.String(), "enabled", enabled)
+		}
+		writeJSON(w, http.StatusOK, newBackendStatus(b))
+	}
+}
+
+// strategyRequest is the body of POST /admin/strategy.
+type strategyRequest struct {
+	Name string `json:"name"`
+}
+
+// handleStrategy serves POST /admin/strategy[?pool=...] and switches the
+// pool to another balancing strategy. Requests already past backend
+// selection are unaffected.
+func (l *LoadBalancer) handleStrategy(w http.ResponseWriter, r *http.Request) {
+	p := l.adminPool(w, r)
+	if p == nil {
+		return
+	}
+
+	var req strategyRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "invalid JSON body: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if req.Name == "" {
+		http.Error(w, "name is required", http.StatusBadRequest)
+		return
+	}
+	s, err := newStrategy(req.Name, l.consistentHash)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if l.stickyCookie != "" {
+		s = &StickyStrategy{Cookie: l.stickyCookie, Next: s}
+	}
+
+	p.setStrategy(s)
+	slog.Info("Strategy changed via admin API", "event", "strategy_changed", "pool", p.name, "strategy", req.Name)
+	writeJSON(w, http.StatusOK, map[string]any{
+		"pool":     p.name,
+		"strategy": req.Name,
+	})
+}
+
+// waitDrained blocks until b has no in-flight requests or ctx is done.
+func waitDrained(ctx context.Context, b *BackEnd) {
+	t := time.NewTicker(50 * time.Millisecond)
+	defer t.Stop()
+	for b.activeConns() > 0 {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+	}
+}
+
+// handleStats serves GET /admin/stats with a snapshot of every backend.
+// The default pool is listed under "backends", named pools under "pools".
+func (l *LoadBalancer) handleStats(w http.ResponseWriter, r *http.Request) {
+	resp := map[string]any{
+		"backends": poolStatus(&l.pool),
+	}
+	if len(l.pools) > 0 {
+		pools := make(map[string][]backendStatus, len(l.pools))
+		for name, p := range l.pools {
+			pools[name] = poolStatus(p)
+		}
+		resp["pools"] = pools
+	}
+
+	writeJSON(w, http.StatusOK, resp)
+}
+
+func poolStatus(p *pool) []backendStatus {
+	backends := p.snapshot()
+	stats := make([]backendStatus, 0, len(backends))
+	for _, b := range backends {
+		stats = append(stats, newBackendStatus(b))
+	}
+	return stats
+}
+
+// handleHealthz serves GET /healthz, the liveness probe. Answering at
+// all means the process is up.
+func (l *LoadBalancer) handleHealthz(w http.ResponseWriter, r *http.Request) {
+	w.Write([]byte("ok\n"))
+}
+
+// handleReady serves GET /ready, the readiness probe. It fails while no
+// backend is alive or maintenance mode is on, so orchestrators stop
+// routing traffic here.
+func (l *LoadBalancer) handleReady(w http.ResponseWriter, r *http.Request) {
+	if l.maintenance.Load() {
+		http.Error(w, "maintenance", http.StatusServiceUnavailable)
+		return
+	}
+
+	if l.anyAlive() {
+		w.Write([]byte("ready\n"))
+		return
+	}
+	http.Error(w, "no backend available", http.StatusServiceUnavailable)
+}
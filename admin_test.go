@@ -0,0 +1,413 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// adminRequest sends method target with body to the admin API of l.
+func adminRequest(l *LoadBalancer, method, target, body string) *httptest.ResponseRecorder {
+	return serve(l.adminHandler(""), httptest.NewRequest(method, target, strings.NewReader(body)))
+}
+
+func TestAdminAddBackend(t *testing.T) {
+	srv := newTestServer(t, nameHandler("added"))
+	l := newTestLB(t)
+
+	rec := adminRequest(l, http.MethodPost, "/admin/backends", `{"url": "`+srv.URL+`", "weight": 2}`)
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("status = %d: %s", rec.Code, rec.Body)
+	}
+	var status backendStatus
+	if err := json.Unmarshal(rec.Body.Bytes(), &status); err != nil {
+		t.Fatal(err)
+	}
+	if !status.Alive || status.Weight != 2 {
+		t.Errorf("status = %+v, want an alive backend of weight 2", status)
+	}
+	if rec := get(l, "/"); rec.Body.String() != "added" {
+		t.Errorf("body = %q, want traffic on the added backend", rec.Body)
+	}
+
+	if rec := adminRequest(l, http.MethodPost, "/admin/backends", `{"url": "`+srv.URL+`"}`); rec.Code != http.StatusConflict {
+		t.Errorf("duplicate add: status = %d, want 409", rec.Code)
+	}
+	if rec := adminRequest(l, http.MethodPost, "/admin/backends", `{"url": "http://bad host"}`); rec.Code != http.StatusBadRequest {
+		t.Errorf("invalid URL: status = %d, want 400", rec.Code)
+	}
+}
+
+func TestAdminAddDeadBackendGetsNoTraffic(t *testing.T) {
+	live := newTestServer(t, nameHandler("live"))
+	l := newTestLB(t, live.URL)
+
+	rec := adminRequest(l, http.MethodPost, "/admin/backends", `{"url": "`+deadURL(t)+`"}`)
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("status = %d: %s", rec.Code, rec.Body)
+	}
+	for range 4 {
+		if rec := get(l, "/"); rec.Body.String() != "live" {
+			t.Fatalf("body = %q, want every request on the live backend", rec.Body)
+		}
+	}
+}
+
+func TestAdminToken(t *testing.T) {
+	l := newTestLB(t)
+	h := l.adminHandler("secret")
+
+	req := httptest.NewRequest(http.MethodGet, "/admin/stats", nil)
+	if rec := serve(h, req); rec.Code != http.StatusUnauthorized || rec.Header().Get("WWW-Authenticate") == "" {
+		t.Errorf("no token: status = %d, want 401 with WWW-Authenticate", rec.Code)
+	}
+
+	req.Header.Set("Authorization", "Bearer wrong")
+	if rec := serve(h, req); rec.Code != http.StatusUnauthorized {
+		t.Errorf("wrong token: status = %d, want 401", rec.Code)
+	}
+
+	req.Header.Set("Authorization", "Bearer secret")
+	if rec := serve(h, req); rec.Code != http.StatusOK {
+		t.Errorf("right token: status = %d, want 200", rec.Code)
+	}
+}
+
+func TestAdminRemoveBackend(t *testing.T) {
+	srv := newTestServer(t, nameHandler("a"))
+	l := newTestLB(t, srv.URL)
+
+	if rec := adminRequest(l, http.MethodDelete, "/admin/backends?url=http://missing", ""); rec.Code != http.StatusNotFound {
+		t.Errorf("missing backend: status = %d, want 404", rec.Code)
+	}
+	if rec := adminRequest(l, http.MethodDelete, "/admin/backends?url="+srv.URL, ""); rec.Code != http.StatusOK {
+		t.Fatalf("status = %d: %s", rec.Code, rec.Body)
+	}
+	if n := len(l.snapshot()); n != 0 {
+		t.Fatalf("%d backends left after removal", n)
+	}
+}
+
+func TestAdminDrainWaitsForInFlight(t *testing.T) {
+	started := make(chan struct{})
+	release := make(chan struct{})
+	srv := newTestServer(t, func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		<-release
+		io.WriteString(w, "done")
+	})
+	l := newTestLB(t, srv.URL)
+
+	proxied := make(chan *httptest.ResponseRecorder)
+	go func() { proxied <- get(l, "/") }()
+	<-started
+
+	removed := make(chan *httptest.ResponseRecorder)
+	go func() {
+		removed <- adminRequest(l, http.MethodDelete, "/admin/backends?drain=true&url="+srv.URL, "")
+	}()
+
+	//Draining stops new traffic right away
+	for !l.snapshot()[0].draining.Load() {
+		time.Sleep(time.Millisecond)
+	}
+	if rec := get(l, "/"); rec.Code != http.StatusServiceUnavailable {
+		t.Errorf("request during drain: status = %d, want 503", rec.Code)
+	}
+	select {
+	case <-removed:
+		t.Fatal("backend removed while a request was in flight")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	close(release)
+	if rec := <-proxied; rec.Body.String() != "done" {
+		t.Errorf("in-flight request got %q, want it to finish", rec.Body)
+	}
+	rec := <-removed
+	var resp struct {
+		InFlight  int64 `json:"in_flight"`
+		Remaining int64 `json:"remaining"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil || resp.InFlight != 1 || resp.Remaining != 0 {
+		t.Fatalf("response = %s, want 1 in flight and none remaining", rec.Body)
+	}
+}
+
+func TestAdminDrainCutShort(t *testing.T) {
+	release := make(chan struct{})
+	defer close(release)
+	started := make(chan struct{})
+	srv := newTestServer(t, func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		<-release
+	})
+	l := newTestLB(t, srv.URL)
+	go get(l, "/")
+	<-started
+
+	//The operator gives up waiting, the removal reports what is left
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	req := httptest.NewRequest(http.MethodDelete, "/admin/backends?drain=true&url="+srv.URL, nil).WithContext(ctx)
+	rec := serve(l.adminHandler(""), req)
+
+	var resp struct {
+		InFlight  int64 `json:"in_flight"`
+		Remaining int64 `json:"remaining"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil || resp.InFlight != 1 || resp.Remaining != 1 {
+		t.Fatalf("response = %s, want the unfinished request reported as remaining", rec.Body)
+	}
+	if len(l.snapshot()) != 0 {
+		t.Fatal("backend still in the pool")
+	}
+}
+
+func TestAdminStats(t *testing.T) {
+	srv := newTestServer(t, nameHandler("ok"))
+	l := newTestLB(t, srv.URL, deadURL(t))
+	l.snapshot()[1].setAlive(false)
+	l.checkHealth(context.Background(), l.snapshot()[0], l.healthOpts)
+	get(l, "/")
+
+	rec := adminRequest(l, http.MethodGet, "/admin/stats", "")
+	if rec.Code != http.StatusOK || rec.Header().Get("Content-Type") != "application/json" {
+		t.Fatalf("status = %d, content type %q", rec.Code, rec.Header().Get("Content-Type"))
+	}
+	var stats struct {
+		Backends []backendStatus `json:"backends"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &stats); err != nil {
+		t.Fatal(err)
+	}
+	if len(stats.Backends) != 2 {
+		t.Fatalf("got %d backends, want 2", len(stats.Backends))
+	}
+	up, down := stats.Backends[0], stats.Backends[1]
+	if up.URL != srv.URL || !up.Alive || up.TotalRequests != 1 || up.InFlight != 0 || up.LastHealthCheck == nil {
+		t.Errorf("live backend = %+v", up)
+	}
+	if down.Alive || down.TotalRequests != 0 {
+		t.Errorf("dead backend = %+v", down)
+	}
+}
+
+func TestReadiness(t *testing.T) {
+	l := newTestLB(t, "http://a", "http://b")
+	backends := l.snapshot()
+	ready := func() int {
+		return serve(http.HandlerFunc(l.handleReady), httptest.NewRequest(http.MethodGet, "/ready", nil)).Code
+	}
+
+	if code := ready(); code != http.StatusOK {
+		t.Errorf("all up: /ready = %d, want 200", code)
+	}
+	backends[0].setAlive(false)
+	if code := ready(); code != http.StatusOK {
+		t.Errorf("some up: /ready = %d, want 200", code)
+	}
+	backends[1].setAlive(false)
+	if code := ready(); code != http.StatusServiceUnavailable {
+		t.Errorf("all down: /ready = %d, want 503", code)
+	}
+
+	//Liveness doesn't depend on the backends
+	if rec := serve(http.HandlerFunc(l.handleHealthz), httptest.NewRequest(http.MethodGet, "/healthz", nil)); rec.Code != http.StatusOK {
+		t.Errorf("all down: /healthz = %d, want 200", rec.Code)
+	}
+}
+
+func TestMaintenanceToggle(t *testing.T) {
+	srv := newTestServer(t, nameHandler("ok"))
+	l := newTestLB(t, srv.URL)
+	ready := func() int {
+		return serve(http.HandlerFunc(l.handleReady), httptest.NewRequest(http.MethodGet, "/ready", nil)).Code
+	}
+
+	if rec := adminRequest(l, http.MethodPost, "/admin/maintenance", `{"enabled": true, "retry_after": 120}`); rec.Code != http.StatusOK {
+		t.Fatalf("enable: status = %d: %s", rec.Code, rec.Body)
+	}
+	rec := get(l, "/")
+	if rec.Code != http.StatusServiceUnavailable || rec.Header().Get("Retry-After") != "120" {
+		t.Fatalf("in maintenance: %d with Retry-After %q, want 503 with 120", rec.Code, rec.Header().Get("Retry-After"))
+	}
+	if code := ready(); code != http.StatusServiceUnavailable {
+		t.Errorf("in maintenance: /ready = %d, want 503", code)
+	}
+
+	if rec := adminRequest(l, http.MethodPost, "/admin/maintenance", `{"enabled": false}`); rec.Code != http.StatusOK {
+		t.Fatalf("disable: status = %d: %s", rec.Code, rec.Body)
+	}
+	if rec := get(l, "/"); rec.Code != http.StatusOK || rec.Header().Get("Retry-After") != "" {
+		t.Fatalf("after maintenance: %d with Retry-After %q, want a plain 200", rec.Code, rec.Header().Get("Retry-After"))
+	}
+	if code := ready(); code != http.StatusOK {
+		t.Errorf("after maintenance: /ready = %d, want 200", code)
+	}
+
+	if rec := adminRequest(l, http.MethodPost, "/admin/maintenance", `{"enabled": true, "retry_after": -1}`); rec.Code != http.StatusBadRequest {
+		t.Errorf("negative retry_after: status = %d, want 400", rec.Code)
+	}
+}
+
+func TestAdminForceHealth(t *testing.T) {
+	var healthy atomic.Bool
+	healthy.Store(true)
+	srv := newTestServer(t, toggleHandler(&healthy))
+	l := newTestLB(t, srv.URL, deadURL(t))
+	l.healthOpts.rise = 3
+	up, down := l.snapshot()[0], l.snapshot()[1]
+	up.setAlive(false)
+
+	//One forced probe brings the backend back despite rise 3
+	rec := adminRequest(l, http.MethodPost, "/admin/backends/"+up.id+"/health", "")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status = %d: %s", rec.Code, rec.Body)
+	}
+	var status backendStatus
+	if err := json.Unmarshal(rec.Body.Bytes(), &status); err != nil {
+		t.Fatal(err)
+	}
+	if status.ID != up.id || !status.Alive || !up.isAlive() {
+		t.Fatalf("status = %+v, want the recovered backend alive", status)
+	}
+
+	rec = adminRequest(l, http.MethodPost, "/admin/backends/health", "")
+	var all []backendStatus
+	if err := json.Unmarshal(rec.Body.Bytes(), &all); err != nil {
+		t.Fatal(err)
+	}
+	if len(all) != 2 || !all[0].Alive || all[1].Alive || down.isAlive() {
+		t.Fatalf("checking every backend gave %+v, want the refused one marked dead", all)
+	}
+
+	if rec := adminRequest(l, http.MethodPost, "/admin/backends/"+backendID("http://unknown")+"/health", ""); rec.Code != http.StatusNotFound {
+		t.Fatalf("unknown backend: status = %d, want 404", rec.Code)
+	}
+}
+
+func TestAdminStrategySwap(t *testing.T) {
+	l := newTestLB(t, newTestServer(t, nameHandler("ok")).URL)
+
+	rec := adminRequest(l, http.MethodPost, "/admin/strategy", `{"name": "least-conn"}`)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status = %d: %s", rec.Code, rec.Body)
+	}
+	if _, ok := l.strategy.(*LeastConnectionsStrategy); !ok {
+		t.Fatalf("strategy = %T after switching to least-conn", l.strategy)
+	}
+	if rec := get(l, "/"); rec.Body.String() != "ok" {
+		t.Fatalf("body = %q after the switch", rec.Body)
+	}
+
+	for _, body := range []string{`{"name": "fastest"}`, `{}`, `not json`} {
+		if rec := adminRequest(l, http.MethodPost, "/admin/strategy", body); rec.Code != http.StatusBadRequest {
+			t.Errorf("body %s: status = %d, want 400", body, rec.Code)
+		}
+	}
+	if _, ok := l.strategy.(*LeastConnectionsStrategy); !ok {
+		t.Fatalf("rejected request replaced the strategy with %T", l.strategy)
+	}
+
+	//Sticky sessions keep wrapping whatever strategy is swapped in
+	l.stickyCookie = "lb_backend"
+	adminRequest(l, http.MethodPost, "/admin/strategy", `{"name": "random"}`)
+	sticky, ok := l.strategy.(*StickyStrategy)
+	if !ok {
+		t.Fatalf("strategy = %T with sticky sessions on", l.strategy)
+	}
+	if _, ok := sticky.Next.(*RandomStrategy); !ok {
+		t.Fatalf("sticky strategy wraps %T, want random", sticky.Next)
+	}
+}
+
+// Run with -race: requests keep picking while the strategy is swapped.
+func TestAdminStrategySwapUnderLoad(t *testing.T) {
+	srv := newTestServer(t, nameHandler("ok"))
+	l := newTestLB(t)
+	for i := range 3 {
+		if err := l.addBackend(newTestBackEnd(t, BackendConfig{URL: srv.URL + "/" + strconv.Itoa(i), Weight: ptr(i + 1)}, l.backendOpts)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	for range 4 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-done:
+					return
+				default:
+				}
+				if rec := get(l, "/"); rec.Code != http.StatusOK {
+					t.Errorf("status = %d during a strategy swap", rec.Code)
+					return
+				}
+			}
+		}()
+	}
+	for i := range 50 {
+		name := []string{"weighted", "least-conn", "round-robin", "weighted-least-conn"}[i%4]
+		if rec := adminRequest(l, http.MethodPost, "/admin/strategy", `{"name": "`+name+`"}`); rec.Code != http.StatusOK {
+			t.Fatalf("switch to %s: status = %d", name, rec.Code)
+		}
+	}
+	close(done)
+	wg.Wait()
+}
+
+func TestAdminDisabledBackendGetsNoTraffic(t *testing.T) {
+	var offHits atomic.Int64
+	off := newTestServer(t, countingHandler(&offHits))
+	on := newTestServer(t, nameHandler("on"))
+	l := newTestLB(t, off.URL, on.URL)
+	b := l.snapshot()[0]
+
+	rec := adminRequest(l, http.MethodPost, "/admin/backends/disable?url="+off.URL, "")
+	var status backendStatus
+	if err := json.Unmarshal(rec.Body.Bytes(), &status); err != nil {
+		t.Fatal(err)
+	}
+	if rec.Code != http.StatusOK || status.Enabled || !status.Alive {
+		t.Fatalf("disable: %d %+v, want an alive but disabled backend", rec.Code, status)
+	}
+
+	//Healthy, and health checks do not bring it back into rotation
+	l.healthCheck(context.Background(), &l.pool, false)
+	if !b.isAlive() {
+		t.Fatal("disabled backend failed its health check")
+	}
+	offHits.Store(0)
+	for range 6 {
+		if rec := get(l, "/"); rec.Body.String() != "on" {
+			t.Fatalf("body = %q, want every request on the enabled backend", rec.Body)
+		}
+	}
+	if offHits.Load() != 0 {
+		t.Fatalf("disabled backend answered %d requests", offHits.Load())
+	}
+
+	adminRequest(l, http.MethodPost, "/admin/backends/enable?url="+off.URL, "")
+	for range 6 {
+		get(l, "/")
+	}
+	if offHits.Load() == 0 {
+		t.Fatal("re-enabled backend got no traffic")
+	}
+	if rec := adminRequest(l, http.MethodPost, "/admin/backends/disable?url=http://unknown", ""); rec.Code != http.StatusNotFound {
+		t.Fatalf("unknown backend: status = %d, want 404", rec.Code)
+	}
+}
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+type breakerState int
+
+const (
+	breakerClosed breakerState = iota
+	breakerOpen
+	breakerHalfOpen
+)
+
+func (s breakerState) String() string {
+	switch s {
+	case breakerOpen:
+		return "open"
+	case breakerHalfOpen:
+		return "half-open"
+	default:
+		return "closed"
+	}
+}
+
+// breakerOptions configures the per-backend circuit breakers.
+// A zero threshold disables the breaker.
+type breakerOptions struct {
+	threshold int
+	window    time.Duration
+	cooldown  time.Duration
+}
+
+// circuitBreaker stops traffic to a backend after threshold errors
+// within window. Once cooldown has passed a single trial request is
+// let through: success closes the breaker, failure opens it again.
+//
+// Every state change starts a new generation. acquire hands out the
+// current one and record ignores outcomes from an older generation, so
+// requests admitted before the breaker opened can't decide the trial.
+type circuitBreaker struct {
+	opts breakerOptions
+	//Metrics label of the backend
+	backend string
+
+	mux         sync.Mutex
+	state       breakerState
+	errors      int
+	windowStart time.Time
+	openedAt    time.Time
+	trial       bool
+	trips       int
+	gen         uint64
+}
+
+func newCircuitBreaker(opts breakerOptions, backend string) *circuitBreaker {
+	if opts.threshold > 0 {
+		breakerStateGauge.WithLabelValues(backend).Set(float64(breakerClosed))
+	}
+	return &circuitBreaker{opts: opts, backend: backend}
+}
+
+// setState moves the breaker to s, counting trips. Callers hold mux.
+func (c *circuitBreaker) setState(s breakerState, now time.Time) {
+	c.state = s
+	c.gen++
+	if s == breakerOpen {
+		c.openedAt = now
+		c.trips++
+		breakerTripsTotal.WithLabelValues(c.backend).Inc()
+	}
+	breakerStateGauge.WithLabelValues(c.backend).Set(float64(s))
+}
+
+// ready reports whether the backend may be picked. It doesn't reserve
+// the half-open trial, see acquire.
+func (c *circuitBreaker) ready() bool {
+	if c == nil || c.opts.threshold <= 0 {
+		return true
+	}
+
+	c.mux.Lock()
+	defer c.mux.Unlock()
+
+	switch c.state {
+	case breakerOpen:
+		return time.Since(c.openedAt) >= c.opts.cooldown
+	case breakerHalfOpen:
+		return !c.trial
+	}
+	return true
+}
+
+// acquire is called right before a request is sent. It returns false
+// when the breaker is open or the half-open trial is already taken,
+// otherwise the generation to pass to record.
+func (c *circuitBreaker) acquire() (uint64, bool) {
+	if c == nil || c.opts.threshold <= 0 {
+		return 0, true
+	}
+
+	c.mux.Lock()
+	defer c.mux.Unlock()
+
+	if c.state == breakerOpen {
+		if time.Since(c.openedAt) < c.opts.cooldown {
+			return 0, false
+		}
+		c.setState(breakerHalfOpen, time.Now())
+		c.trial = false
+	}
+
+	if c.state == breakerHalfOpen {
+		if c.trial {
+			return 0, false
+		}
+		c.trial = true
+	}
+	return c.gen, true
+}
+
+// record reports the outcome of a request admitted by acquire with gen
+// and returns the new state when it changed.
+func (c *circuitBreaker) record(gen uint64, success bool) (breakerState, bool) {
+	if c == nil || c.opts.threshold <= 0 {
+		return breakerClosed, false
+	}
+
+	c.mux.Lock()
+	defer c.mux.Unlock()
+
+	//Late results from requests started before the last state change
+	if gen != c.gen {
+		return c.state, false
+	}
+
+	now := time.Now()
+	switch c.state {
+	case breakerHalfOpen:
+		c.trial = false
+		if success {
+			c.setState(breakerClosed, now)
+			c.errors = 0
+		} else {
+			c.setState(breakerOpen, now)
+		}
+		return c.state, true
+	case breakerOpen:
+		return c.state, false
+	}
+
+	if success {
+		return c.state, false
+	}
+
+	if now.Sub(c.windowStart) > c.opts.window {
+		c.windowStart = now
+		c.errors = 0
+	}
+	c.errors++
+	if c.errors >= c.opts.threshold {
+		c.setState(breakerOpen, now)
+		return c.state, true
+	}
+	return c.state, false
+}
+
+func (c *circuitBreaker) currentState() breakerState {
+	if c == nil {
+		return breakerClosed
+	}
+
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	return c.state
+}
+
+// breakerStatus is a snapshot of a breaker for the admin API.
+type breakerStatus struct {
+	State string `json:"state"`
+	//When the breaker last opened, unset if it never did
+	OpenedAt *time.Time `json:"opened_at,omitempty"`
+	Trips    int        `json:"trips"`
+}
+
+// status returns a snapshot of c, nil when the breaker is disabled.
+func (c *circuitBreaker) status() *breakerStatus {
+	if c == nil || c.opts.threshold <= 0 {
+		return nil
+	}
+
+	c.mux.Lock()
+	defer c.mux.Unlock()
+
+	s := &breakerStatus{State: c.state.String(), Trips: c.trips}
+	if !c.openedAt.IsZero() {
+		openedAt := c.openedAt
+		s.OpenedAt = &openedAt
+	}
+	return s
+}
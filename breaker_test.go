@@ -0,0 +1,165 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestBreakerWithholdsTrafficWhileOpen(t *testing.T) {
+	var failing atomic.Int64
+	bad := newTestServer(t, func(w http.ResponseWriter, r *http.Request) {
+		failing.Add(1)
+		w.WriteHeader(http.StatusInternalServerError)
+	})
+	good := newTestServer(t, nameHandler("good"))
+
+	l := newTestLB(t)
+	l.backendOpts.breaker = breakerOptions{threshold: 3, window: time.Minute, cooldown: time.Hour}
+	backends := addTestBackends(t, l, bad.URL, good.URL)
+
+	for range 20 {
+		get(l, "/")
+	}
+	if n := failing.Load(); n != 3 {
+		t.Fatalf("failing backend got %d requests, want 3 before the breaker opened", n)
+	}
+	if s := backends[0].breaker.currentState(); s != breakerOpen {
+		t.Fatalf("breaker is %s, want open", s)
+	}
+	if rec := get(l, "/"); rec.Body.String() != "good" {
+		t.Fatalf("body = %q, want traffic on the healthy backend", rec.Body)
+	}
+}
+
+// failRequest records a failed request on c as if acquire admitted it.
+func failRequest(c *circuitBreaker) {
+	if gen, ok := c.acquire(); ok {
+		c.record(gen, false)
+	}
+}
+
+func TestBreakerHalfOpenTrial(t *testing.T) {
+	c := newCircuitBreaker(breakerOptions{threshold: 2, window: time.Minute, cooldown: 20 * time.Millisecond}, "test")
+	failRequest(c)
+	failRequest(c)
+	if _, ok := c.acquire(); ok {
+		t.Fatal("acquire succeeded on an open breaker")
+	}
+
+	time.Sleep(30 * time.Millisecond)
+	gen, ok := c.acquire()
+	if !ok {
+		t.Fatal("no trial after the cooldown")
+	}
+	if _, ok := c.acquire(); ok || c.ready() {
+		t.Fatal("second request let through during the trial")
+	}
+	if state, _ := c.record(gen, true); state != breakerClosed {
+		t.Fatalf("state after a successful trial = %s, want closed", state)
+	}
+}
+
+func TestBreakerTrialIgnoresEarlierRequests(t *testing.T) {
+	c := newCircuitBreaker(breakerOptions{threshold: 1, window: time.Minute, cooldown: 20 * time.Millisecond}, "test")
+	//Admitted while closed, still running when the breaker opens
+	stale, _ := c.acquire()
+	failRequest(c)
+
+	time.Sleep(30 * time.Millisecond)
+	trial, ok := c.acquire()
+	if !ok {
+		t.Fatal("no trial after the cooldown")
+	}
+	if _, changed := c.record(stale, true); changed || c.currentState() != breakerHalfOpen {
+		t.Fatalf("request from before the breaker opened decided the trial, state %s", c.currentState())
+	}
+	if _, ok := c.acquire(); ok {
+		t.Fatal("trial released by a request other than the trial")
+	}
+	if state, _ := c.record(trial, false); state != breakerOpen {
+		t.Fatalf("state after a failed trial = %s, want open", state)
+	}
+	if _, changed := c.record(trial, true); changed {
+		t.Fatal("trial outcome recorded twice")
+	}
+}
+
+func TestBreakerReleasesAbortedTrial(t *testing.T) {
+	//Promise a body, then hang up halfway so the proxy aborts the handler
+	srv := newTestServer(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Length", "100")
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte("partial"))
+		w.(http.Flusher).Flush()
+		conn, _, err := w.(http.Hijacker).Hijack()
+		if err == nil {
+			conn.Close()
+		}
+	})
+
+	l := newTestLB(t)
+	l.backendOpts.breaker = breakerOptions{threshold: 1, window: time.Minute, cooldown: 20 * time.Millisecond}
+	b := addTestBackends(t, l, srv.URL)[0]
+	failRequest(b.breaker)
+	time.Sleep(30 * time.Millisecond)
+
+	//ReverseProxy only aborts requests that came through an http.Server
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req = req.WithContext(context.WithValue(req.Context(), http.ServerContextKey, &http.Server{}))
+	func() {
+		defer func() {
+			if v := recover(); v != http.ErrAbortHandler {
+				t.Fatalf("recovered %v, want http.ErrAbortHandler", v)
+			}
+		}()
+		l.serveBackend(&l.pool, b, httptest.NewRecorder(), req)
+	}()
+
+	if s := b.breaker.currentState(); s != breakerOpen {
+		t.Fatalf("breaker is %s after an aborted trial, want open", s)
+	}
+	time.Sleep(30 * time.Millisecond)
+	if _, ok := b.breaker.acquire(); !ok {
+		t.Fatal("aborted trial is still held, no new trial allowed")
+	}
+}
+
+func TestBreakerStatusExposed(t *testing.T) {
+	srv := newTestServer(t, func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	})
+	l := newTestLB(t)
+	l.backendOpts.breaker = breakerOptions{threshold: 2, window: time.Minute, cooldown: time.Hour}
+	b := addTestBackends(t, l, srv.URL)[0]
+
+	if s := newBackendStatus(b).Breaker; s == nil || s.State != "closed" || s.OpenedAt != nil {
+		t.Fatalf("breaker status before any failure = %+v, want closed", s)
+	}
+	trips := testutil.ToFloat64(breakerTripsTotal.WithLabelValues(srv.URL))
+
+	before := time.Now()
+	get(l, "/")
+	get(l, "/")
+	s := newBackendStatus(b).Breaker
+	if s == nil || s.State != "open" || s.Trips != 1 || s.OpenedAt == nil || s.OpenedAt.Before(before) {
+		t.Fatalf("breaker status after tripping = %+v, want open since the second failure", s)
+	}
+	if v := testutil.ToFloat64(breakerStateGauge.WithLabelValues(srv.URL)); v != float64(breakerOpen) {
+		t.Errorf("state gauge = %v, want %d for open", v, breakerOpen)
+	}
+	if v := testutil.ToFloat64(breakerTripsTotal.WithLabelValues(srv.URL)) - trips; v != 1 {
+		t.Errorf("trips counter rose by %v, want 1", v)
+	}
+
+	//Stats leave the breaker out when it is disabled
+	plain := newTestBackEnd(t, BackendConfig{URL: srv.URL}, backendOptions{})
+	if s := newBackendStatus(plain).Breaker; s != nil {
+		t.Errorf("disabled breaker reported as %+v", s)
+	}
+}
@@ -0,0 +1,219 @@
+package main
+
+import (
+	"bufio"
+	"container/list"
+	"net"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// maxCachedBody is the largest response body kept in the cache.
+const maxCachedBody = 1 << 20
+
+// responseCache keeps upstream GET responses in memory for as long as
+// their Cache-Control max-age allows, evicting the least recently used
+// entry once maxEntries are stored.
+type responseCache struct {
+	maxEntries int
+
+	mux     sync.Mutex
+	lru     *list.List
+	entries map[string]*list.Element
+}
+
+type cachedResponse struct {
+	key     string
+	status  int
+	header  http.Header
+	body    []byte
+	stored  time.Time
+	expires time.Time
+}
+
+func newResponseCache(maxEntries int) *responseCache {
+	return &responseCache{
+		maxEntries: maxEntries,
+		lru:        list.New(),
+		entries:    make(map[string]*list.Element),
+	}
+}
+
+// cacheKey identifies requests that get the same response.
+func cacheKey(r *http.Request) string {
+	return r.Method + " " + r.Host + r.URL.RequestURI()
+}
+
+// cacheableRequest reports whether r may be answered from the cache.
+// Requests carrying credentials are always sent to a backend.
+func cacheableRequest(r *http.Request) bool {
+	if r.Method != http.MethodGet || r.Header.Get("Authorization") != "" {
+		return false
+	}
+	cc := r.Header.Get("Cache-Control")
+	return !strings.Contains(cc, "no-cache") && !strings.Contains(cc, "no-store")
+}
+
+// get returns the live entry for key, or nil.
+func (c *responseCache) get(key string) *cachedResponse {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+
+	el, ok := c.entries[key]
+	if !ok {
+		return nil
+	}
+	e := el.Value.(*cachedResponse)
+	if time.Now().After(e.expires) {
+		c.lru.Remove(el)
+		delete(c.entries, key)
+		return nil
+	}
+	c.lru.MoveToFront(el)
+	return e
+}
+
+// store keeps the response captured by cw if upstream allows caching it.
+func (c *responseCache) store(key string, cw *cacheWriter) {
+	if cw.status != http.StatusOK || cw.overflow {
+		return
+	}
+	ttl, ok := cacheTTL(cw.header)
+	if !ok {
+		return
+	}
+
+	now := time.Now()
+	e := &cachedResponse{
+		key:     key,
+		status:  cw.status,
+		header:  cw.header,
+		body:    cw.body,
+		stored:  now,
+		expires: now.Add(ttl),
+	}
+	e.header.Del("X-Cache")
+
+	c.mux.Lock()
+	defer c.mux.Unlock()
+
+	if el, ok := c.entries[key]; ok {
+		el.Value = e
+		c.lru.MoveToFront(el)
+		return
+	}
+	c.entries[key] = c.lru.PushFront(e)
+	for c.lru.Len() > c.maxEntries {
+		oldest := c.lru.Back()
+		c.lru.Remove(oldest)
+		delete(c.entries, oldest.Value.(*cachedResponse).key)
+	}
+}
+
+// cacheTTL returns how long a response with header h may be cached.
+// Only responses with a positive max-age qualify; no-store, no-cache,
+// private, Set-Cookie and Vary all keep a response out of the cache.
+func cacheTTL(h http.Header) (time.Duration, bool) {
+	if h.Get("Set-Cookie") != "" || h.Get("Vary") != "" || h.Get("Content-Encoding") != "" {
+		return 0, false
+	}
+
+	var maxAge int
+	for _, d := range strings.Split(h.Get("Cache-Control"), ",") {
+		name, value, _ := strings.Cut(strings.TrimSpace(strings.ToLower(d)), "=")
+		switch name {
+		case "no-store", "no-cache", "private":
+			return 0, false
+		case "max-age":
+			n, err := strconv.Atoi(value)
+			if err != nil {
+				return 0, false
+			}
+			maxAge = n
+		}
+	}
+	if maxAge <= 0 {
+		return 0, false
+	}
+	return time.Duration(maxAge) * time.Second, true
+}
+
+// write sends the cached response to w.
+func (e *cachedResponse) write(w http.ResponseWriter) {
+	h := w.Header()
+	for k, v := range e.header {
+		h[k] = v
+	}
+	h.Set("X-Cache", "HIT")
+	h.Set("Age", strconv.Itoa(int(time.Since(e.stored).Seconds())))
+	w.WriteHeader(e.status)
+	w.Write(e.body)
+}
+
+// cacheWriter passes a response through to the client while keeping a
+// copy of it for the cache. Bodies over maxCachedBody are not kept.
+type cacheWriter struct {
+	http.ResponseWriter
+	//Sticky session cookie set by the load balancer, left out of the copy
+	stickyCookie string
+	status       int
+	header       http.Header
+	body         []byte
+	overflow     bool
+}
+
+func (c *cacheWriter) WriteHeader(code int) {
+	if c.status == 0 {
+		c.status = code
+		c.header = c.Header().Clone()
+		if c.stickyCookie != "" {
+			dropCookie(c.header, c.stickyCookie)
+		}
+	}
+	c.ResponseWriter.WriteHeader(code)
+}
+
+// dropCookie removes the Set-Cookie values for the cookie name from h.
+func dropCookie(h http.Header, name string) {
+	kept := slices.DeleteFunc(h["Set-Cookie"], func(v string) bool {
+		return strings.HasPrefix(v, name+"=")
+	})
+	if len(kept) == 0 {
+		h.Del("Set-Cookie")
+		return
+	}
+	h["Set-Cookie"] = kept
+}
+
+func (c *cacheWriter) Write(p []byte) (int, error) {
+	if c.status == 0 {
+		c.WriteHeader(http.StatusOK)
+	}
+	if !c.overflow {
+		if len(c.body)+len(p) > maxCachedBody {
+			c.overflow = true
+			c.body = nil
+		} else {
+			c.body = append(c.body, p...)
+		}
+	}
+	return c.ResponseWriter.Write(p)
+}
+
+func (c *cacheWriter) Flush() {
+	http.NewResponseController(c.ResponseWriter).Flush()
+}
+
+func (c *cacheWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	//An upgraded connection is never a cacheable response
+	c.overflow = true
+	return http.NewResponseController(c.ResponseWriter).Hijack()
+}
+
+func (c *cacheWriter) Unwrap() http.ResponseWriter {
+	return c.ResponseWriter
+}
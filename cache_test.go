@@ -0,0 +1,136 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+)
+
+// cacheableHandler counts its requests and answers body with a
+// Cache-Control header allowing a minute of caching.
+func cacheableHandler(n *atomic.Int64, body string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		n.Add(1)
+		w.Header().Set("Cache-Control", "max-age=60")
+		io.WriteString(w, body)
+	}
+}
+
+func TestCacheHit(t *testing.T) {
+	var hits atomic.Int64
+	l := newTestLB(t, newTestServer(t, cacheableHandler(&hits, "cached")).URL)
+	l.cache = newResponseCache(10)
+
+	first := get(l, "/page")
+	if first.Header().Get("X-Cache") != "MISS" || first.Body.String() != "cached" {
+		t.Fatalf("first request: X-Cache %q, body %q", first.Header().Get("X-Cache"), first.Body)
+	}
+	second := get(l, "/page")
+	if second.Header().Get("X-Cache") != "HIT" || second.Body.String() != "cached" || second.Header().Get("Age") == "" {
+		t.Fatalf("second request: X-Cache %q, Age %q, body %q, want a hit", second.Header().Get("X-Cache"), second.Header().Get("Age"), second.Body)
+	}
+	if n := hits.Load(); n != 1 {
+		t.Fatalf("upstream answered %d requests, want 1", n)
+	}
+
+	//Credentials, other methods and no-cache requests go upstream
+	post := httptest.NewRequest(http.MethodPost, "/page", nil)
+	auth := httptest.NewRequest(http.MethodGet, "/page", nil)
+	auth.Header.Set("Authorization", "Bearer x")
+	noCache := httptest.NewRequest(http.MethodGet, "/page", nil)
+	noCache.Header.Set("Cache-Control", "no-cache")
+	for _, req := range []*http.Request{post, auth, noCache} {
+		before := hits.Load()
+		serve(l, req)
+		if hits.Load() == before {
+			t.Errorf("%s with %v answered from the cache", req.Method, req.Header)
+		}
+	}
+}
+
+func TestCacheTTL(t *testing.T) {
+	for _, tc := range []struct {
+		header http.Header
+		ok     bool
+	}{
+		{http.Header{"Cache-Control": {"public, max-age=30"}}, true},
+		{http.Header{}, false},
+		{http.Header{"Cache-Control": {"max-age=0"}}, false},
+		{http.Header{"Cache-Control": {"private, max-age=30"}}, false},
+		{http.Header{"Cache-Control": {"no-store"}}, false},
+		{http.Header{"Cache-Control": {"max-age=30"}, "Set-Cookie": {"session=1"}}, false},
+		{http.Header{"Cache-Control": {"max-age=30"}, "Vary": {"Accept"}}, false},
+	} {
+		if _, ok := cacheTTL(tc.header); ok != tc.ok {
+			t.Errorf("cacheTTL(%v) cacheable = %v, want %v", tc.header, ok, tc.ok)
+		}
+	}
+}
+
+func TestTruncatedResponseNotCached(t *testing.T) {
+	var hits atomic.Int64
+	srv := newTestServer(t, func(w http.ResponseWriter, r *http.Request) {
+		hits.Add(1)
+		w.Header().Set("Cache-Control", "max-age=60")
+		w.Header().Set("Content-Length", "100")
+		io.WriteString(w, "partial")
+		if conn, _, err := w.(http.Hijacker).Hijack(); err == nil {
+			conn.Close()
+		}
+	})
+	l := newTestLB(t, srv.URL)
+	l.cache = newResponseCache(10)
+
+	for range 2 {
+		//ReverseProxy only aborts requests that came through an http.Server
+		req := httptest.NewRequest(http.MethodGet, "/page", nil)
+		req = req.WithContext(context.WithValue(req.Context(), http.ServerContextKey, &http.Server{}))
+		func() {
+			defer func() { recover() }()
+			serve(l, req)
+		}()
+	}
+	if n := hits.Load(); n != 2 {
+		t.Fatalf("upstream answered %d requests, want the truncated response kept out of the cache", n)
+	}
+}
+
+func TestStickyResponseStillCached(t *testing.T) {
+	var hits atomic.Int64
+	l := newTestLB(t)
+	l.stickyCookie = "lb_backend"
+	l.strategy = &StickyStrategy{Cookie: l.stickyCookie, Next: &RoundRobinStrategy{}}
+	l.cache = newResponseCache(10)
+	addTestBackends(t, l, newTestServer(t, cacheableHandler(&hits, "a")).URL)
+
+	first := get(l, "/page")
+	if stickyCookie(first) == nil {
+		t.Fatal("first response set no sticky cookie")
+	}
+	second := get(l, "/page")
+	if second.Header().Get("X-Cache") != "HIT" {
+		t.Fatalf("X-Cache = %q, want the response cached despite the sticky cookie", second.Header().Get("X-Cache"))
+	}
+	//The cookie pinned the first client, it must not be handed to others
+	if stickyCookie(second) != nil {
+		t.Fatal("cached response replays the sticky cookie")
+	}
+}
+
+func TestRateLimitAppliesToCacheHits(t *testing.T) {
+	var hits atomic.Int64
+	l := newTestLB(t, newTestServer(t, cacheableHandler(&hits, "cached")).URL)
+	l.cache = newResponseCache(10)
+	l.limiter = newRateLimiter(0.001, 2)
+
+	get(l, "/page")
+	if rec := get(l, "/page"); rec.Header().Get("X-Cache") != "HIT" {
+		t.Fatalf("X-Cache = %q, want a hit", rec.Header().Get("X-Cache"))
+	}
+	if rec := get(l, "/page"); rec.Code != http.StatusTooManyRequests {
+		t.Fatalf("status = %d, want cache hits to use up the client's budget", rec.Code)
+	}
+}
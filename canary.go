@@ -0,0 +1,71 @@
+package main
+
+import (
+	"fmt"
+	"math/rand/v2"
+)
+
+// CanaryConfig sends a share of a pool's traffic to its canary backends.
+type CanaryConfig struct {
+	// Percent of requests, 0-100, routed to canary backends.
+	Percent float64 `yaml:"percent"`
+	// Tags identify canary backends, tier: canary by default.
+	Tags map[string]string `yaml:"tags"`
+}
+
+func (c *CanaryConfig) validate() error {
+	if c.Percent < 0 || c.Percent > 100 {
+		return fmt.Errorf("canary percent must be within 0-100, got %v", c.Percent)
+	}
+	return nil
+}
+
+// canarySplit is a loaded CanaryConfig.
+type canarySplit struct {
+	percent float64
+	tags    map[string]string
+}
+
+// split returns the compiled config, or nil when canary routing is off.
+func (c *CanaryConfig) split() *canarySplit {
+	if c.Percent <= 0 {
+		return nil
+	}
+	tags := c.Tags
+	if len(tags) == 0 {
+		tags = map[string]string{"tier": "canary"}
+	}
+	return &canarySplit{percent: c.Percent, tags: tags}
+}
+
+// pick returns the canary or the stable subset of backends for one
+// request. When the drawn subset has no available backend the other one
+// is used, so a broken canary fleet never turns into errors.
+func (s *canarySplit) pick(backends []*BackEnd) []*BackEnd {
+	var canary, stable []*BackEnd
+	for _, b := range backends {
+		if b.hasTags(s.tags) {
+			canary = append(canary, b)
+		} else {
+			stable = append(stable, b)
+		}
+	}
+
+	chosen, other := stable, canary
+	if rand.Float64()*100 < s.percent {
+		chosen, other = canary, stable
+	}
+	if !anyAvailable(chosen) {
+		return other
+	}
+	return chosen
+}
+
+func anyAvailable(backends []*BackEnd) bool {
+	for _, b := range backends {
+		if b.isAvailable() {
+			return true
+		}
+	}
+	return false
+}
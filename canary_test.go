@@ -0,0 +1,96 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestCanaryShare(t *testing.T) {
+	l := newRoutedLB(t, `
+canary:
+  percent: 20
+backends:
+  - http://stable-1
+  - http://stable-2
+  - {url: "http://canary-1", tags: {tier: canary}}
+`)
+
+	const requests = 10000
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	canary := 0
+	for range requests {
+		if b := l.nextBackend(l.candidates(), req); b.url.Host == "canary-1" {
+			canary++
+		}
+	}
+	if share := float64(canary) / requests; share < 0.18 || share > 0.22 {
+		t.Fatalf("canary got %.3f of requests, want about 0.20", share)
+	}
+}
+
+func TestWeightedRoundRobinSharesWithCanary(t *testing.T) {
+	l := newRoutedLB(t, `
+canary:
+  percent: 50
+backends:
+  - {url: "http://heavy", weight: 2}
+  - http://light
+  - {url: "http://canary-1", tags: {tier: canary}}
+`)
+	s := &WeightedRoundRobinStrategy{}
+	l.strategy = s
+
+	//Canary picks must not reset the running totals of the stable fleet
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	picked := make(map[string]int)
+	for range 3000 {
+		picked[l.nextBackend(l.candidates(), req).url.Host]++
+	}
+	if d := picked["heavy"] - 2*picked["light"]; d < -2 || d > 2 {
+		t.Fatalf("picks = %v, want heavy at twice the share of light", picked)
+	}
+	if share := float64(picked["canary-1"]) / 3000; share < 0.45 || share > 0.55 {
+		t.Fatalf("canary got %.3f of requests, want about 0.50", share)
+	}
+
+	if !l.removeBackend(l.findBackend("http://light")) {
+		t.Fatal("removing light failed")
+	}
+	if n := len(s.current); n != 2 {
+		t.Fatalf("strategy keeps state for %d backends after a removal, want 2", n)
+	}
+}
+
+func TestCanaryFallsBackWhenSubsetDown(t *testing.T) {
+	l := newRoutedLB(t, `
+canary:
+  percent: 100
+  tags: {track: beta}
+backends:
+  - http://stable
+  - {url: "http://beta", tags: {track: beta}}
+`)
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	if b := l.nextBackend(l.candidates(), req); b.url.Host != "beta" {
+		t.Fatalf("picked %s with 100%% canary traffic", b.url.Host)
+	}
+
+	l.findBackend("http://beta").setAlive(false)
+	for range 10 {
+		if b := l.nextBackend(l.candidates(), req); b == nil || b.url.Host != "stable" {
+			t.Fatal("down canary fleet not replaced by the stable one")
+		}
+	}
+}
+
+func TestCanaryConfigValidate(t *testing.T) {
+	for _, p := range []float64{-1, 101} {
+		if err := (&CanaryConfig{Percent: p}).validate(); err == nil {
+			t.Errorf("percent %v accepted", p)
+		}
+	}
+	if (&CanaryConfig{}).split() != nil {
+		t.Error("zero percent enabled canary routing")
+	}
+}
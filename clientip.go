@@ -0,0 +1,98 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+)
+
+type clientIPKey struct{}
+
+// forwardTrust decides whose forwarding headers are believed.
+type forwardTrust struct {
+	//Set by -trust-forwarded
+	enabled bool
+	//Peers allowed to forward for others, empty trusts nobody
+	proxies []netip.Prefix
+}
+
+// parseTrustedProxies parses a comma-separated list of CIDR ranges or
+// single IPs.
+func parseTrustedProxies(list string) ([]netip.Prefix, error) {
+	var prefixes []netip.Prefix
+	for _, entry := range strings.Split(list, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		if !strings.Contains(entry, "/") {
+			addr, err := netip.ParseAddr(entry)
+			if err != nil {
+				return nil, fmt.Errorf("invalid trusted proxy %q: %w", entry, err)
+			}
+			prefixes = append(prefixes, netip.PrefixFrom(addr, addr.BitLen()))
+			continue
+		}
+		p, err := netip.ParsePrefix(entry)
+		if err != nil {
+			return nil, fmt.Errorf("invalid trusted proxy %q: %w", entry, err)
+		}
+		prefixes = append(prefixes, p.Masked())
+	}
+	return prefixes, nil
+}
+
+// remoteHost returns the host part of r.RemoteAddr.
+func remoteHost(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// trusts reports whether the direct peer of r may set forwarding
+// headers: forwarding must be enabled and the peer within proxies.
+func (t forwardTrust) trusts(r *http.Request) bool {
+	if !t.enabled {
+		return false
+	}
+	addr, err := netip.ParseAddr(remoteHost(r))
+	if err != nil {
+		return false
+	}
+	addr = addr.Unmap()
+	for _, p := range t.proxies {
+		if p.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// withClientIP resolves the originating client address of r once, so
+// strategies, the rate limiter and the logs all agree on it. The first
+// entry of X-Forwarded-For wins when present and the peer is trusted,
+// otherwise the host part of RemoteAddr is used.
+func (t forwardTrust) withClientIP(r *http.Request) *http.Request {
+	ip := remoteHost(r)
+	if xff := r.Header.Get("X-Forwarded-For"); xff != "" && t.trusts(r) {
+		first, _, _ := strings.Cut(xff, ",")
+		if v := strings.TrimSpace(first); v != "" {
+			ip = v
+		}
+	}
+	return r.WithContext(context.WithValue(r.Context(), clientIPKey{}, ip))
+}
+
+// clientIP returns the client address resolved by withClientIP, or the
+// peer address for requests that didn't go through it.
+func clientIP(r *http.Request) string {
+	if ip, ok := r.Context().Value(clientIPKey{}).(string); ok {
+		return ip
+	}
+	return remoteHost(r)
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"bufio"
+	"compress/gzip"
+	"mime"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// compressibleTypes are the response content types worth gzipping.
+// Anything else (images, archives, video) is usually compressed already.
+var compressibleTypes = map[string]bool{
+	"application/javascript": true,
+	"application/json":       true,
+	"application/xml":        true,
+	"image/svg+xml":          true,
+}
+
+var gzipWriters = sync.Pool{
+	New: func() any { return gzip.NewWriter(nil) },
+}
+
+func acceptsGzip(r *http.Request) bool {
+	if r.Method == http.MethodHead || r.Header.Get("Upgrade") != "" {
+		return false
+	}
+	for _, enc := range strings.Split(r.Header.Get("Accept-Encoding"), ",") {
+		name, params, _ := strings.Cut(enc, ";")
+		if strings.EqualFold(strings.TrimSpace(name), "gzip") {
+			return qValue(params) > 0
+		}
+	}
+	return false
+}
+
+// qValue returns the q parameter of an Accept-Encoding entry, 1 when
+// absent. A malformed one counts as 0 since identity is always safe.
+func qValue(params string) float64 {
+	for _, param := range strings.Split(params, ";") {
+		key, value, _ := strings.Cut(param, "=")
+		if !strings.EqualFold(strings.TrimSpace(key), "q") {
+			continue
+		}
+		q, err := strconv.ParseFloat(strings.TrimSpace(value), 64)
+		if err != nil {
+			return 0
+		}
+		return q
+	}
+	return 1
+}
+
+func compressibleType(contentType string) bool {
+	mt, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	return strings.HasPrefix(mt, "text/") || compressibleTypes[mt]
+}
+
+// gzipResponseWriter compresses eligible responses. Bodies are buffered
+// until minSize bytes have been seen so small responses go out as-is.
+type gzipResponseWriter struct {
+	http.ResponseWriter
+	minSize int
+
+	status  int
+	pending bool
+	gz      *gzip.Writer
+	buf     []byte
+}
+
+func newGzipResponseWriter(w http.ResponseWriter, minSize int) *gzipResponseWriter {
+	return &gzipResponseWriter{ResponseWriter: w, minSize: minSize}
+}
+
+func (g *gzipResponseWriter) WriteHeader(code int) {
+	if g.status != 0 {
+		return
+	}
+	g.status = code
+
+	if g.eligible() {
+		g.pending = true
+		return
+	}
+	g.ResponseWriter.WriteHeader(code)
+}
+
+func (g *gzipResponseWriter) eligible() bool {
+	h := g.Header()
+	if g.status < http.StatusOK || g.status == http.StatusNoContent || g.status == http.StatusNotModified {
+		return false
+	}
+	//Byte ranges refer to the identity body, gzipping them breaks resumes
+	if g.status == http.StatusPartialContent || h.Get("Content-Range") != "" {
+		return false
+	}
+	if h.Get("Content-Encoding") != "" || !compressibleType(h.Get("Content-Type")) {
+		return false
+	}
+	if cl, err := strconv.Atoi(h.Get("Content-Length")); err == nil && cl < g.minSize {
+		return false
+	}
+	return true
+}
+
+func (g *gzipResponseWriter) Write(p []byte) (int, error) {
+	if g.status == 0 {
+		g.WriteHeader(http.StatusOK)
+	}
+
+	switch {
+	case g.gz != nil:
+		return g.gz.Write(p)
+	case !g.pending:
+		return g.ResponseWriter.Write(p)
+	}
+
+	g.buf = append(g.buf, p...)
+	if len(g.buf) >= g.minSize {
+		if err := g.startGzip(); err != nil {
+			return 0, err
+		}
+	}
+	return len(p), nil
+}
+
+// startGzip commits to a compressed response and writes what was buffered.
+func (g *gzipResponseWriter) startGzip() error {
+	h := g.Header()
+	h.Del("Content-Length")
+	h.Set("Content-Encoding", "gzip")
+	h.Add("Vary", "Accept-Encoding")
+	g.ResponseWriter.WriteHeader(g.status)
+
+	g.pending = false
+	g.gz = gzipWriters.Get().(*gzip.Writer)
+	g.gz.Reset(g.ResponseWriter)
+
+	_, err := g.gz.Write(g.buf)
+	g.buf = nil
+	return err
+}
+
+func (g *gzipResponseWriter) Flush() {
+	//A flush means the client needs the bytes now, stop waiting for minSize
+	if g.pending {
+		g.startGzip()
+	}
+	if g.gz != nil {
+		g.gz.Flush()
+	}
+	http.NewResponseController(g.ResponseWriter).Flush()
+}
+
+// Close finishes the response. Bodies that never reached minSize are
+// sent uncompressed.
+func (g *gzipResponseWriter) Close() error {
+	if g.pending {
+		g.pending = false
+		g.ResponseWriter.WriteHeader(g.status)
+		_, err := g.ResponseWriter.Write(g.buf)
+		g.buf = nil
+		return err
+	}
+
+	if g.gz == nil {
+		return nil
+	}
+	err := g.gz.Close()
+	gzipWriters.Put(g.gz)
+	g.gz = nil
+	return err
+}
+
+func (g *gzipResponseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	return http.NewResponseController(g.ResponseWriter).Hijack()
+}
+
+func (g *gzipResponseWriter) Unwrap() http.ResponseWriter {
+	return g.ResponseWriter
+}
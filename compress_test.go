@@ -0,0 +1,116 @@
+package main
+
+import (
+	"compress/gzip"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// contentHandler answers with body as contentType, optionally encoded.
+func contentHandler(contentType, encoding, body string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", contentType)
+		if encoding != "" {
+			w.Header().Set("Content-Encoding", encoding)
+		}
+		io.WriteString(w, body)
+	}
+}
+
+// getGzip sends a GET for / accepting gzip to h.
+func getGzip(h http.Handler) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set("Accept-Encoding", "gzip, deflate")
+	return serve(h, req)
+}
+
+func TestGzipLargeTextResponse(t *testing.T) {
+	body := strings.Repeat("hello, world\n", 500)
+	srv := newTestServer(t, contentHandler("text/plain; charset=utf-8", "", body))
+	l := newTestLB(t, srv.URL)
+	l.compressMinSize = 1024
+
+	rec := getGzip(l)
+	if rec.Header().Get("Content-Encoding") != "gzip" {
+		t.Fatalf("Content-Encoding = %q, want gzip", rec.Header().Get("Content-Encoding"))
+	}
+	if !strings.Contains(rec.Header().Get("Vary"), "Accept-Encoding") {
+		t.Errorf("Vary = %q, want Accept-Encoding", rec.Header().Get("Vary"))
+	}
+	if rec.Body.Len() >= len(body) {
+		t.Errorf("compressed body is %d bytes, original %d", rec.Body.Len(), len(body))
+	}
+	zr, err := gzip.NewReader(rec.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := io.ReadAll(zr)
+	if err != nil || string(got) != body {
+		t.Fatalf("decompressed body differs: %v", err)
+	}
+}
+
+func TestGzipSkipsIneligibleResponses(t *testing.T) {
+	large := strings.Repeat("x", 4096)
+	for _, tc := range []struct {
+		name    string
+		handler http.HandlerFunc
+		accept  bool
+	}{
+		{"small", contentHandler("text/plain", "", "tiny"), true},
+		{"image", contentHandler("image/png", "", large), true},
+		{"already encoded", contentHandler("text/plain", "br", large), true},
+		{"client without gzip", contentHandler("text/plain", "", large), false},
+		{"partial content", func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "text/plain")
+			w.Header().Set("Content-Range", "bytes 0-4095/8192")
+			w.WriteHeader(http.StatusPartialContent)
+			io.WriteString(w, large)
+		}, true},
+		{"content range", func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "text/plain")
+			w.Header().Set("Content-Range", "bytes */8192")
+			w.WriteHeader(http.StatusRequestedRangeNotSatisfiable)
+			io.WriteString(w, large)
+		}, true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			l := newTestLB(t, newTestServer(t, tc.handler).URL)
+			l.compressMinSize = 1024
+
+			rec := get(l, "/")
+			if tc.accept {
+				rec = getGzip(l)
+			}
+			if rec.Header().Get("Content-Encoding") == "gzip" {
+				t.Fatal("response was gzipped")
+			}
+		})
+	}
+}
+
+func TestAcceptsGzip(t *testing.T) {
+	for _, tc := range []struct {
+		accept string
+		want   bool
+	}{
+		{"gzip", true},
+		{"deflate, GZIP", true},
+		{"gzip;q=0.5, br", true},
+		{"gzip ; q=1.0", true},
+		{"gzip;q=0", false},
+		{"br, gzip;q=0.000", false},
+		{"gzip;q=high", false},
+		{"deflate", false},
+		{"", false},
+	} {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.Header.Set("Accept-Encoding", tc.accept)
+		if got := acceptsGzip(req); got != tc.want {
+			t.Errorf("acceptsGzip(%q) = %v, want %v", tc.accept, got, tc.want)
+		}
+	}
+}
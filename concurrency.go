@@ -0,0 +1,56 @@
+package main
+
+import (
+	"context"
+	"time"
+)
+
+// concurrencyLimiter caps the number of requests in flight across all
+// backends. Requests over the limit wait up to wait for a slot.
+type concurrencyLimiter struct {
+	sem  chan struct{}
+	wait time.Duration
+}
+
+func newConcurrencyLimiter(limit int, wait time.Duration) *concurrencyLimiter {
+	return &concurrencyLimiter{
+		sem:  make(chan struct{}, limit),
+		wait: wait,
+	}
+}
+
+// acquire takes a slot and reports whether one became free in time.
+// Every successful acquire must be paired with release.
+func (c *concurrencyLimiter) acquire(ctx context.Context) bool {
+	select {
+	case c.sem <- struct{}{}:
+	default:
+		if !c.waitSlot(ctx) {
+			globalRejectedTotal.Inc()
+			return false
+		}
+	}
+	globalInFlight.Inc()
+	return true
+}
+
+func (c *concurrencyLimiter) waitSlot(ctx context.Context) bool {
+	if c.wait <= 0 {
+		return false
+	}
+	t := time.NewTimer(c.wait)
+	defer t.Stop()
+	select {
+	case c.sem <- struct{}{}:
+		return true
+	case <-t.C:
+		return false
+	case <-ctx.Done():
+		return false
+	}
+}
+
+func (c *concurrencyLimiter) release() {
+	<-c.sem
+	globalInFlight.Dec()
+}
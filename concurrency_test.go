@@ -0,0 +1,192 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// blockingHandler signals on started for every request and answers name
+// once release is closed.
+func blockingHandler(name string, started chan<- struct{}, release <-chan struct{}) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		started <- struct{}{}
+		<-release
+		io.WriteString(w, name)
+	}
+}
+
+func TestMaxConnsSpillsOver(t *testing.T) {
+	started := make(chan struct{}, 1)
+	release := make(chan struct{})
+	capped := newTestServer(t, blockingHandler("capped", started, release))
+	free := newTestServer(t, nameHandler("free"))
+
+	l := newTestLB(t)
+	if err := l.addBackend(newTestBackEnd(t, BackendConfig{URL: capped.URL, MaxConns: 1}, l.backendOpts)); err != nil {
+		t.Fatal(err)
+	}
+	addTestBackends(t, l, free.URL)
+
+	held := make(chan *httptest.ResponseRecorder)
+	go func() { held <- get(l, "/") }()
+	select {
+	case <-started:
+	case rec := <-held:
+		//Round-robin sent the first request to the free backend, try again
+		if rec.Body.String() != "free" {
+			t.Fatalf("body = %q", rec.Body)
+		}
+		go func() { held <- get(l, "/") }()
+		<-started
+	}
+
+	for range 5 {
+		if rec := get(l, "/"); rec.Body.String() != "free" {
+			t.Fatalf("body = %q, want requests to spill over to the free backend", rec.Body)
+		}
+	}
+	close(release)
+	if rec := <-held; rec.Body.String() != "capped" {
+		t.Fatalf("held request got %q", rec.Body)
+	}
+}
+
+func TestMaxConnsAllSaturated(t *testing.T) {
+	started := make(chan struct{}, 1)
+	release := make(chan struct{})
+	srv := newTestServer(t, blockingHandler("ok", started, release))
+
+	l := newTestLB(t)
+	if err := l.addBackend(newTestBackEnd(t, BackendConfig{URL: srv.URL, MaxConns: 1}, l.backendOpts)); err != nil {
+		t.Fatal(err)
+	}
+
+	held := make(chan *httptest.ResponseRecorder)
+	go func() { held <- get(l, "/") }()
+	<-started
+
+	if rec := get(l, "/"); rec.Code != http.StatusServiceUnavailable {
+		t.Fatalf("status = %d with every backend saturated, want 503", rec.Code)
+	}
+
+	//With a queue timeout the request waits for the slot instead
+	l.queueTimeout = 5 * time.Second
+	queued := make(chan *httptest.ResponseRecorder)
+	go func() { queued <- get(l, "/") }()
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+	<-held
+	<-started
+	if rec := <-queued; rec.Code != http.StatusOK {
+		t.Fatalf("queued request: status = %d, want 200", rec.Code)
+	}
+}
+
+// Run with -race: every request bumps the counter from its own goroutine.
+func TestInFlightCounting(t *testing.T) {
+	const clients = 20
+	started := make(chan struct{}, clients)
+	release := make(chan struct{})
+	srv := newTestServer(t, blockingHandler("ok", started, release))
+	l := newTestLB(t, srv.URL)
+	b := l.snapshot()[0]
+
+	var wg sync.WaitGroup
+	for range clients {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			get(l, "/")
+		}()
+	}
+	for range clients {
+		<-started
+	}
+	if n := b.activeConns(); n != clients {
+		t.Errorf("activeConns() = %d with %d requests in flight", n, clients)
+	}
+	if s := newBackendStatus(b); s.InFlight != clients {
+		t.Errorf("stats in_flight = %d, want %d", s.InFlight, clients)
+	}
+
+	close(release)
+	wg.Wait()
+	if n := b.activeConns(); n != 0 {
+		t.Fatalf("activeConns() = %d after every request finished", n)
+	}
+}
+
+func TestInFlightReleasedOnPanic(t *testing.T) {
+	srv := newTestServer(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Length", "100")
+		w.Write([]byte("partial"))
+		if conn, _, err := w.(http.Hijacker).Hijack(); err == nil {
+			conn.Close()
+		}
+	})
+	l := newTestLB(t, srv.URL)
+	b := l.snapshot()[0]
+
+	//ReverseProxy only aborts requests that came through an http.Server
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req = req.WithContext(context.WithValue(req.Context(), http.ServerContextKey, &http.Server{}))
+	func() {
+		defer func() { recover() }()
+		serve(l, req)
+	}()
+	if n := b.activeConns(); n != 0 {
+		t.Fatalf("activeConns() = %d after the proxy panicked", n)
+	}
+}
+
+func TestGlobalConcurrencyLimit(t *testing.T) {
+	started := make(chan struct{}, 2)
+	release := make(chan struct{})
+	l := newTestLB(t,
+		newTestServer(t, blockingHandler("a", started, release)).URL,
+		newTestServer(t, blockingHandler("b", started, release)).URL)
+	l.concurrency = newConcurrencyLimiter(2, 0)
+	rejected := testutil.ToFloat64(globalRejectedTotal)
+
+	//Two requests fill the limit, spread over both backends
+	held := make(chan *httptest.ResponseRecorder, 3)
+	for range 2 {
+		go func() { held <- get(l, "/") }()
+	}
+	<-started
+	<-started
+	if v := testutil.ToFloat64(globalInFlight); v != 2 {
+		t.Errorf("in-flight gauge = %v, want 2", v)
+	}
+
+	rec := get(l, "/")
+	if rec.Code != http.StatusServiceUnavailable || rec.Header().Get("Retry-After") == "" {
+		t.Fatalf("request over the limit: status %d, Retry-After %q, want 503 with Retry-After", rec.Code, rec.Header().Get("Retry-After"))
+	}
+	if v := testutil.ToFloat64(globalRejectedTotal) - rejected; v != 1 {
+		t.Errorf("rejected counter rose by %v, want 1", v)
+	}
+
+	//With a wait the request takes the first slot that frees up
+	l.concurrency.wait = 5 * time.Second
+	go func() { held <- get(l, "/") }()
+	time.Sleep(50 * time.Millisecond)
+	release <- struct{}{}
+	<-started
+	close(release)
+	for range 3 {
+		if rec := <-held; rec.Code != http.StatusOK {
+			t.Fatalf("status = %d, want every admitted request answered", rec.Code)
+		}
+	}
+	if v := testutil.ToFloat64(globalInFlight); v != 0 {
+		t.Errorf("in-flight gauge = %v after every request finished", v)
+	}
+}
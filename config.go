@@ -0,0 +1,505 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Config is the on-disk YAML layout for the load balancer.
+//
+//	backends:
+//	  - url: http://localhost:8081
+//	    weight: 2
+//	    health_path: /health
+//	    health_status: 200-299
+//	  - http://localhost:8082
+//	  - url: http://localhost:8083
+//	    health_mode: tcp
+//	    strip_prefix: /api
+//	    timeout: 2m
+//	  - url: http://localhost:8084
+//	    health_method: HEAD
+//	    health_headers:
+//	      Authorization: Bearer s3cret
+//	  - url: https://internal.example:8443
+//	    tags:
+//	      zone: us-east
+//	      tier: canary
+//	canary:
+//	  percent: 5
+//	tls:
+//	  ca_file: /etc/lb/internal-ca.pem
+//	consistent_hash:
+//	  key: header:X-User-ID
+//	  virtual_nodes: 100
+//	headers:
+//	  response:
+//	    set:
+//	      X-Content-Type-Options: nosniff
+//	    remove: [Server, X-Powered-By]
+//	pools:
+//	  api:
+//	    strategy: least-conn
+//	    health:
+//	      interval: 10s
+//	    backends:
+//	      - http://localhost:9001
+//	routes:
+//	  - host: api.example.com
+//	    pool: api
+//	  - path_prefix: /api
+//	    pool: api
+//	  - methods: [GET, HEAD]
+//	    pool: replicas
+//	  - sni: admin.example.com
+//	    pool: api
+//	unavailable:
+//	  file: /etc/lb/503.html
+//	  retry_after: 30
+//
+// Requests are matched against routes in order; unmatched ones go to
+// default_pool, or to the top-level backends when it is unset. With
+// neither they are answered with 404.
+type Config struct {
+	Backends       []BackendConfig       `yaml:"backends"`
+	TLS            BackendTLSConfig      `yaml:"tls"`
+	ConsistentHash ConsistentHashConfig  `yaml:"consistent_hash"`
+	Headers        HeadersConfig         `yaml:"headers"`
+	Pools          map[string]PoolConfig `yaml:"pools"`
+	Routes         []RouteConfig         `yaml:"routes"`
+	DefaultPool    string                `yaml:"default_pool"`
+	Unavailable    ErrorPageConfig       `yaml:"unavailable"`
+	// MatchTags restricts traffic of the top-level backends to those
+	// carrying all of these tags.
+	MatchTags map[string]string `yaml:"match_tags"`
+	Canary    CanaryConfig      `yaml:"canary"`
+}
+
+// PoolConfig describes a named backend pool.
+type PoolConfig struct {
+	Backends []BackendConfig `yaml:"backends"`
+	// Strategy is one of the -strategy names, round-robin by default.
+	Strategy string           `yaml:"strategy"`
+	Health   PoolHealthConfig `yaml:"health"`
+	// MatchTags restricts traffic to backends carrying all of these tags.
+	MatchTags map[string]string `yaml:"match_tags"`
+	Canary    CanaryConfig      `yaml:"canary"`
+}
+
+// PoolHealthConfig overrides the -health-* flags for one pool.
+type PoolHealthConfig struct {
+	Interval time.Duration `yaml:"interval"`
+	Timeout  time.Duration `yaml:"timeout"`
+	Fall     int           `yaml:"fall"`
+	Rise     int           `yaml:"rise"`
+}
+
+// apply returns opts with the fields set in h replaced.
+func (h PoolHealthConfig) apply(opts healthOptions) healthOptions {
+	if h.Interval > 0 {
+		opts.interval = h.Interval
+	}
+	if h.Timeout > 0 {
+		opts.timeout = h.Timeout
+	}
+	if h.Fall > 0 {
+		opts.fall = h.Fall
+	}
+	if h.Rise > 0 {
+		opts.rise = h.Rise
+	}
+	return opts
+}
+
+// RouteConfig sends requests matching all of Host, SNI, PathPrefix and
+// Methods that are set to Pool. SNI is the server name the client sent
+// in the TLS handshake, which may differ from the Host header.
+type RouteConfig struct {
+	Host       string   `yaml:"host"`
+	SNI        string   `yaml:"sni"`
+	PathPrefix string   `yaml:"path_prefix"`
+	Methods    []string `yaml:"methods"`
+	Pool       string   `yaml:"pool"`
+}
+
+// ConsistentHashConfig tunes the consistent hashing strategy. Key is
+// also used by ip-hash.
+type ConsistentHashConfig struct {
+	// Key is "ip", "path", "header:<Name>" or "query:<name>".
+	Key string `yaml:"key"`
+	// VirtualNodes is the number of ring points per backend.
+	VirtualNodes int `yaml:"virtual_nodes"`
+}
+
+// BackendTLSConfig controls how https:// backends are verified.
+type BackendTLSConfig struct {
+	// CAFile is a PEM bundle used instead of the system roots.
+	CAFile string `yaml:"ca_file"`
+	// InsecureSkipVerify disables certificate checks, for development only.
+	InsecureSkipVerify bool `yaml:"insecure_skip_verify"`
+}
+
+// BackendConfig describes a single upstream server. An entry may be
+// written as a plain URL string or as a mapping with optional fields.
+// The URL must be http or https, a bare host:port means http.
+type BackendConfig struct {
+	URL        string `yaml:"url" json:"url"`
+	Weight     *int   `yaml:"weight" json:"weight"`
+	HealthPath string `yaml:"health_path" json:"health_path"`
+	// HealthMode is "http" (default), "tcp" or "grpc".
+	HealthMode string `yaml:"health_mode" json:"health_mode"`
+	// HealthService is the service name sent in gRPC health checks.
+	HealthService string `yaml:"health_service" json:"health_service"`
+	// HealthStatus lists the codes an HTTP health check accepts,
+	// 200-299 when unset.
+	HealthStatus StatusCodes `yaml:"health_status" json:"health_status"`
+	// HealthMethod defaults to GET; HealthBody is only sent with POST or PUT.
+	HealthMethod  string            `yaml:"health_method" json:"health_method"`
+	HealthBody    string            `yaml:"health_body" json:"health_body"`
+	HealthHeaders map[string]string `yaml:"health_headers" json:"health_headers"`
+	// StripPrefix is removed from the request path before forwarding.
+	StripPrefix string `yaml:"strip_prefix" json:"strip_prefix"`
+	// DisableKeepAlive opens a new connection for every request to
+	// backends that mishandle connection reuse. It is rejected with
+	// -h2c, whose HTTP/2 connections are always shared.
+	DisableKeepAlive bool `yaml:"disable_keepalive" json:"disable_keepalive"`
+	// MaxConns limits in-flight requests, overriding -max-conns.
+	MaxConns int `yaml:"max_conns" json:"max_conns"`
+	// Timeout bounds each request to this backend, overriding
+	// -request-timeout.
+	Timeout Duration `yaml:"timeout" json:"timeout"`
+	// Tags are free-form labels such as zone: us-east.
+	Tags map[string]string `yaml:"tags" json:"tags"`
+
+	line int
+}
+
+// Duration is a time.Duration written as a string such as "1.5s" in
+// both YAML and JSON.
+type Duration time.Duration
+
+func (d *Duration) UnmarshalYAML(n *yaml.Node) error {
+	return d.parse(n.Value)
+}
+
+func (d *Duration) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return fmt.Errorf("duration must be a string such as \"5s\"")
+	}
+	return d.parse(s)
+}
+
+func (d *Duration) parse(s string) error {
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = Duration(v)
+	return nil
+}
+
+func (c *BackendConfig) UnmarshalYAML(n *yaml.Node) error {
+	c.line = n.Line
+	if n.Kind == yaml.ScalarNode {
+		return n.Decode(&c.URL)
+	}
+
+	type raw BackendConfig
+	return n.Decode((*raw)(c))
+}
+
+// loadConfig reads and validates the YAML config file at path.
+func loadConfig(path string) (*Config, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("reading config %s: %w", path, err)
+	}
+
+	cfg := &Config{}
+	if err := yaml.Unmarshal(data, cfg); err != nil {
+		return nil, fmt.Errorf("parsing config %s: %w", path, err)
+	}
+
+	if err := validHashKey(cfg.ConsistentHash.Key); err != nil {
+		return nil, fmt.Errorf("config %s: consistent_hash: %w", path, err)
+	}
+	if cfg.ConsistentHash.VirtualNodes < 0 {
+		return nil, fmt.Errorf("config %s: consistent_hash: virtual_nodes must not be negative", path)
+	}
+
+	if err := cfg.Headers.Request.validate(); err != nil {
+		return nil, fmt.Errorf("config %s: headers.request: %w", path, err)
+	}
+	if err := cfg.Headers.Response.validate(); err != nil {
+		return nil, fmt.Errorf("config %s: headers.response: %w", path, err)
+	}
+
+	if len(cfg.Backends) == 0 && len(cfg.Pools) == 0 {
+		return nil, fmt.Errorf("config %s: no backends defined", path)
+	}
+
+	if err := validBackends(cfg.Backends); err != nil {
+		return nil, fmt.Errorf("config %s %w", path, err)
+	}
+
+	if err := cfg.Canary.validate(); err != nil {
+		return nil, fmt.Errorf("config %s: %w", path, err)
+	}
+
+	if err := cfg.validatePools(); err != nil {
+		return nil, fmt.Errorf("config %s: %w", path, err)
+	}
+
+	return cfg, nil
+}
+
+func validBackends(backends []BackendConfig) error {
+	for i := range backends {
+		bc := &backends[i]
+		if err := bc.validate(); err != nil {
+			return fmt.Errorf("line %d: %w", bc.line, err)
+		}
+	}
+	return nil
+}
+
+func (cfg *Config) validatePools() error {
+	hasPool := func(name string) bool {
+		_, ok := cfg.Pools[name]
+		return ok || (name == defaultPoolName && len(cfg.Backends) > 0)
+	}
+
+	for name, pc := range cfg.Pools {
+		if name == "" || name == defaultPoolName {
+			return fmt.Errorf("pool name %q is reserved", name)
+		}
+		if len(pc.Backends) == 0 {
+			return fmt.Errorf("pool %s: no backends defined", name)
+		}
+		if err := validBackends(pc.Backends); err != nil {
+			return fmt.Errorf("pool %s %w", name, err)
+		}
+		if _, err := newStrategy(pc.Strategy, cfg.ConsistentHash); err != nil {
+			return fmt.Errorf("pool %s: %w", name, err)
+		}
+		if err := pc.Canary.validate(); err != nil {
+			return fmt.Errorf("pool %s: %w", name, err)
+		}
+		h := pc.Health
+		if h.Interval < 0 || h.Timeout < 0 || h.Fall < 0 || h.Rise < 0 {
+			return fmt.Errorf("pool %s: health settings must not be negative", name)
+		}
+	}
+
+	for i, rc := range cfg.Routes {
+		if rc.Host == "" && rc.SNI == "" && rc.PathPrefix == "" && len(rc.Methods) == 0 {
+			return fmt.Errorf("route %d: host, sni, path_prefix or methods is required", i+1)
+		}
+		for _, m := range rc.Methods {
+			if m == "" || m != strings.ToUpper(m) {
+				return fmt.Errorf("route %d: method %q must be upper case", i+1, m)
+			}
+		}
+		if rc.PathPrefix != "" && !strings.HasPrefix(rc.PathPrefix, "/") {
+			return fmt.Errorf("route %d: path_prefix must start with /", i+1)
+		}
+		if !hasPool(rc.Pool) {
+			return fmt.Errorf("route %d: unknown pool %q", i+1, rc.Pool)
+		}
+	}
+
+	if cfg.DefaultPool != "" && !hasPool(cfg.DefaultPool) {
+		return fmt.Errorf("unknown default_pool %q", cfg.DefaultPool)
+	}
+	return nil
+}
+
+func (c *BackendConfig) validate() error {
+	if c.URL == "" {
+		return fmt.Errorf("backend url is empty")
+	}
+
+	//A bare host:port would otherwise parse with the host as its scheme
+	if !strings.Contains(c.URL, "://") {
+		c.URL = "http://" + c.URL
+	}
+
+	u, err := url.Parse(c.URL)
+	if err != nil {
+		return fmt.Errorf("invalid backend url %q: %w", c.URL, err)
+	}
+	//Backends are proxied over HTTP(S) and dialed over TCP only
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return fmt.Errorf("invalid backend url %q: scheme must be http or https", c.URL)
+	}
+	if u.Host == "" || u.Hostname() == "" {
+		return fmt.Errorf("invalid backend url %q: no host", c.URL)
+	}
+
+	if c.Weight != nil && *c.Weight < 0 {
+		return fmt.Errorf("backend %s: weight must not be negative", c.URL)
+	}
+
+	if c.StripPrefix != "" && !strings.HasPrefix(c.StripPrefix, "/") {
+		return fmt.Errorf("backend %s: strip_prefix must start with /", c.URL)
+	}
+
+	if c.Timeout < 0 {
+		return fmt.Errorf("backend %s: timeout must not be negative", c.URL)
+	}
+
+	if c.MaxConns < 0 {
+		return fmt.Errorf("backend %s: max_conns must not be negative", c.URL)
+	}
+
+	switch c.HealthMode {
+	case "", healthModeHTTP, healthModeTCP, healthModeGRPC:
+	default:
+		return fmt.Errorf("backend %s: unknown health_mode %q", c.URL, c.HealthMode)
+	}
+
+	switch c.HealthMethod {
+	case "", http.MethodGet, http.MethodHead, http.MethodOptions:
+		if c.HealthBody != "" {
+			return fmt.Errorf("backend %s: health_body needs health_method POST or PUT", c.URL)
+		}
+	case http.MethodPost, http.MethodPut:
+	default:
+		return fmt.Errorf("backend %s: unsupported health_method %q", c.URL, c.HealthMethod)
+	}
+
+	for name := range c.HealthHeaders {
+		if name == "" || strings.ContainsAny(name, " \t:\r\n") {
+			return fmt.Errorf("backend %s: invalid health_headers name %q", c.URL, name)
+		}
+	}
+
+	return nil
+}
+
+// healthCheck returns the health check settings with defaults applied.
+func (c *BackendConfig) healthCheck() healthCheckConfig {
+	hc := healthCheckConfig{
+		mode:    c.HealthMode,
+		path:    c.HealthPath,
+		status:  c.HealthStatus,
+		method:  c.HealthMethod,
+		body:    c.HealthBody,
+		service: c.HealthService,
+	}
+	if len(c.HealthHeaders) > 0 {
+		hc.header = make(http.Header, len(c.HealthHeaders))
+		for k, v := range c.HealthHeaders {
+			hc.header.Set(k, v)
+		}
+	}
+	if hc.mode == "" {
+		hc.mode = healthModeHTTP
+	}
+	if hc.path == "" {
+		hc.path = "/health"
+	}
+	if len(hc.status) == 0 {
+		hc.status = StatusCodes{{lo: http.StatusOK, hi: 299}}
+	}
+	if hc.method == "" {
+		hc.method = http.MethodGet
+	}
+	return hc
+}
+
+// maxConns returns the in-flight limit, falling back to def when unset.
+func (c *BackendConfig) maxConns(def int) int {
+	if c.MaxConns > 0 {
+		return c.MaxConns
+	}
+	return def
+}
+
+// weight returns the configured weight, defaulting to 1 when unset.
+func (c *BackendConfig) weight() int {
+	if c.Weight == nil {
+		return 1
+	}
+	return *c.Weight
+}
+
+// parseBackendList parses a comma-separated list of backend URLs read
+// from source, the -backends flag or LB_BACKENDS.
+func parseBackendList(source, list string) ([]BackendConfig, error) {
+	var backends []BackendConfig
+	for i, entry := range strings.Split(list, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			return nil, fmt.Errorf("%s entry %d is empty", source, i+1)
+		}
+
+		bc := BackendConfig{URL: entry}
+		if err := bc.validate(); err != nil {
+			return nil, fmt.Errorf("%s entry %d: %w", source, i+1, err)
+		}
+		backends = append(backends, bc)
+	}
+	return backends, nil
+}
+
+// backendsFromEnv reads LB_BACKENDS, a comma-separated URL list, and the
+// optional LB_WEIGHTS, one weight per URL in the same order. It returns
+// nil when LB_BACKENDS is unset.
+func backendsFromEnv() ([]BackendConfig, error) {
+	list := os.Getenv("LB_BACKENDS")
+	if list == "" {
+		return nil, nil
+	}
+	backends, err := parseBackendList("LB_BACKENDS", list)
+	if err != nil {
+		return nil, err
+	}
+
+	weights := os.Getenv("LB_WEIGHTS")
+	if weights == "" {
+		return backends, nil
+	}
+	fields := strings.Split(weights, ",")
+	if len(fields) != len(backends) {
+		return nil, fmt.Errorf("LB_WEIGHTS has %d entries, LB_BACKENDS has %d", len(fields), len(backends))
+	}
+	for i, f := range fields {
+		w, err := strconv.Atoi(strings.TrimSpace(f))
+		if err != nil || w < 0 {
+			return nil, fmt.Errorf("LB_WEIGHTS entry %d: invalid weight %q", i+1, f)
+		}
+		backends[i].Weight = &w
+	}
+	return backends, nil
+}
+
+// defaultConfig is used when no config file is given.
+func defaultConfig() *Config {
+	servers := []string{
+		"http://localhost:8081",
+		"http://localhost:8082",
+		"http://localhost:8083",
+		"http://localhost:8084",
+		"http://localhost:8085",
+		"http://localhost:8086",
+		"http://localhost:8087",
+		"http://localhost:8088",
+		"http://localhost:8089",
+	}
+
+	cfg := &Config{}
+	for _, s := range servers {
+		cfg.Backends = append(cfg.Backends, BackendConfig{URL: s})
+	}
+	return cfg
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// writeConfig writes a config file with content and returns its path.
+func writeConfig(t *testing.T, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "lb.yaml")
+	if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoadConfig(t *testing.T) {
+	path := writeConfig(t, `
+backends:
+  - url: http://localhost:8081
+    weight: 3
+    health_path: /status
+  - http://localhost:8082
+`)
+	cfg, err := loadConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cfg.Backends) != 2 {
+		t.Fatalf("got %d backends, want 2", len(cfg.Backends))
+	}
+	b0, b1 := cfg.Backends[0], cfg.Backends[1]
+	if b0.URL != "http://localhost:8081" || b0.weight() != 3 || b0.healthCheck().path != "/status" {
+		t.Errorf("first backend = %+v", b0)
+	}
+	if b1.URL != "http://localhost:8082" || b1.weight() != 1 || b1.healthCheck().path != "/health" {
+		t.Errorf("second backend = %+v", b1)
+	}
+}
+
+func TestLoadConfigInvalidURLNamesLine(t *testing.T) {
+	path := writeConfig(t, `backends:
+  - http://localhost:8081
+  - "http://bad host:80"
+`)
+	_, err := loadConfig(path)
+	if err == nil {
+		t.Fatal("loadConfig accepted an invalid URL")
+	}
+	if !strings.Contains(err.Error(), "line 3") {
+		t.Errorf("error %q does not name line 3", err)
+	}
+}
+
+func TestDefaultConfig(t *testing.T) {
+	if n := len(defaultConfig().Backends); n != 9 {
+		t.Fatalf("default config has %d backends, want 9", n)
+	}
+}
+
+func TestParseBackendList(t *testing.T) {
+	backends, err := parseBackendList("-backends", "http://a:80, http://b:80")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(backends) != 2 || backends[0].URL != "http://a:80" || backends[1].URL != "http://b:80" {
+		t.Fatalf("backends = %+v", backends)
+	}
+
+	for _, list := range []string{"", "http://a:80,,http://b:80", "http://a:80,http://bad host"} {
+		_, err := parseBackendList("-backends", list)
+		if err == nil || !strings.HasPrefix(err.Error(), "-backends entry") {
+			t.Errorf("parseBackendList(%q) error = %v, want one naming the entry", list, err)
+		}
+	}
+}
+
+func TestBackendsFromEnv(t *testing.T) {
+	t.Setenv("LB_BACKENDS", "http://a:80,b:8080")
+	t.Setenv("LB_WEIGHTS", "3, 0")
+	backends, err := backendsFromEnv()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(backends) != 2 {
+		t.Fatalf("got %d backends, want 2", len(backends))
+	}
+	if backends[0].URL != "http://a:80" || backends[0].weight() != 3 {
+		t.Errorf("first backend = %s weight %d", backends[0].URL, backends[0].weight())
+	}
+	if backends[1].URL != "http://b:8080" || backends[1].weight() != 0 {
+		t.Errorf("second backend = %s weight %d", backends[1].URL, backends[1].weight())
+	}
+}
+
+func TestBackendsFromEnvUnset(t *testing.T) {
+	t.Setenv("LB_BACKENDS", "")
+	if backends, err := backendsFromEnv(); backends != nil || err != nil {
+		t.Fatalf("backendsFromEnv() = %v, %v, want nil when LB_BACKENDS is unset", backends, err)
+	}
+}
+
+func TestBackendsFromEnvInvalid(t *testing.T) {
+	for _, tc := range []struct {
+		backends, weights string
+	}{
+		{"http://a:80,", ""},
+		{"http://a:80,http://b:80", "1"},
+		{"http://a:80", "-1"},
+		{"http://a:80", "heavy"},
+	} {
+		t.Setenv("LB_BACKENDS", tc.backends)
+		t.Setenv("LB_WEIGHTS", tc.weights)
+		if _, err := backendsFromEnv(); err == nil {
+			t.Errorf("LB_BACKENDS=%q LB_WEIGHTS=%q accepted", tc.backends, tc.weights)
+		}
+	}
+}
+
+func TestBackendURLNormalization(t *testing.T) {
+	for _, tc := range []struct {
+		in, want string
+	}{
+		{"localhost:8081", "http://localhost:8081"},
+		{"10.0.0.5:80", "http://10.0.0.5:80"},
+		{"backend.internal", "http://backend.internal"},
+		{"https://backend:443", "https://backend:443"},
+	} {
+		bc := BackendConfig{URL: tc.in}
+		if err := bc.validate(); err != nil {
+			t.Errorf("validate(%q): %v", tc.in, err)
+			continue
+		}
+		if bc.URL != tc.want {
+			t.Errorf("validate(%q) normalized to %q, want %q", tc.in, bc.URL, tc.want)
+		}
+	}
+
+	for _, in := range []string{"", "http://", "http://:8080", "://missing", "http://bad host:80"} {
+		bc := BackendConfig{URL: in}
+		if err := bc.validate(); err == nil {
+			t.Errorf("validate accepted %q as %q", in, bc.URL)
+		}
+	}
+}
+
+func TestBackendURLScheme(t *testing.T) {
+	for _, tc := range []struct {
+		url string
+		ok  bool
+	}{
+		{"http://a:80", true},
+		{"https://a:443", true},
+		{"HTTPS://a:443", true},
+		{"ftp://a:21", false},
+		{"ws://a:80", false},
+		{"unix:///run/app.sock", false},
+		{"file:///etc/passwd", false},
+	} {
+		bc := BackendConfig{URL: tc.url}
+		err := bc.validate()
+		if (err == nil) != tc.ok {
+			t.Errorf("validate(%q) = %v, want ok %v", tc.url, err, tc.ok)
+		}
+		if err != nil && !strings.Contains(err.Error(), "scheme must be http or https") {
+			t.Errorf("validate(%q) = %v, want the scheme named as the problem", tc.url, err)
+		}
+	}
+}
+
+func TestLoadConfigSchemelessBackend(t *testing.T) {
+	cfg, err := loadConfig(writeConfig(t, "backends:\n  - localhost:8081\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := cfg.Backends[0].URL; got != "http://localhost:8081" {
+		t.Fatalf("backend url = %q, want http://localhost:8081", got)
+	}
+}
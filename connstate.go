@@ -0,0 +1,20 @@
+package main
+
+import (
+	"net"
+	"net/http"
+)
+
+// trackConnState is the http.Server ConnState hook feeding the
+// connection metrics. Hijacked connections, such as WebSockets, leave
+// the server's hands and count as closed.
+func trackConnState(_ net.Conn, state http.ConnState) {
+	switch state {
+	case http.StateNew:
+		connectionsAccepted.Inc()
+		connectionsActive.Inc()
+	case http.StateClosed, http.StateHijacked:
+		connectionsClosed.Inc()
+		connectionsActive.Dec()
+	}
+}
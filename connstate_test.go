@@ -0,0 +1,68 @@
+package main
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestConnStateCounters(t *testing.T) {
+	l := newTestLB(t, newTestServer(t, nameHandler("ok")).URL)
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := &http.Server{Handler: l, ConnState: trackConnState}
+	go srv.Serve(ln)
+	defer srv.Close()
+
+	accepted := testutil.ToFloat64(connectionsAccepted)
+	active := testutil.ToFloat64(connectionsActive)
+	closed := testutil.ToFloat64(connectionsClosed)
+	delta := func() (float64, float64, float64) {
+		return testutil.ToFloat64(connectionsAccepted) - accepted,
+			testutil.ToFloat64(connectionsActive) - active,
+			testutil.ToFloat64(connectionsClosed) - closed
+	}
+	//ConnState runs on the server's goroutines, so wait for it to settle
+	waitFor := func(wantAccepted, wantActive, wantClosed float64) {
+		t.Helper()
+		deadline := time.Now().Add(2 * time.Second)
+		for {
+			a, o, c := delta()
+			if a == wantAccepted && o == wantActive && c == wantClosed {
+				return
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("accepted +%v, active +%v, closed +%v, want +%v, +%v, +%v", a, o, c, wantAccepted, wantActive, wantClosed)
+			}
+			time.Sleep(5 * time.Millisecond)
+		}
+	}
+
+	//Two keep-alive clients each hold one connection open
+	var clients []*http.Client
+	for range 2 {
+		client := &http.Client{Transport: &http.Transport{}}
+		clients = append(clients, client)
+		for range 3 {
+			resp, err := client.Get("http://" + ln.Addr().String())
+			if err != nil {
+				t.Fatal(err)
+			}
+			//Drain the body so the transport reuses the connection
+			io.Copy(io.Discard, resp.Body)
+			resp.Body.Close()
+		}
+	}
+	waitFor(2, 2, 0)
+
+	for _, c := range clients {
+		c.CloseIdleConnections()
+	}
+	waitFor(2, 0, 2)
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"log/slog"
+	"maps"
+	"net/http"
+	"slices"
+	"strings"
+)
+
+// sensitiveHeaders are never written to the debug log.
+var sensitiveHeaders = map[string]bool{
+	"Authorization":       true,
+	"Proxy-Authorization": true,
+	"Cookie":              true,
+	"Set-Cookie":          true,
+}
+
+// redactHeaders returns h as a log attribute with the values of
+// sensitiveHeaders replaced.
+func redactHeaders(h http.Header) slog.Attr {
+	attrs := make([]any, 0, len(h))
+	for _, k := range slices.Sorted(maps.Keys(h)) {
+		v := strings.Join(h[k], ", ")
+		if sensitiveHeaders[k] {
+			v = "[REDACTED]"
+		}
+		attrs = append(attrs, slog.String(k, v))
+	}
+	return slog.Group("headers", attrs...)
+}
+
+// debugHeadersDirector wraps a reverse proxy Director to log the
+// headers sent to backend.
+func debugHeadersDirector(director func(*http.Request), backend string) func(*http.Request) {
+	return func(req *http.Request) {
+		director(req)
+		slog.Info("Upstream request", "event", "debug_headers", "backend", backend, "method", req.Method, "path", req.URL.Path, "host", req.Host, redactHeaders(req.Header))
+	}
+}
+
+// logResponseHeaders logs the headers a backend answered with.
+func logResponseHeaders(resp *http.Response, backend string) {
+	slog.Info("Upstream response", "event", "debug_headers", "backend", backend, "status", resp.StatusCode, redactHeaders(resp.Header))
+}
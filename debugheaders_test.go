@@ -0,0 +1,71 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestDebugHeadersRedacted(t *testing.T) {
+	srv := newTestServer(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Set-Cookie", "session=upstream-secret")
+		w.Header().Set("X-Upstream", "yes")
+		//Redaction only applies to the log, the backend gets the real value
+		w.Write([]byte(r.Header.Get("Authorization")))
+	})
+	send := func(l *LoadBalancer) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "/orders", nil)
+		req.Header.Set("Authorization", "Bearer client-secret")
+		req.Header.Set("Cookie", "session=client-secret")
+		req.Header.Set("X-Trace", "abc")
+		return serve(l, req)
+	}
+
+	l := newTestLB(t)
+	l.backendOpts.debugHeaders = true
+	addTestBackends(t, l, srv.URL)
+	logs := captureLogs(t)
+	if rec := send(l); rec.Body.String() != "Bearer client-secret" {
+		t.Fatalf("backend saw Authorization %q", rec.Body)
+	}
+
+	events := logs.events(t, "debug_headers")
+	if len(events) != 2 {
+		t.Fatalf("logged %d debug_headers events, want the request and the response", len(events))
+	}
+	reqHeaders := events[0]["headers"].(map[string]any)
+	respHeaders := events[1]["headers"].(map[string]any)
+	for _, tc := range []struct {
+		headers    map[string]any
+		name, want string
+	}{
+		{reqHeaders, "Authorization", "[REDACTED]"},
+		{reqHeaders, "Cookie", "[REDACTED]"},
+		{reqHeaders, "X-Trace", "abc"},
+		{respHeaders, "Set-Cookie", "[REDACTED]"},
+		{respHeaders, "X-Upstream", "yes"},
+	} {
+		if got := tc.headers[tc.name]; got != tc.want {
+			t.Errorf("logged %s = %v, want %q", tc.name, got, tc.want)
+		}
+	}
+	if events[0]["path"] != "/orders" || events[1]["status"] != float64(http.StatusOK) {
+		t.Errorf("events = %v, want the path and status logged", events)
+	}
+	for _, e := range events {
+		for _, v := range e["headers"].(map[string]any) {
+			if strings.Contains(v.(string), "secret") {
+				t.Fatalf("secret leaked into the log: %v", e)
+			}
+		}
+	}
+
+	//Off by default
+	quiet := newTestLB(t, srv.URL)
+	quietLogs := captureLogs(t)
+	send(quiet)
+	if events := quietLogs.events(t, "debug_headers"); len(events) != 0 {
+		t.Fatalf("logged %d debug_headers events with -debug-headers off", len(events))
+	}
+}
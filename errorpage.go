@@ -0,0 +1,79 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+)
+
+// ErrorPageConfig replaces the plain text 503 answered when no backend
+// can serve a request. Body and File are mutually exclusive.
+type ErrorPageConfig struct {
+	Body string `yaml:"body"`
+	File string `yaml:"file"`
+	// ContentType defaults to text/html; charset=utf-8.
+	ContentType string `yaml:"content_type"`
+	// RetryAfter in seconds is sent as Retry-After when set.
+	RetryAfter int `yaml:"retry_after"`
+}
+
+// errorPage is a loaded ErrorPageConfig.
+type errorPage struct {
+	body        []byte
+	contentType string
+	retryAfter  int
+}
+
+// load reads the page, returning nil when nothing is configured.
+func (c *ErrorPageConfig) load() (*errorPage, error) {
+	if c.Body == "" && c.File == "" {
+		if c.RetryAfter != 0 || c.ContentType != "" {
+			return nil, fmt.Errorf("body or file is required")
+		}
+		return nil, nil
+	}
+	if c.Body != "" && c.File != "" {
+		return nil, fmt.Errorf("body and file are mutually exclusive")
+	}
+	if c.RetryAfter < 0 {
+		return nil, fmt.Errorf("retry_after must not be negative")
+	}
+
+	p := &errorPage{
+		body:        []byte(c.Body),
+		contentType: c.ContentType,
+		retryAfter:  c.RetryAfter,
+	}
+	if c.File != "" {
+		data, err := os.ReadFile(c.File)
+		if err != nil {
+			return nil, err
+		}
+		p.body = data
+	}
+	if p.contentType == "" {
+		p.contentType = "text/html; charset=utf-8"
+	}
+	return p, nil
+}
+
+// writeUnavailable answers with 503 using page, or with text when no
+// page is configured. A positive retryAfter overrides the page's own.
+func writeUnavailable(w http.ResponseWriter, page *errorPage, text string, retryAfter int) {
+	if page != nil && retryAfter <= 0 {
+		retryAfter = page.retryAfter
+	}
+	if retryAfter > 0 {
+		w.Header().Set("Retry-After", strconv.Itoa(retryAfter))
+	}
+
+	if page == nil {
+		http.Error(w, text, http.StatusServiceUnavailable)
+		return
+	}
+	w.Header().Set("Content-Type", page.contentType)
+	w.Header().Set("Content-Length", strconv.Itoa(len(page.body)))
+	w.WriteHeader(http.StatusServiceUnavailable)
+	w.Write(page.body)
+}
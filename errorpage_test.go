@@ -0,0 +1,65 @@
+package main
+
+import (
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestCustomUnavailablePage(t *testing.T) {
+	page, err := (&ErrorPageConfig{Body: `{"error": "down"}`, ContentType: "application/json", RetryAfter: 30}).load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	l := newTestLB(t, "http://down")
+	l.backendOpts.unavailable = page
+	l.snapshot()[0].setAlive(false)
+
+	rec := get(l, "/")
+	if rec.Code != http.StatusServiceUnavailable || rec.Body.String() != `{"error": "down"}` {
+		t.Fatalf("%d %q, want the custom 503 body", rec.Code, rec.Body)
+	}
+	if rec.Header().Get("Content-Type") != "application/json" || rec.Header().Get("Retry-After") != "30" {
+		t.Fatalf("headers = %v", rec.Header())
+	}
+}
+
+func TestDefaultUnavailableText(t *testing.T) {
+	l := newTestLB(t, "http://down")
+	l.snapshot()[0].setAlive(false)
+
+	rec := get(l, "/")
+	if rec.Code != http.StatusServiceUnavailable || strings.TrimSpace(rec.Body.String()) != "Service Unavailable" || rec.Header().Get("Retry-After") != "" {
+		t.Fatalf("%d %q, Retry-After %q, want the plain default", rec.Code, rec.Body, rec.Header().Get("Retry-After"))
+	}
+}
+
+func TestErrorPageConfigLoad(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "503.html")
+	if err := os.WriteFile(file, []byte("<h1>back soon</h1>"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	page, err := (&ErrorPageConfig{File: file}).load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(page.body) != "<h1>back soon</h1>" || page.contentType != "text/html; charset=utf-8" {
+		t.Fatalf("page = %q as %q", page.body, page.contentType)
+	}
+
+	if page, err := (&ErrorPageConfig{}).load(); page != nil || err != nil {
+		t.Fatalf("empty config = %v, %v, want nil", page, err)
+	}
+	for _, c := range []ErrorPageConfig{
+		{Body: "x", File: file},
+		{RetryAfter: 5},
+		{Body: "x", RetryAfter: -1},
+		{File: filepath.Join(t.TempDir(), "missing.html")},
+	} {
+		if _, err := c.load(); err == nil {
+			t.Errorf("load accepted %+v", c)
+		}
+	}
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// HealthEvent describes a backend changing between alive and dead.
+type HealthEvent struct {
+	Backend   string    `json:"backend"`
+	NewState  string    `json:"newState"`
+	Timestamp time.Time `json:"timestamp"`
+}
+
+// eventBus fans health transitions out to subscribers and an optional
+// webhook. Slow subscribers miss events rather than block health checks.
+type eventBus struct {
+	webhook string
+	client  *http.Client
+
+	mux         sync.Mutex
+	subscribers []chan HealthEvent
+}
+
+func (e *eventBus) subscribe() <-chan HealthEvent {
+	ch := make(chan HealthEvent, 16)
+	e.mux.Lock()
+	e.subscribers = append(e.subscribers, ch)
+	e.mux.Unlock()
+	return ch
+}
+
+func (e *eventBus) publish(ev HealthEvent) {
+	e.mux.Lock()
+	for _, ch := range e.subscribers {
+		select {
+		case ch <- ev:
+		default:
+			slog.Warn("Dropped health event for slow subscriber", "event", "health_event", "backend", ev.Backend)
+		}
+	}
+	e.mux.Unlock()
+
+	if e.webhook != "" {
+		go e.post(ev)
+	}
+}
+
+func (e *eventBus) post(ev HealthEvent) {
+	payload, err := json.Marshal(ev)
+	if err != nil {
+		slog.Error("Encoding health event failed", "event", "health_event", "error", err)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, e.webhook, bytes.NewReader(payload))
+	if err != nil {
+		slog.Error("Health webhook failed", "event", "health_event", "error", err)
+		return
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	client := e.client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		slog.Error("Health webhook failed", "event", "health_event", "error", err)
+		return
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		slog.Warn("Health webhook returned unexpected status", "event", "health_event", "status", resp.StatusCode)
+	}
+}
+
+// Subscribe returns a channel receiving every backend health transition.
+func (l *LoadBalancer) Subscribe() <-chan HealthEvent {
+	return l.events.subscribe()
+}
+
+// notifyHealth publishes a transition of b to alive or dead.
+func (l *LoadBalancer) notifyHealth(b *BackEnd, alive bool) {
+	state := "dead"
+	if alive {
+		state = "alive"
+	}
+	l.events.publish(HealthEvent{
+		Backend:   b.url.String(),
+		NewState:  state,
+		Timestamp: time.Now(),
+	})
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// toggleHandler passes health checks while healthy is set.
+func toggleHandler(healthy *atomic.Bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !healthy.Load() {
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+	}
+}
+
+func TestHealthEventPerTransition(t *testing.T) {
+	var healthy atomic.Bool
+	healthy.Store(true)
+	srv := newTestServer(t, toggleHandler(&healthy))
+	l := newTestLB(t, srv.URL)
+	l.healthOpts.fall = 2
+	events := l.Subscribe()
+	b := l.snapshot()[0]
+
+	results := []bool{true, true, true, false, false, false, false, true, true}
+	var got []HealthEvent
+	for _, ok := range results {
+		healthy.Store(ok)
+		l.checkHealth(context.Background(), b, l.healthOpts)
+		select {
+		case ev := <-events:
+			got = append(got, ev)
+		default:
+		}
+	}
+
+	if len(got) != 2 {
+		t.Fatalf("got %d events, want one per flip: %+v", len(got), got)
+	}
+	if got[0].NewState != "dead" || got[1].NewState != "alive" || got[0].Backend != srv.URL {
+		t.Fatalf("events = %+v, want dead then alive for %s", got, srv.URL)
+	}
+}
+
+func TestHealthEventWebhook(t *testing.T) {
+	received := make(chan HealthEvent, 1)
+	hook := newTestServer(t, func(w http.ResponseWriter, r *http.Request) {
+		var ev HealthEvent
+		if r.Method != http.MethodPost || json.NewDecoder(r.Body).Decode(&ev) != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		received <- ev
+	})
+
+	l := newTestLB(t)
+	l.events.webhook = hook.URL
+	b := newTestBackEnd(t, BackendConfig{URL: "http://backend"}, backendOptions{})
+	l.notifyHealth(b, false)
+
+	select {
+	case ev := <-received:
+		if ev.Backend != "http://backend" || ev.NewState != "dead" || ev.Timestamp.IsZero() {
+			t.Fatalf("webhook got %+v", ev)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("webhook not called")
+	}
+}
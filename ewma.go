@@ -0,0 +1,39 @@
+package main
+
+import (
+	"math"
+	"sync/atomic"
+	"time"
+)
+
+// ewmaAlpha is the weight of the newest sample in a backend's latency
+// average; about the last ten requests dominate it.
+const ewmaAlpha = 0.2
+
+// ewma is a lock-free exponentially weighted moving average of
+// durations. The zero value has no samples.
+type ewma struct {
+	bits atomic.Uint64
+}
+
+func (e *ewma) observe(d time.Duration) {
+	sample := float64(d)
+	for {
+		old := e.bits.Load()
+		next := sample
+		if old != 0 {
+			prev := math.Float64frombits(old)
+			next = prev + ewmaAlpha*(sample-prev)
+		}
+		//A zero average would read as no samples
+		next = max(next, 1)
+		if e.bits.CompareAndSwap(old, math.Float64bits(next)) {
+			return
+		}
+	}
+}
+
+// value returns the current average, zero before the first sample.
+func (e *ewma) value() time.Duration {
+	return time.Duration(math.Float64frombits(e.bits.Load()))
+}
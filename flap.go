@@ -0,0 +1,62 @@
+package main
+
+import (
+	"log/slog"
+	"time"
+)
+
+// healthResultHistory is the number of recent probe results kept per
+// backend for flap detection.
+const healthResultHistory = 32
+
+// flapOptions controls flap detection. A zero threshold disables it.
+type flapOptions struct {
+	//Result changes within window above which a backend is flapping
+	threshold int
+	window    time.Duration
+	//Take flapping backends out of rotation until they settle
+	exclude bool
+}
+
+type healthResult struct {
+	at time.Time
+	ok bool
+}
+
+// recordResult appends a probe result to b's history and re-evaluates
+// whether b is flapping. It must be called with b.mux held and reports
+// whether the flapping state changed.
+func (b *BackEnd) recordResult(ok bool, at time.Time, opts flapOptions) bool {
+	b.results[b.resultCount%healthResultHistory] = healthResult{at: at, ok: ok}
+	b.resultCount++
+	if opts.threshold <= 0 {
+		return false
+	}
+
+	//Walk the ring from oldest to newest counting changes inside the window
+	n := min(b.resultCount, healthResultHistory)
+	transitions := 0
+	var prev *healthResult
+	for i := b.resultCount - n; i < b.resultCount; i++ {
+		res := &b.results[i%healthResultHistory]
+		if at.Sub(res.at) > opts.window {
+			continue
+		}
+		if prev != nil && prev.ok != res.ok {
+			transitions++
+		}
+		prev = res
+	}
+
+	flapping := transitions > opts.threshold
+	return b.flapping.Swap(flapping) != flapping
+}
+
+// logFlapping reports a change of b's flapping state.
+func logFlapping(b *BackEnd, opts flapOptions) {
+	if b.flapping.Load() {
+		slog.Warn("Backend is flapping", "event", "flapping", "backend", b.url.String(), "threshold", opts.threshold, "window", opts.window, "excluded", opts.exclude)
+		return
+	}
+	slog.Info("Backend stopped flapping", "event", "flapping", "backend", b.url.String())
+}
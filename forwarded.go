@@ -0,0 +1,40 @@
+package main
+
+import (
+	"net/http"
+)
+
+// forwardedDirector wraps a reverse proxy Director so upstream servers
+// learn who the client is and whether it came in over TLS. Inbound
+// forwarding headers are only kept from peers trust allows, otherwise
+// they are replaced to prevent clients from spoofing their address.
+func forwardedDirector(director func(*http.Request), trust forwardTrust) func(*http.Request) {
+	return func(req *http.Request) {
+		director(req)
+
+		remote := remoteHost(req)
+		trusted := trust.trusts(req)
+		if !trusted {
+			//ReverseProxy appends the remote address to whatever is left here
+			req.Header.Del("X-Forwarded-For")
+			req.Header.Del("X-Real-IP")
+			req.Header.Del("X-Forwarded-Proto")
+		}
+
+		if req.Header.Get("X-Real-IP") == "" {
+			if trusted {
+				req.Header.Set("X-Real-IP", clientIP(req))
+			} else {
+				req.Header.Set("X-Real-IP", remote)
+			}
+		}
+
+		if req.Header.Get("X-Forwarded-Proto") == "" {
+			proto := "http"
+			if req.TLS != nil {
+				proto = "https"
+			}
+			req.Header.Set("X-Forwarded-Proto", proto)
+		}
+	}
+}
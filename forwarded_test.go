@@ -0,0 +1,176 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"slices"
+	"testing"
+)
+
+// headersHandler answers with the request headers as JSON.
+func headersHandler(w http.ResponseWriter, r *http.Request) {
+	json.NewEncoder(w).Encode(r.Header)
+}
+
+// upstreamHeaders sends req through l and returns the headers the
+// backend received.
+func upstreamHeaders(t *testing.T, l *LoadBalancer, req *http.Request) http.Header {
+	t.Helper()
+	rec := serve(l, req)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status = %d", rec.Code)
+	}
+	var h http.Header
+	if err := json.Unmarshal(rec.Body.Bytes(), &h); err != nil {
+		t.Fatal(err)
+	}
+	return h
+}
+
+func TestForwardedHeaders(t *testing.T) {
+	srv := newTestServer(t, headersHandler)
+	l := newTestLB(t, srv.URL)
+
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.RemoteAddr = "198.51.100.4:5000"
+	h := upstreamHeaders(t, l, req)
+
+	if got := h.Get("X-Real-IP"); got != "198.51.100.4" {
+		t.Errorf("X-Real-IP = %q", got)
+	}
+	if got := h.Get("X-Forwarded-For"); got != "198.51.100.4" {
+		t.Errorf("X-Forwarded-For = %q", got)
+	}
+	if got := h.Get("X-Forwarded-Proto"); got != "http" {
+		t.Errorf("X-Forwarded-Proto = %q", got)
+	}
+}
+
+func TestForwardedHeadersSpoofing(t *testing.T) {
+	srv := newTestServer(t, headersHandler)
+	spoofed := func() *http.Request {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.RemoteAddr = "192.0.2.10:5000"
+		req.Header.Set("X-Forwarded-For", "203.0.113.9")
+		req.Header.Set("X-Real-IP", "203.0.113.9")
+		req.Header.Set("X-Forwarded-Proto", "https")
+		return req
+	}
+
+	t.Run("untrusted", func(t *testing.T) {
+		l := newTestLB(t, srv.URL)
+		h := upstreamHeaders(t, l, spoofed())
+		if got := h.Get("X-Forwarded-For"); got != "192.0.2.10" {
+			t.Errorf("X-Forwarded-For = %q, want only the peer", got)
+		}
+		if got := h.Get("X-Real-IP"); got != "192.0.2.10" {
+			t.Errorf("X-Real-IP = %q, want the peer", got)
+		}
+		if got := h.Get("X-Forwarded-Proto"); got != "http" {
+			t.Errorf("X-Forwarded-Proto = %q, want http", got)
+		}
+	})
+
+	t.Run("trusted", func(t *testing.T) {
+		l := newTestLB(t)
+		l.backendOpts.forwarded = forwardTrust{enabled: true, proxies: []netip.Prefix{netip.MustParsePrefix("192.0.2.0/24")}}
+		addTestBackends(t, l, srv.URL)
+		h := upstreamHeaders(t, l, spoofed())
+		if got := h.Get("X-Forwarded-For"); got != "203.0.113.9, 192.0.2.10" {
+			t.Errorf("X-Forwarded-For = %q, want the chain extended", got)
+		}
+		if got := h.Get("X-Real-IP"); got != "203.0.113.9" {
+			t.Errorf("X-Real-IP = %q, want the forwarded client", got)
+		}
+		if got := h.Get("X-Forwarded-Proto"); got != "https" {
+			t.Errorf("X-Forwarded-Proto = %q, want https kept", got)
+		}
+	})
+}
+
+func TestForwardTrust(t *testing.T) {
+	proxies, err := parseTrustedProxies("10.0.0.0/8, 192.0.2.7")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		trust  forwardTrust
+		remote string
+		want   bool
+	}{
+		{forwardTrust{enabled: true, proxies: proxies}, "10.1.2.3:5000", true},
+		{forwardTrust{enabled: true, proxies: proxies}, "192.0.2.7:5000", true},
+		{forwardTrust{enabled: true, proxies: proxies}, "[::ffff:10.1.2.3]:5000", true},
+		{forwardTrust{enabled: true, proxies: proxies}, "192.0.2.8:5000", false},
+		{forwardTrust{enabled: true, proxies: proxies}, "[2001:db8::1]:5000", false},
+		//-trust-forwarded off ignores the list
+		{forwardTrust{proxies: proxies}, "10.1.2.3:5000", false},
+		//An empty list trusts nobody, not everybody
+		{forwardTrust{enabled: true}, "10.1.2.3:5000", false},
+		{forwardTrust{enabled: true}, "127.0.0.1:5000", false},
+	} {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.RemoteAddr = tc.remote
+		if got := tc.trust.trusts(req); got != tc.want {
+			t.Errorf("enabled %v, %d proxies, peer %s: trusts = %v, want %v", tc.trust.enabled, len(tc.trust.proxies), tc.remote, got, tc.want)
+		}
+	}
+}
+
+func TestParseTrustedProxies(t *testing.T) {
+	proxies, err := parseTrustedProxies("10.1.2.3/8,,2001:db8::/32, 192.0.2.7 ")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []netip.Prefix{
+		netip.MustParsePrefix("10.0.0.0/8"),
+		netip.MustParsePrefix("2001:db8::/32"),
+		netip.MustParsePrefix("192.0.2.7/32"),
+	}
+	if !slices.Equal(proxies, want) {
+		t.Fatalf("proxies = %v, want %v", proxies, want)
+	}
+	for _, list := range []string{"10.0.0.0/33", "proxy.internal", "10.0.0"} {
+		if _, err := parseTrustedProxies(list); err == nil {
+			t.Errorf("parseTrustedProxies(%q) accepted", list)
+		}
+	}
+}
+
+func TestClientIPRespectsTrustForwarded(t *testing.T) {
+	proxies := []netip.Prefix{netip.MustParsePrefix("192.0.2.0/24")}
+	for _, tc := range []struct {
+		trust  forwardTrust
+		remote string
+		want   string
+	}{
+		{forwardTrust{enabled: true, proxies: proxies}, "192.0.2.10:5000", "203.0.113.9"},
+		{forwardTrust{enabled: true, proxies: proxies}, "198.51.100.4:5000", "198.51.100.4"},
+		{forwardTrust{proxies: proxies}, "192.0.2.10:5000", "192.0.2.10"},
+		{forwardTrust{enabled: true}, "192.0.2.10:5000", "192.0.2.10"},
+	} {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.RemoteAddr = tc.remote
+		req.Header.Set("X-Forwarded-For", "203.0.113.9, 192.0.2.10")
+		if got := clientIP(tc.trust.withClientIP(req)); got != tc.want {
+			t.Errorf("enabled %v, peer %s: clientIP = %q, want %q", tc.trust.enabled, tc.remote, got, tc.want)
+		}
+	}
+
+	//The resolved address is what the rest of the request sees
+	srv := newTestServer(t, nameHandler("ok"))
+	l := newTestLB(t)
+	l.backendOpts.forwarded = forwardTrust{enabled: true, proxies: proxies}
+	l.accessLog = true
+	addTestBackends(t, l, srv.URL)
+	logs := captureLogs(t)
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.RemoteAddr = "192.0.2.10:5000"
+	req.Header.Set("X-Forwarded-For", "203.0.113.9")
+	serve(l, req)
+	if access := logs.events(t, "access"); len(access) != 1 || access[0]["client_ip"] != "203.0.113.9" {
+		t.Fatalf("access log = %v, want the forwarded client", access)
+	}
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"log/slog"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+)
+
+// GRPCChecker calls the standard grpc.health.v1.Health/Check RPC and
+// considers a backend alive only when it reports SERVING for Service.
+// https backends are dialed with TLS using the TLS settings.
+type GRPCChecker struct {
+	Service string
+	TLS     *tls.Config
+}
+
+func (c *GRPCChecker) Check(ctx context.Context, b *BackEnd) bool {
+	creds := insecure.NewCredentials()
+	if b.url.Scheme == "https" {
+		creds = credentials.NewTLS(c.TLS)
+	}
+
+	conn, err := grpc.NewClient(b.dialAddr(), grpc.WithTransportCredentials(creds))
+	if err != nil {
+		slog.Warn("Health check failed", "event", "health_check", "backend", b.url.String(), "mode", healthModeGRPC, "error", err)
+		return false
+	}
+	defer conn.Close()
+
+	resp, err := healthpb.NewHealthClient(conn).Check(ctx, &healthpb.HealthCheckRequest{Service: c.Service})
+	if err != nil {
+		slog.Warn("Health check failed", "event", "health_check", "backend", b.url.String(), "mode", healthModeGRPC, "service", c.Service, "error", err)
+		return false
+	}
+
+	if resp.GetStatus() != healthpb.HealthCheckResponse_SERVING {
+		slog.Warn("Health check returned unexpected status", "event", "health_check", "backend", b.url.String(), "mode", healthModeGRPC, "service", c.Service, "status", resp.GetStatus().String())
+		return false
+	}
+	return true
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+)
+
+// newGRPCHealthServer starts a gRPC server exposing the standard health
+// service and returns it with the backend URL to reach it.
+func newGRPCHealthServer(t *testing.T) (*health.Server, string) {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	hs := health.NewServer()
+	srv := grpc.NewServer()
+	healthpb.RegisterHealthServer(srv, hs)
+	go srv.Serve(ln)
+	t.Cleanup(srv.Stop)
+	return hs, "http://" + ln.Addr().String()
+}
+
+func TestGRPCCheckerTogglesWithServingStatus(t *testing.T) {
+	hs, url := newGRPCHealthServer(t)
+	b := newTestBackEnd(t, BackendConfig{URL: url, HealthMode: healthModeGRPC, HealthService: "orders"}, backendOptions{})
+
+	for _, tc := range []struct {
+		status healthpb.HealthCheckResponse_ServingStatus
+		alive  bool
+	}{
+		{healthpb.HealthCheckResponse_SERVING, true},
+		{healthpb.HealthCheckResponse_NOT_SERVING, false},
+		{healthpb.HealthCheckResponse_SERVING, true},
+	} {
+		hs.SetServingStatus("orders", tc.status)
+		if got := b.isBackendAlive(context.Background(), time.Second); got != tc.alive {
+			t.Errorf("service %s: alive = %v, want %v", tc.status, got, tc.alive)
+		}
+	}
+
+	//A service the server does not know about is not healthy
+	other := newTestBackEnd(t, BackendConfig{URL: url, HealthMode: healthModeGRPC, HealthService: "billing"}, backendOptions{})
+	if other.isBackendAlive(context.Background(), time.Second) {
+		t.Error("unknown service reported alive")
+	}
+	//The empty service name asks about the whole server
+	whole := newTestBackEnd(t, BackendConfig{URL: url, HealthMode: healthModeGRPC}, backendOptions{})
+	if !whole.isBackendAlive(context.Background(), time.Second) {
+		t.Error("server-wide check failed on a serving server")
+	}
+}
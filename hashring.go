@@ -0,0 +1,190 @@
+package main
+
+import (
+	"fmt"
+	"hash/fnv"
+	"net/http"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const defaultVirtualNodes = 100
+
+// maxCachedRings bounds the rings kept per strategy. Canary splits and
+// retries each need a ring of their own, sustained churn of the member
+// sets past this starts over with an empty cache.
+const maxCachedRings = 64
+
+// ConsistentHashStrategy maps requests onto a hash ring holding
+// VirtualNodes points per backend, so adding or removing a backend only
+// moves the keys that hashed next to its points. Key selects what is
+// hashed, see hashKey.
+type ConsistentHashStrategy struct {
+	Key          string
+	VirtualNodes int
+
+	mux sync.Mutex
+	//Rings by ringKey of their members, so alternating between the
+	//canary and stable subsets or retrying without a backend reuses
+	//the ring built for that set
+	rings map[string]*hashRing
+}
+
+type hashRing struct {
+	//Backends the ring was built from, a reloaded backend keeps its URL
+	//but is a new *BackEnd
+	members map[*BackEnd]bool
+	points  []ringPoint
+}
+
+type ringPoint struct {
+	hash    uint64
+	backend *BackEnd
+}
+
+func (s *ConsistentHashStrategy) Pick(backends []*BackEnd, r *http.Request) *BackEnd {
+	if len(backends) == 0 {
+		return nil
+	}
+
+	ring := s.ringFor(backends)
+	h := hash64(hashKey(r, s.Key))
+	start := sort.Search(len(ring.points), func(i int) bool {
+		return ring.points[i].hash >= h
+	})
+
+	//Walk clockwise until a healthy backend turns up
+	for i := 0; i < len(ring.points); i++ {
+		p := ring.points[(start+i)%len(ring.points)]
+		if p.backend.isAvailable() {
+			return p.backend
+		}
+	}
+	return nil
+}
+
+// ringFor returns the ring for backends, building it on first use of
+// that set of backends.
+func (s *ConsistentHashStrategy) ringFor(backends []*BackEnd) *hashRing {
+	key := ringKey(backends)
+
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	if ring, ok := s.rings[key]; ok && ring.hasMembers(backends) {
+		return ring
+	}
+
+	vnodes := s.VirtualNodes
+	if vnodes <= 0 {
+		vnodes = defaultVirtualNodes
+	}
+
+	ring := &hashRing{
+		members: make(map[*BackEnd]bool, len(backends)),
+		points:  make([]ringPoint, 0, len(backends)*vnodes),
+	}
+	for _, b := range backends {
+		ring.members[b] = true
+		for i := 0; i < vnodes; i++ {
+			ring.points = append(ring.points, ringPoint{
+				hash:    hash64(b.url.String() + "#" + strconv.Itoa(i)),
+				backend: b,
+			})
+		}
+	}
+	sort.Slice(ring.points, func(i, j int) bool {
+		return ring.points[i].hash < ring.points[j].hash
+	})
+
+	if s.rings == nil || len(s.rings) >= maxCachedRings {
+		s.rings = make(map[string]*hashRing)
+	}
+	s.rings[key] = ring
+	return ring
+}
+
+func (s *ConsistentHashStrategy) forget(b *BackEnd) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	for key, ring := range s.rings {
+		if ring.members[b] {
+			delete(s.rings, key)
+		}
+	}
+}
+
+// ringKey identifies a set of backends by their sorted URLs, the ring
+// does not depend on the order they came in.
+func ringKey(backends []*BackEnd) string {
+	urls := make([]string, len(backends))
+	for i, b := range backends {
+		urls[i] = b.url.String()
+	}
+	slices.Sort(urls)
+	return strings.Join(urls, "\n")
+}
+
+// hasMembers reports whether the ring was built from exactly backends.
+func (ring *hashRing) hasMembers(backends []*BackEnd) bool {
+	if len(ring.members) != len(backends) {
+		return false
+	}
+	for _, b := range backends {
+		if !ring.members[b] {
+			return false
+		}
+	}
+	return true
+}
+
+// hashKey extracts the request attribute named by key: "ip" (default),
+// "path", "header:<Name>" or "query:<name>". Requests lacking the named
+// header or query parameter fall back to the client IP.
+func hashKey(r *http.Request, key string) string {
+	var v string
+	switch {
+	case key == "path":
+		return r.URL.Path
+	case strings.HasPrefix(key, "header:"):
+		v = r.Header.Get(strings.TrimPrefix(key, "header:"))
+	case strings.HasPrefix(key, "query:"):
+		v = r.URL.Query().Get(strings.TrimPrefix(key, "query:"))
+	}
+	if v == "" {
+		return clientIP(r)
+	}
+	return v
+}
+
+// validHashKey reports whether key is understood by hashKey.
+func validHashKey(key string) error {
+	switch {
+	case key == "", key == "ip", key == "path":
+		return nil
+	case strings.HasPrefix(key, "header:") && len(key) > len("header:"):
+		return nil
+	case strings.HasPrefix(key, "query:") && len(key) > len("query:"):
+		return nil
+	}
+	return fmt.Errorf("unknown hash key %q, want ip, path, header:<Name> or query:<name>", key)
+}
+
+// hash64 hashes s for placement on the ring. FNV-1a alone leaves
+// similar strings such as "/key/1" and "/key/2" close together, so its
+// output is run through the murmur3 finalizer to spread them out.
+func hash64(s string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(s))
+	x := h.Sum64()
+	x ^= x >> 33
+	x *= 0xff51afd7ed558ccd
+	x ^= x >> 33
+	x *= 0xc4ceb9fe1a85ec53
+	x ^= x >> 33
+	return x
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"testing"
+)
+
+// assignments maps each of n paths to the backend s picks for it.
+func assignments(s Strategy, backends []*BackEnd, n int) []*BackEnd {
+	picks := make([]*BackEnd, n)
+	for i := range picks {
+		picks[i] = s.Pick(backends, httptest.NewRequest(http.MethodGet, fmt.Sprintf("/key/%d", i), nil))
+	}
+	return picks
+}
+
+func TestConsistentHashRemapChurn(t *testing.T) {
+	backends := fakeBackends(t, 10)
+	s := &ConsistentHashStrategy{Key: "path"}
+	before := assignments(s, backends, 2000)
+
+	gone := backends[3]
+	after := assignments(s, slices.Delete(slices.Clone(backends), 3, 4), 2000)
+
+	moved := 0
+	for i := range before {
+		if before[i] == after[i] {
+			continue
+		}
+		if before[i] != gone {
+			t.Fatalf("key %d moved from %s to %s though its backend stayed", i, before[i].url, after[i].url)
+		}
+		moved++
+	}
+	//A tenth of the keys lived on the removed backend
+	if moved < 100 || moved > 350 {
+		t.Fatalf("%d of 2000 keys remapped when one of 10 backends left, want about 200", moved)
+	}
+}
+
+func TestConsistentHashDownBackendMovesOnlyItsKeys(t *testing.T) {
+	backends := fakeBackends(t, 5)
+	s := &ConsistentHashStrategy{Key: "path", VirtualNodes: 50}
+	before := assignments(s, backends, 500)
+
+	backends[2].setAlive(false)
+	after := assignments(s, backends, 500)
+	for i := range before {
+		if before[i] != backends[2] && before[i] != after[i] {
+			t.Fatalf("key %d moved although its backend is healthy", i)
+		}
+		if after[i] == backends[2] {
+			t.Fatalf("key %d still on the down backend", i)
+		}
+	}
+}
+
+func TestConsistentHashReusesRings(t *testing.T) {
+	backends := fakeBackends(t, 4)
+	s := &ConsistentHashStrategy{Key: "path"}
+
+	//A retry without backends[1] in between must not cost a rebuild
+	all := s.ringFor(backends)
+	retry := s.ringFor(without(backends, backends[1]))
+	if retry == all {
+		t.Fatal("ring without a backend is the ring of the whole pool")
+	}
+	reversed := slices.Clone(backends)
+	slices.Reverse(reversed)
+	if s.ringFor(backends) != all || s.ringFor(reversed) != all {
+		t.Fatal("ring of the whole pool rebuilt after a retry")
+	}
+
+	//A reloaded backend keeps its URL but needs a ring of its own
+	reloaded := slices.Clone(backends)
+	reloaded[2] = newTestBackEnd(t, BackendConfig{URL: backends[2].url.String()}, backendOptions{})
+	if ring := s.ringFor(reloaded); ring == all || !ring.members[reloaded[2]] {
+		t.Fatal("ring of the old backend reused after a reload")
+	}
+
+	s.forget(backends[1])
+	if len(s.rings) != 1 {
+		t.Fatalf("%d rings cached after forgetting a backend in two of three, want 1", len(s.rings))
+	}
+}
+
+func TestConsistentHashSpreadsSimilarKeys(t *testing.T) {
+	backends := fakeBackends(t, 10)
+	counts := make(map[*BackEnd]int)
+	for _, b := range assignments(&ConsistentHashStrategy{Key: "path"}, backends, 2000) {
+		counts[b]++
+	}
+	for _, b := range backends {
+		if n := counts[b]; n < 100 || n > 400 {
+			t.Errorf("%s got %d of 2000 keys, want about 200", b.url, n)
+		}
+	}
+}
+
+func TestHashKey(t *testing.T) {
+	req := httptest.NewRequest(http.MethodGet, "/orders?uid=42", nil)
+	req.RemoteAddr = "203.0.113.7:5000"
+	req.Header.Set("X-Tenant", "acme")
+
+	for _, tc := range []struct {
+		key, want string
+	}{
+		{"", "203.0.113.7"},
+		{"ip", "203.0.113.7"},
+		{"path", "/orders"},
+		{"header:X-Tenant", "acme"},
+		{"header:x-tenant", "acme"},
+		{"query:uid", "42"},
+		{"header:X-Missing", "203.0.113.7"},
+		{"query:missing", "203.0.113.7"},
+	} {
+		if got := hashKey(req, tc.key); got != tc.want {
+			t.Errorf("hashKey(%q) = %q, want %q", tc.key, got, tc.want)
+		}
+	}
+
+	for _, key := range []string{"cookie", "header:", "query:"} {
+		if validHashKey(key) == nil {
+			t.Errorf("validHashKey accepted %q", key)
+		}
+	}
+}
+
+func TestHashStrategiesRouteByHeader(t *testing.T) {
+	backends := fakeBackends(t, 5)
+	for _, s := range []Strategy{
+		&IPHashStrategy{Key: "header:X-Tenant"},
+		&ConsistentHashStrategy{Key: "header:X-Tenant"},
+	} {
+		pick := func(tenant, remoteAddr string) *BackEnd {
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			req.RemoteAddr = remoteAddr
+			if tenant != "" {
+				req.Header.Set("X-Tenant", tenant)
+			}
+			return s.Pick(backends, req)
+		}
+
+		//The same tenant lands on one backend whichever client sends it
+		tenants := make(map[*BackEnd]bool)
+		for i := range 20 {
+			tenant := fmt.Sprintf("tenant-%d", i)
+			first := pick(tenant, "198.51.100.1:1000")
+			tenants[first] = true
+			for _, addr := range []string{"198.51.100.2:2000", "203.0.113.9:3000"} {
+				if b := pick(tenant, addr); b != first {
+					t.Fatalf("%T: %s moved from %s to %s with a new client", s, tenant, first.url, b.url)
+				}
+			}
+		}
+		if len(tenants) < 2 {
+			t.Errorf("%T: 20 tenants all on one backend", s)
+		}
+
+		//Without the header the client IP decides, deterministically
+		if a, b := pick("", "198.51.100.1:1000"), pick("", "198.51.100.1:2000"); a != b {
+			t.Errorf("%T: requests without the header from one IP split over %s and %s", s, a.url, b.url)
+		}
+	}
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+)
+
+// HeadersConfig rewrites headers on the way to and from backends.
+type HeadersConfig struct {
+	Request  HeaderRules `yaml:"request"`
+	Response HeaderRules `yaml:"response"`
+}
+
+// HeaderRules lists header changes. They are applied in a fixed order:
+// remove, then set, then add, each in header name order.
+type HeaderRules struct {
+	// Set replaces any existing values of a header.
+	Set map[string]string `yaml:"set"`
+	// Add appends a value, keeping existing ones.
+	Add    map[string]string `yaml:"add"`
+	Remove []string          `yaml:"remove"`
+}
+
+func (h *HeaderRules) validate() error {
+	for _, name := range h.names() {
+		if name == "" || strings.ContainsAny(name, " \t:\r\n") {
+			return fmt.Errorf("invalid header name %q", name)
+		}
+	}
+	return nil
+}
+
+func (h *HeaderRules) names() []string {
+	names := slices.Clone(h.Remove)
+	for name := range h.Set {
+		names = append(names, name)
+	}
+	for name := range h.Add {
+		names = append(names, name)
+	}
+	return names
+}
+
+// headerOps is the compiled, ordered form of HeaderRules.
+type headerOps struct {
+	remove []string
+	set    [][2]string
+	add    [][2]string
+}
+
+// compile returns the ordered operations for h, or nil when h is empty.
+func (h *HeaderRules) compile() *headerOps {
+	if len(h.Set) == 0 && len(h.Add) == 0 && len(h.Remove) == 0 {
+		return nil
+	}
+
+	ops := &headerOps{remove: slices.Sorted(slices.Values(h.Remove))}
+	ops.set = sortedPairs(h.Set)
+	ops.add = sortedPairs(h.Add)
+	return ops
+}
+
+func sortedPairs(m map[string]string) [][2]string {
+	pairs := make([][2]string, 0, len(m))
+	for k, v := range m {
+		pairs = append(pairs, [2]string{k, v})
+	}
+	slices.SortFunc(pairs, func(a, b [2]string) int {
+		return strings.Compare(a[0], b[0])
+	})
+	return pairs
+}
+
+// apply rewrites h. A nil headerOps leaves h untouched.
+func (o *headerOps) apply(h http.Header) {
+	if o == nil {
+		return
+	}
+	for _, name := range o.remove {
+		h.Del(name)
+	}
+	for _, kv := range o.set {
+		h.Set(kv[0], kv[1])
+	}
+	for _, kv := range o.add {
+		h.Add(kv[0], kv[1])
+	}
+}
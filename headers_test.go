@@ -0,0 +1,88 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"testing"
+)
+
+func TestHeaderRulesThroughProxy(t *testing.T) {
+	srv := newTestServer(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Server", "upstream/1.0")
+		w.Header().Set("X-Powered-By", "php")
+		w.Header().Set("X-Seen-Tenant", r.Header.Get("X-Tenant"))
+		w.Header().Set("X-Seen-Debug", r.Header.Get("X-Debug"))
+	})
+
+	l := newTestLB(t)
+	l.backendOpts.requestHeaders = (&HeaderRules{
+		Set:    map[string]string{"X-Tenant": "acme"},
+		Remove: []string{"X-Debug"},
+	}).compile()
+	l.backendOpts.responseHeaders = (&HeaderRules{
+		Set:    map[string]string{"X-Content-Type-Options": "nosniff"},
+		Remove: []string{"Server", "X-Powered-By"},
+	}).compile()
+	addTestBackends(t, l, srv.URL)
+
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set("X-Tenant", "spoofed")
+	req.Header.Set("X-Debug", "1")
+	h := serve(l, req).Header()
+
+	if h.Get("X-Content-Type-Options") != "nosniff" {
+		t.Error("added response header missing")
+	}
+	if h.Get("Server") != "" || h.Get("X-Powered-By") != "" {
+		t.Errorf("removed response headers still present: %v", h)
+	}
+	if h.Get("X-Seen-Tenant") != "acme" || h.Get("X-Seen-Debug") != "" {
+		t.Errorf("backend saw X-Tenant %q and X-Debug %q, want acme and nothing", h.Get("X-Seen-Tenant"), h.Get("X-Seen-Debug"))
+	}
+}
+
+func TestHeaderOpsOrder(t *testing.T) {
+	ops := (&HeaderRules{
+		Set:    map[string]string{"B": "set", "A": "set"},
+		Add:    map[string]string{"B": "added"},
+		Remove: []string{"B"},
+	}).compile()
+
+	h := http.Header{"B": {"original"}}
+	ops.apply(h)
+	//Remove, then set, then add
+	if got := h.Values("B"); !slices.Equal(got, []string{"set", "added"}) {
+		t.Fatalf("B = %q, want [set added]", got)
+	}
+	if (&HeaderRules{}).compile() != nil {
+		t.Fatal("empty rules compiled to operations")
+	}
+}
+
+func TestServedByHeader(t *testing.T) {
+	a := newTestServer(t, nameHandler("a"))
+	b := newTestServer(t, nameHandler("b"))
+	l := newTestLB(t)
+	l.backendOpts.servedByHeader = "X-Served-By"
+	addTestBackends(t, l, a.URL, b.URL)
+
+	want := map[string]string{"a": a.URL, "b": b.URL}
+	seen := make(map[string]bool)
+	for range 4 {
+		rec := get(l, "/")
+		if got := rec.Header().Get("X-Served-By"); got != want[rec.Body.String()] {
+			t.Fatalf("backend %q answered with X-Served-By %q, want %q", rec.Body, got, want[rec.Body.String()])
+		}
+		seen[rec.Body.String()] = true
+	}
+	if len(seen) != 2 {
+		t.Fatalf("only %v answered", seen)
+	}
+
+	//Off unless configured
+	plain := newTestLB(t, a.URL)
+	if got := get(plain, "/").Header().Get("X-Served-By"); got != "" {
+		t.Fatalf("X-Served-By = %q without the header configured", got)
+	}
+}
@@ -0,0 +1,477 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"math/rand/v2"
+	"net"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	healthModeHTTP = "http"
+	healthModeTCP  = "tcp"
+	healthModeGRPC = "grpc"
+)
+
+// healthCheckConfig describes how a backend is probed.
+type healthCheckConfig struct {
+	mode   string
+	path   string
+	status StatusCodes
+	method string
+	body   string
+	header http.Header
+	//gRPC service name to query, empty asks about the whole server
+	service string
+}
+
+// equal reports whether c and o probe the same way.
+func (c healthCheckConfig) equal(o healthCheckConfig) bool {
+	if c.mode != o.mode || c.path != o.path || !slices.Equal(c.status, o.status) || c.method != o.method || c.body != o.body || c.service != o.service || len(c.header) != len(o.header) {
+		return false
+	}
+	for k, v := range c.header {
+		if !slices.Equal(v, o.header[k]) {
+			return false
+		}
+	}
+	return true
+}
+
+// healthOptions controls the active health checker.
+type healthOptions struct {
+	interval time.Duration
+	timeout  time.Duration
+	//Consecutive failures before a live backend is marked dead
+	fall int
+	//Consecutive successes before a dead backend is marked alive
+	rise int
+	//Maximum number of backends probed at the same time
+	concurrency int
+	//Longest delay between probes of a dead backend, at most interval
+	//disables backoff
+	backoffMax time.Duration
+	//Fraction of interval by which periodic probes are randomly delayed,
+	//so backends aren't all probed at the same instant
+	jitter float64
+	flap   flapOptions
+}
+
+// validate checks that probes run at a positive interval and each one
+// gives up before the next is due.
+func (o healthOptions) validate() error {
+	if o.interval <= 0 {
+		return fmt.Errorf("health interval must be positive, got %s", o.interval)
+	}
+	if o.timeout <= 0 || o.timeout >= o.interval {
+		return fmt.Errorf("health timeout must be positive and smaller than interval %s, got %s", o.interval, o.timeout)
+	}
+	return nil
+}
+
+// jitterDelay returns a random delay for one periodic probe. It stays
+// below interval minus timeout so a delayed probe still finishes before
+// the next sweep is due.
+func (o healthOptions) jitterDelay() time.Duration {
+	window := min(time.Duration(o.jitter*float64(o.interval)), o.interval-o.timeout)
+	if window <= 0 {
+		return 0
+	}
+	return time.Duration(rand.Float64() * float64(window))
+}
+
+// backoff returns how many intervals to skip before probing a dead
+// backend again after failures consecutive failed probes. The delay
+// doubles with every failure up to backoffMax.
+func (o healthOptions) backoff(failures int) int {
+	if o.backoffMax <= o.interval || failures < 1 {
+		return 0
+	}
+	maxSkip := int(o.backoffMax/o.interval) - 1
+	return min(1<<min(failures-1, 30)-1, maxSkip)
+}
+
+// passiveOptions controls marking backends dead from proxy errors seen
+// on live traffic. A zero threshold disables passive checks.
+type passiveOptions struct {
+	threshold int
+	window    time.Duration
+}
+
+// newHealthClient returns the client used for HTTP health checks. It
+// shares the proxy transport so https backends are verified the same way.
+func newHealthClient(transport *http.Transport) *http.Client {
+	c := &http.Client{
+		//Report redirects as-is instead of following them
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+	if transport != nil {
+		c.Transport = transport
+	}
+	return c
+}
+
+// healthLatencyHistory is the number of recent probe latencies kept per
+// backend.
+const healthLatencyHistory = 10
+
+func (b *BackEnd) isBackendAlive(ctx context.Context, timeout time.Duration) bool {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	start := time.Now()
+	ok := b.checker.Check(ctx, b)
+
+	latency := time.Since(start)
+	b.recordCheckLatency(latency)
+	healthCheckLatency.WithLabelValues(b.url.String()).Set(latency.Seconds())
+	return ok
+}
+
+// recordCheckLatency adds d to the rolling history of probe latencies.
+func (b *BackEnd) recordCheckLatency(d time.Duration) {
+	b.mux.Lock()
+	defer b.mux.Unlock()
+	b.checkLatencies[b.checkCount%healthLatencyHistory] = d
+	b.checkCount++
+}
+
+// checkLatency returns the latency of the last probe and the average
+// over the recent history. Both are zero before the first probe.
+func (b *BackEnd) checkLatency() (last, avg time.Duration) {
+	b.mux.Lock()
+	defer b.mux.Unlock()
+
+	n := min(b.checkCount, healthLatencyHistory)
+	if n == 0 {
+		return 0, 0
+	}
+
+	var sum time.Duration
+	for _, d := range b.checkLatencies[:n] {
+		sum += d
+	}
+	return b.checkLatencies[(b.checkCount-1)%healthLatencyHistory], sum / time.Duration(n)
+}
+
+// HealthChecker decides whether a backend is alive. Check must give up
+// once ctx is done.
+type HealthChecker interface {
+	Check(ctx context.Context, b *BackEnd) bool
+}
+
+// newHealthChecker returns the checker for hc. HTTP and gRPC checks
+// verify https backends with the settings of transport.
+func newHealthChecker(hc healthCheckConfig, transport *http.Transport) HealthChecker {
+	switch hc.mode {
+	case healthModeTCP:
+		return &TCPChecker{}
+	case healthModeGRPC:
+		c := &GRPCChecker{Service: hc.service}
+		if transport != nil {
+			c.TLS = transport.TLSClientConfig
+		}
+		return c
+	}
+	return &HTTPChecker{
+		Path:   hc.path,
+		Status: hc.status,
+		Method: hc.method,
+		Body:   hc.body,
+		Header: hc.header,
+		Client: newHealthClient(transport),
+	}
+}
+
+// dialAddr returns the host:port to dial for b, defaulting the port from
+// the scheme when the URL has none.
+func (b *BackEnd) dialAddr() string {
+	if b.url.Port() != "" {
+		return b.url.Host
+	}
+	switch b.url.Scheme {
+	case "http":
+		return net.JoinHostPort(b.url.Hostname(), "80")
+	case "https":
+		return net.JoinHostPort(b.url.Hostname(), "443")
+	}
+	return b.url.Host
+}
+
+// TCPChecker considers a backend alive when a TCP connection to it can
+// be opened.
+type TCPChecker struct{}
+
+func (c *TCPChecker) Check(ctx context.Context, b *BackEnd) bool {
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "tcp", b.dialAddr())
+	if err != nil {
+		slog.Warn("Site unreachable", "event", "health_check", "backend", b.url.String(), "mode", healthModeTCP, "error", err)
+		return false
+	}
+	defer conn.Close()
+	return true
+}
+
+// HTTPChecker sends a request to Path on the backend and considers it
+// alive when the response status is one of Status.
+type HTTPChecker struct {
+	Path   string
+	Status StatusCodes
+	Method string
+	Body   string
+	Header http.Header
+	Client *http.Client
+}
+
+func (c *HTTPChecker) Check(ctx context.Context, b *BackEnd) bool {
+	target := b.url.JoinPath(c.Path)
+	var body io.Reader
+	if c.Body != "" {
+		body = strings.NewReader(c.Body)
+	}
+	req, err := http.NewRequestWithContext(ctx, c.Method, target.String(), body)
+	if err != nil {
+		slog.Warn("Health check failed", "event", "health_check", "backend", b.url.String(), "target", target.String(), "error", err)
+		return false
+	}
+	for k, v := range c.Header {
+		req.Header[k] = v
+	}
+
+	resp, err := c.Client.Do(req)
+	if err != nil {
+		slog.Warn("Health check failed", "event", "health_check", "backend", b.url.String(), "target", target.String(), "error", err)
+		return false
+	}
+	defer func() {
+		//Drain the rest so the connection goes back to the idle pool,
+		//the probe timeout bounds how long that may take
+		io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+	}()
+
+	if !c.Status.contains(resp.StatusCode) {
+		slog.Warn("Health check returned unexpected status", "event", "health_check", "backend", b.url.String(), "target", target.String(), "status", resp.StatusCode, "expected", c.Status.String())
+		return false
+	}
+	return true
+}
+
+// recordHealth applies a single probe result and flips the alive state
+// once the fall or rise threshold is crossed. The very first probe sets
+// the state directly so backends don't wait several intervals at startup.
+func (b *BackEnd) recordHealth(ok bool, opts healthOptions) (alive, changed, flapChanged bool) {
+	b.mux.Lock()
+	defer b.mux.Unlock()
+
+	defer func() {
+		if b.alive.Load() {
+			b.skipChecks = 0
+		} else {
+			b.skipChecks = opts.backoff(b.failures)
+		}
+	}()
+
+	b.lastCheck = time.Now()
+	flapChanged = b.recordResult(ok, b.lastCheck, opts.flap)
+	if ok {
+		b.successes++
+		b.failures = 0
+	} else {
+		b.failures++
+		b.successes = 0
+	}
+
+	alive = b.alive.Load()
+	switch {
+	case !b.checked:
+		b.checked = true
+		b.alive.Store(ok)
+		return ok, false, flapChanged
+	case alive && b.failures >= opts.fall:
+		b.alive.Store(false)
+		return false, true, flapChanged
+	case !alive && b.successes >= opts.rise:
+		b.alive.Store(true)
+		b.healthySince = b.lastCheck
+		return true, true, flapChanged
+	}
+
+	return alive, false, flapChanged
+}
+
+// healthCheck probes every backend of p in parallel, running at most
+// opts.concurrency probes at a time. With jitter set each probe is
+// first delayed by opts.jitterDelay.
+func (l *LoadBalancer) healthCheck(ctx context.Context, p *pool, jitter bool) {
+	opts := p.healthOpts
+	limit := opts.concurrency
+	if limit < 1 {
+		limit = 1
+	}
+	sem := make(chan struct{}, limit)
+
+	var wg sync.WaitGroup
+	for _, b := range p.snapshot() {
+		if b.skipCheck() {
+			continue
+		}
+		wg.Add(1)
+		go func(b *BackEnd) {
+			defer wg.Done()
+			if jitter && !sleepContext(ctx, opts.jitterDelay()) {
+				return
+			}
+			sem <- struct{}{}
+			defer func() { <-sem }()
+			l.checkHealth(ctx, b, opts)
+		}(b)
+	}
+	wg.Wait()
+}
+
+// skipCheck reports whether b is backing off and consumes one skipped
+// interval if so.
+func (b *BackEnd) skipCheck() bool {
+	b.mux.Lock()
+	defer b.mux.Unlock()
+	if b.skipChecks == 0 {
+		return false
+	}
+	b.skipChecks--
+	return true
+}
+
+// checkHealth runs a single probe against b and records the result. A
+// probe cut short by ctx is not recorded.
+func (l *LoadBalancer) checkHealth(ctx context.Context, b *BackEnd, opts healthOptions) {
+	ok := b.isBackendAlive(ctx, opts.timeout)
+	if ctx.Err() != nil {
+		return
+	}
+
+	alive, changed, flapChanged := b.recordHealth(ok, opts)
+	if changed {
+		l.notifyHealth(b, alive)
+	}
+	if flapChanged {
+		logFlapping(b, opts.flap)
+	}
+
+	switch {
+	case changed && alive:
+		slog.Info("Service is back up", "event", "health_transition", "backend", b.url.String(), "status", "alive", "checks", opts.rise)
+	case changed:
+		slog.Warn("Service went down", "event", "health_transition", "backend", b.url.String(), "status", "dead", "checks", opts.fall)
+	case alive:
+		slog.Info("Service is doing well", "event", "health_status", "backend", b.url.String(), "status", "alive")
+	default:
+		slog.Warn("Service is dead", "event", "health_status", "backend", b.url.String(), "status", "dead")
+	}
+}
+
+// PeriodicHealthCheck re-checks every backend of p each interval until
+// ctx is cancelled.
+func (l *LoadBalancer) PeriodicHealthCheck(ctx context.Context, p *pool) {
+	t := time.NewTicker(p.healthOpts.interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+			l.healthCheck(ctx, p, true)
+		}
+	}
+}
+
+// waitForBackendsPoll is how often waitForBackends re-probes backends.
+const waitForBackendsPoll = time.Second
+
+// waitForBackends blocks until some backend is alive, timeout elapsed
+// or ctx is cancelled, probing every backend each waitForBackendsPoll
+// regardless of the health interval.
+func (l *LoadBalancer) waitForBackends(ctx context.Context, timeout time.Duration) {
+	start := time.Now()
+	deadline := time.NewTimer(timeout)
+	defer deadline.Stop()
+	t := time.NewTicker(waitForBackendsPoll)
+	defer t.Stop()
+
+	for !l.anyAlive() {
+		slog.Info("Waiting for a backend to pass its health check", "event", "startup", "waited", time.Since(start).Round(time.Millisecond), "timeout", timeout)
+		select {
+		case <-ctx.Done():
+			return
+		case <-deadline.C:
+			slog.Warn("No backend alive, serving anyway", "event", "startup", "waited", timeout)
+			return
+		case <-t.C:
+		}
+
+		for _, p := range l.allPools() {
+			for _, b := range p.snapshot() {
+				if !b.isAlive() {
+					l.checkHealth(ctx, b, p.healthOpts)
+				}
+			}
+		}
+	}
+}
+
+// anyAlive reports whether any pool has an alive backend that isn't
+// disabled.
+func (l *LoadBalancer) anyAlive() bool {
+	for _, p := range l.allPools() {
+		for _, b := range p.snapshot() {
+			if b.isAlive() && !b.disabled.Load() {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// recordProxyError counts a proxy error against b and marks it dead
+// once opts.threshold errors happened within opts.window. Recovery goes
+// through the normal rise threshold of the active checker.
+func (b *BackEnd) recordProxyError(opts passiveOptions) bool {
+	if opts.threshold <= 0 {
+		return false
+	}
+
+	b.mux.Lock()
+	defer b.mux.Unlock()
+
+	now := time.Now()
+	if now.Sub(b.proxyErrorsSince) > opts.window {
+		b.proxyErrorsSince = now
+		b.proxyErrors = 0
+	}
+	b.proxyErrors++
+
+	if b.proxyErrors < opts.threshold || !b.alive.Load() {
+		return false
+	}
+
+	b.alive.Store(false)
+	b.successes = 0
+	b.proxyErrors = 0
+	return true
+}
+
+func (b *BackEnd) lastHealthCheck() time.Time {
+	b.mux.Lock()
+	defer b.mux.Unlock()
+	return b.lastCheck
+}
@@ -0,0 +1,627 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"runtime"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestPeriodicHealthCheckRepeats(t *testing.T) {
+	var probes atomic.Int64
+	srv := newTestServer(t, countingHandler(&probes))
+	l := newTestLB(t, srv.URL)
+	l.healthOpts.interval = 50 * time.Millisecond
+	l.healthOpts.timeout = 40 * time.Millisecond
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		l.PeriodicHealthCheck(ctx, &l.pool)
+		close(done)
+	}()
+
+	time.Sleep(180 * time.Millisecond)
+	cancel()
+	<-done
+
+	if n := probes.Load(); n < 2 {
+		t.Fatalf("health check ran %d times in 180ms at a 50ms interval, want at least 2", n)
+	}
+}
+
+func TestHTTPCheckerRequiresExpectedStatus(t *testing.T) {
+	srv := newTestServer(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/health" {
+			http.NotFound(w, r)
+			return
+		}
+		w.WriteHeader(http.StatusInternalServerError)
+	})
+
+	httpBackend := newTestBackEnd(t, BackendConfig{URL: srv.URL}, backendOptions{})
+	if httpBackend.isBackendAlive(context.Background(), time.Second) {
+		t.Error("HTTP check passed on a backend answering 500")
+	}
+
+	//The port is open, which is all a TCP check looks at
+	tcpBackend := newTestBackEnd(t, BackendConfig{URL: srv.URL, HealthMode: healthModeTCP}, backendOptions{})
+	if !tcpBackend.isBackendAlive(context.Background(), time.Second) {
+		t.Error("TCP check failed on a listening backend")
+	}
+}
+
+func TestHTTPCheckerTimesOut(t *testing.T) {
+	release := make(chan struct{})
+	srv := newTestServer(t, func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-release:
+		case <-r.Context().Done():
+		}
+	})
+	defer close(release)
+
+	b := newTestBackEnd(t, BackendConfig{URL: srv.URL}, backendOptions{})
+	start := time.Now()
+	if b.isBackendAlive(context.Background(), 50*time.Millisecond) {
+		t.Fatal("hung backend reported alive")
+	}
+	if d := time.Since(start); d > time.Second {
+		t.Fatalf("check took %v with a 50ms timeout", d)
+	}
+}
+
+func TestRecordHealthThresholds(t *testing.T) {
+	opts := healthOptions{interval: time.Minute, fall: 3, rise: 2}
+	b := newTestBackEnd(t, BackendConfig{URL: "http://backend"}, backendOptions{})
+	b.recordHealth(true, opts)
+
+	steps := []struct {
+		ok    bool
+		alive bool
+	}{
+		{false, true},
+		{false, true},
+		{true, true}, //A success resets the failure count
+		{false, true},
+		{false, true},
+		{false, false},
+		{true, false},
+		{true, true},
+	}
+	for i, s := range steps {
+		if alive, _, _ := b.recordHealth(s.ok, opts); alive != s.alive {
+			t.Fatalf("step %d: alive = %v, want %v", i, alive, s.alive)
+		}
+	}
+}
+
+func TestHealthSweepRunsConcurrently(t *testing.T) {
+	release := make(chan struct{})
+	hang := func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-release:
+		case <-r.Context().Done():
+		}
+	}
+	l := newTestLB(t)
+	l.healthOpts.timeout = 100 * time.Millisecond
+	l.healthOpts.concurrency = 8
+	var urls []string
+	for range 8 {
+		urls = append(urls, newTestServer(t, hang).URL)
+	}
+	addTestBackends(t, l, urls...)
+	defer close(release)
+
+	start := time.Now()
+	l.healthCheck(context.Background(), &l.pool, false)
+	if d := time.Since(start); d > 400*time.Millisecond {
+		t.Fatalf("sweep of 8 hanging backends took %v with a 100ms timeout", d)
+	}
+	for _, b := range l.snapshot() {
+		if b.isAlive() {
+			t.Errorf("hanging backend %s still alive", b.url)
+		}
+	}
+}
+
+// resetHandler passes health checks and hangs up on every other request.
+func resetHandler(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path == "/health" {
+		return
+	}
+	conn, _, err := w.(http.Hijacker).Hijack()
+	if err == nil {
+		conn.Close()
+	}
+}
+
+func TestPassiveHealthMarksBackendDead(t *testing.T) {
+	srv := newTestServer(t, resetHandler)
+	l := newTestLB(t)
+	l.healthOpts.rise = 2
+	l.backendOpts.passive = passiveOptions{threshold: 2, window: time.Minute}
+	b := addTestBackends(t, l, srv.URL)[0]
+	b.recordHealth(true, l.healthOpts)
+
+	get(l, "/")
+	if !b.isAlive() {
+		t.Fatal("backend marked dead below the threshold")
+	}
+	get(l, "/")
+	if b.isAlive() {
+		t.Fatal("backend still alive after 2 proxy errors")
+	}
+
+	//Recovery needs the usual run of successful checks
+	l.checkHealth(context.Background(), b, l.healthOpts)
+	if b.isAlive() {
+		t.Fatal("backend back after a single check with rise 2")
+	}
+	l.checkHealth(context.Background(), b, l.healthOpts)
+	if !b.isAlive() {
+		t.Fatal("backend not back after 2 successful checks")
+	}
+}
+
+func TestHealthCheckLatencyRecorded(t *testing.T) {
+	srv := newTestServer(t, func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(30 * time.Millisecond)
+	})
+	l := newTestLB(t, srv.URL)
+	b := l.snapshot()[0]
+
+	if last, _ := b.checkLatency(); last != 0 {
+		t.Fatalf("latency %v before any check", last)
+	}
+	l.checkHealth(context.Background(), b, l.healthOpts)
+	l.checkHealth(context.Background(), b, l.healthOpts)
+
+	last, avg := b.checkLatency()
+	if last < 30*time.Millisecond || avg < 30*time.Millisecond {
+		t.Fatalf("last %v, average %v, want at least the 30ms the stub takes", last, avg)
+	}
+	if s := newBackendStatus(b); s.HealthCheckLatencyMS < 30 || s.HealthCheckLatencyAvgMS < 30 || s.LastHealthCheck == nil {
+		t.Fatalf("stats = %+v, want the latency exposed", s)
+	}
+	if v := testutil.ToFloat64(healthCheckLatency.WithLabelValues(srv.URL)); v < 0.03 {
+		t.Fatalf("health check latency gauge = %v, want at least 0.03", v)
+	}
+}
+
+func TestHealthBackoff(t *testing.T) {
+	opts := healthOptions{interval: time.Minute, backoffMax: 8 * time.Minute}
+	var got []int
+	for failures := 1; failures <= 6; failures++ {
+		got = append(got, opts.backoff(failures))
+	}
+	if want := []int{0, 1, 3, 7, 7, 7}; !slices.Equal(got, want) {
+		t.Fatalf("skipped intervals = %v, want %v", got, want)
+	}
+
+	opts.backoffMax = opts.interval
+	if n := opts.backoff(5); n != 0 {
+		t.Fatalf("backoff with backoffMax at the interval = %d, want 0", n)
+	}
+}
+
+func TestDeadBackendProbedLessOften(t *testing.T) {
+	var probes atomic.Int64
+	var healthy atomic.Bool
+	srv := newTestServer(t, func(w http.ResponseWriter, r *http.Request) {
+		probes.Add(1)
+		toggleHandler(&healthy)(w, r)
+	})
+	l := newTestLB(t, srv.URL)
+	l.healthOpts.backoffMax = 4 * l.healthOpts.interval
+
+	//Record which sweeps actually probed the dead backend
+	var probed []int
+	for sweep := range 12 {
+		before := probes.Load()
+		l.healthCheck(context.Background(), &l.pool, false)
+		if probes.Load() > before {
+			probed = append(probed, sweep)
+		}
+	}
+	if want := []int{0, 1, 3, 7, 11}; !slices.Equal(probed, want) {
+		t.Fatalf("probed in sweeps %v, want %v as the delay grows to its cap", probed, want)
+	}
+
+	//Recovery resets the schedule
+	healthy.Store(true)
+	for range 4 {
+		l.healthCheck(context.Background(), &l.pool, false)
+	}
+	before := probes.Load()
+	l.healthCheck(context.Background(), &l.pool, false)
+	if probes.Load() == before || !l.snapshot()[0].isAlive() {
+		t.Fatal("recovered backend not back on the normal interval")
+	}
+}
+
+func TestHTTPCheckerMethodAndHeaders(t *testing.T) {
+	srv := newTestServer(t, func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/head-only":
+			if r.Method != http.MethodHead {
+				w.WriteHeader(http.StatusMethodNotAllowed)
+			}
+		case "/auth":
+			body, _ := io.ReadAll(r.Body)
+			if r.Method != http.MethodPost || r.Header.Get("Authorization") != "Bearer probe" || string(body) != "ping" {
+				w.WriteHeader(http.StatusUnauthorized)
+			}
+		}
+	})
+
+	for _, tc := range []struct {
+		name string
+		bc   BackendConfig
+		want bool
+	}{
+		{"GET on HEAD endpoint", BackendConfig{HealthPath: "/head-only"}, false},
+		{"HEAD", BackendConfig{HealthPath: "/head-only", HealthMethod: http.MethodHead}, true},
+		{"missing auth", BackendConfig{HealthPath: "/auth", HealthMethod: http.MethodPost, HealthBody: "ping"}, false},
+		{"auth header", BackendConfig{HealthPath: "/auth", HealthMethod: http.MethodPost, HealthBody: "ping", HealthHeaders: map[string]string{"authorization": "Bearer probe"}}, true},
+	} {
+		tc.bc.URL = srv.URL
+		b := newTestBackEnd(t, tc.bc, backendOptions{})
+		if got := b.isBackendAlive(context.Background(), time.Second); got != tc.want {
+			t.Errorf("%s: alive = %v, want %v", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestHealthMethodValidation(t *testing.T) {
+	for _, bc := range []BackendConfig{
+		{URL: "http://a", HealthMethod: "TRACE"},
+		{URL: "http://a", HealthMethod: "get"},
+		{URL: "http://a", HealthBody: "ping"},
+		{URL: "http://a", HealthHeaders: map[string]string{"Bad Name": "x"}},
+	} {
+		if err := bc.validate(); err == nil {
+			t.Errorf("validate accepted %+v", bc)
+		}
+	}
+}
+
+func TestFlapDetection(t *testing.T) {
+	opts := healthOptions{
+		interval: time.Minute,
+		fall:     1,
+		rise:     1,
+		flap:     flapOptions{threshold: 3, window: time.Minute, exclude: true},
+	}
+	b := newTestBackEnd(t, BackendConfig{URL: "http://backend"}, backendOptions{excludeFlapping: true})
+
+	//Three changes are allowed, the fourth trips the detector
+	var tripped int
+	for i, ok := range []bool{true, false, true, false, true} {
+		_, _, flapChanged := b.recordHealth(ok, opts)
+		if flapChanged {
+			tripped = i
+		}
+	}
+	if !b.flapping.Load() || tripped != 4 {
+		t.Fatalf("flapping = %v after change at result %d, want it set by the fifth result", b.flapping.Load(), tripped)
+	}
+	if !newBackendStatus(b).Flapping {
+		t.Error("stats do not report the backend as flapping")
+	}
+	if b.isAvailable() {
+		t.Error("flapping backend still in rotation with exclusion on")
+	}
+
+	//Results that have aged out of the window no longer count
+	b.mux.Lock()
+	settled := b.recordResult(true, time.Now().Add(2*time.Minute), opts.flap)
+	b.mux.Unlock()
+	if !settled || b.flapping.Load() {
+		t.Fatal("backend still flapping once its changes left the window")
+	}
+	if !b.isAvailable() {
+		t.Fatal("settled backend not back in rotation")
+	}
+}
+
+func TestDialAddrDefaultsPort(t *testing.T) {
+	for _, tc := range []struct {
+		url, want string
+	}{
+		{"http://backend", "backend:80"},
+		{"https://backend", "backend:443"},
+		{"http://backend:8080", "backend:8080"},
+		{"https://[::1]", "[::1]:443"},
+	} {
+		b := newTestBackEnd(t, BackendConfig{URL: tc.url}, backendOptions{})
+		if got := b.dialAddr(); got != tc.want {
+			t.Errorf("dialAddr() for %s = %q, want %q", tc.url, got, tc.want)
+		}
+	}
+}
+
+// listenWellKnown listens on the loopback address at port, skipping the
+// test when the port is taken or needs privileges this run lacks.
+func listenWellKnown(t *testing.T, port string) net.Listener {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:"+port)
+	if err != nil {
+		t.Skipf("cannot listen on port %s: %v", port, err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	return ln
+}
+
+func TestPortlessBackendsReachable(t *testing.T) {
+	ln := listenWellKnown(t, "80")
+	srv := &http.Server{Handler: nameHandler("port-80")}
+	go srv.Serve(ln)
+	defer srv.Close()
+	listenWellKnown(t, "443")
+
+	l := newTestLB(t)
+	for _, bc := range []BackendConfig{
+		{URL: "http://127.0.0.1"},
+		{URL: "http://127.0.0.1", HealthMode: healthModeTCP},
+		{URL: "https://127.0.0.1", HealthMode: healthModeTCP},
+	} {
+		b := newTestBackEnd(t, bc, l.backendOpts)
+		if !b.isBackendAlive(context.Background(), time.Second) {
+			t.Errorf("%s with %q check reported dead", bc.URL, bc.HealthMode)
+		}
+	}
+
+	addTestBackends(t, l, "http://127.0.0.1")
+	if rec := get(l, "/"); rec.Body.String() != "port-80" {
+		t.Fatalf("proxied %d %q, want the backend on port 80", rec.Code, rec.Body)
+	}
+}
+
+func TestHealthCheckerSelection(t *testing.T) {
+	for _, tc := range []struct {
+		bc      BackendConfig
+		lbWide  string
+		checker HealthChecker
+	}{
+		{BackendConfig{URL: "http://a"}, "", &HTTPChecker{}},
+		{BackendConfig{URL: "http://a", HealthMode: healthModeTCP}, "", &TCPChecker{}},
+		{BackendConfig{URL: "http://a", HealthMode: healthModeGRPC}, "", &GRPCChecker{}},
+		{BackendConfig{URL: "http://a"}, healthModeTCP, &TCPChecker{}},
+		{BackendConfig{URL: "http://a", HealthMode: healthModeHTTP}, healthModeTCP, &HTTPChecker{}},
+	} {
+		b := newTestBackEnd(t, tc.bc, backendOptions{healthMode: tc.lbWide})
+		if got, want := fmt.Sprintf("%T", b.checker), fmt.Sprintf("%T", tc.checker); got != want {
+			t.Errorf("health_mode %q with -health-mode %q: checker %s, want %s", tc.bc.HealthMode, tc.lbWide, got, want)
+		}
+	}
+
+	b := newTestBackEnd(t, BackendConfig{URL: "http://a", HealthPath: "/ready"}, backendOptions{})
+	if c := b.checker.(*HTTPChecker); c.Path != "/ready" || c.Method != http.MethodGet {
+		t.Errorf("HTTP checker = %+v, want path /ready and method GET", c)
+	}
+	b = newTestBackEnd(t, BackendConfig{URL: "http://a", HealthMode: healthModeGRPC, HealthService: "svc"}, backendOptions{})
+	if c := b.checker.(*GRPCChecker); c.Service != "svc" {
+		t.Errorf("gRPC checker service = %q, want svc", c.Service)
+	}
+}
+
+// checkerFunc adapts a function to HealthChecker.
+type checkerFunc func(ctx context.Context, b *BackEnd) bool
+
+func (f checkerFunc) Check(ctx context.Context, b *BackEnd) bool {
+	return f(ctx, b)
+}
+
+func TestHealthCheckUsesEachBackendsChecker(t *testing.T) {
+	l := newTestLB(t, "http://up", "http://down")
+	up, down := l.snapshot()[0], l.snapshot()[1]
+	var probed atomic.Int64
+	up.checker = checkerFunc(func(context.Context, *BackEnd) bool { probed.Add(1); return true })
+	down.checker = checkerFunc(func(context.Context, *BackEnd) bool { probed.Add(1); return false })
+
+	l.healthCheck(context.Background(), &l.pool, false)
+	if probed.Load() != 2 || !up.isAlive() || down.isAlive() {
+		t.Fatalf("probed %d, up alive %v, down alive %v, want each backend judged by its own checker", probed.Load(), up.isAlive(), down.isAlive())
+	}
+}
+
+func TestWaitForBackends(t *testing.T) {
+	var healthy atomic.Bool
+	srv := newTestServer(t, toggleHandler(&healthy))
+	l := newTestLB(t, srv.URL)
+	b := l.snapshot()[0]
+	b.setAlive(false)
+	logs := captureLogs(t)
+
+	//The backend comes up while the LB is already waiting for it
+	time.AfterFunc(300*time.Millisecond, func() { healthy.Store(true) })
+	start := time.Now()
+	l.waitForBackends(context.Background(), 10*time.Second)
+	if d := time.Since(start); d < 300*time.Millisecond || d > 5*time.Second {
+		t.Fatalf("waited %v for a backend coming up after 300ms", d)
+	}
+	if !b.isAlive() {
+		t.Fatal("returned before the backend passed its health check")
+	}
+	if len(logs.events(t, "startup")) == 0 {
+		t.Error("no progress logged while waiting")
+	}
+
+	//With nothing coming up the timeout ends the wait
+	healthy.Store(false)
+	b.setAlive(false)
+	start = time.Now()
+	l.waitForBackends(context.Background(), 100*time.Millisecond)
+	if d := time.Since(start); d > time.Second {
+		t.Fatalf("waited %v with a 100ms timeout", d)
+	}
+}
+
+// goroutinesIn counts the running goroutines whose stack mentions fn.
+func goroutinesIn(fn string) int {
+	buf := make([]byte, 1<<20)
+	buf = buf[:runtime.Stack(buf, true)]
+	return strings.Count(string(buf), fn+"(")
+}
+
+func TestPeriodicHealthCheckStopsOnShutdown(t *testing.T) {
+	srv := newTestServer(t, nameHandler("ok"))
+	l := newTestLB(t, srv.URL)
+	l.healthOpts.interval = 10 * time.Millisecond
+	before := goroutinesIn(".(*LoadBalancer).PeriodicHealthCheck")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	var checkers sync.WaitGroup
+	for range 3 {
+		checkers.Add(1)
+		go func() {
+			defer checkers.Done()
+			l.PeriodicHealthCheck(ctx, &l.pool)
+		}()
+	}
+	time.Sleep(50 * time.Millisecond)
+	if n := goroutinesIn(".(*LoadBalancer).PeriodicHealthCheck") - before; n != 3 {
+		t.Fatalf("%d health checkers running, want 3", n)
+	}
+
+	cancel()
+	checkers.Wait()
+	//A goroutine that returned may linger in the dump for a moment
+	deadline := time.Now().Add(time.Second)
+	for goroutinesIn(".(*LoadBalancer).PeriodicHealthCheck") > before {
+		if time.Now().After(deadline) {
+			t.Fatal("health check goroutine still running after shutdown")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestHealthJitterSpreadsProbes(t *testing.T) {
+	var mux sync.Mutex
+	var probes []time.Time
+	srv := newTestServer(t, func(w http.ResponseWriter, r *http.Request) {
+		mux.Lock()
+		probes = append(probes, time.Now())
+		mux.Unlock()
+	})
+	sweep := func(jitter float64) time.Duration {
+		l := newTestLB(t)
+		l.healthOpts.interval = 400 * time.Millisecond
+		l.healthOpts.timeout = 40 * time.Millisecond
+		l.healthOpts.jitter = jitter
+		l.healthOpts.concurrency = 16
+		for range 16 {
+			//A distinct path per backend keeps the URLs unique
+			addTestBackends(t, l, srv.URL+"/"+strconv.Itoa(len(l.snapshot())))
+		}
+		mux.Lock()
+		probes = nil
+		mux.Unlock()
+		l.healthCheck(context.Background(), &l.pool, true)
+		mux.Lock()
+		defer mux.Unlock()
+		if len(probes) != 16 {
+			t.Fatalf("%d probes, want 16", len(probes))
+		}
+		return slices.MaxFunc(probes, time.Time.Compare).Sub(slices.MinFunc(probes, time.Time.Compare))
+	}
+
+	if spread := sweep(0); spread > 100*time.Millisecond {
+		t.Errorf("probes without jitter spread over %v, want them together", spread)
+	}
+	//16 delays drawn from [0, 360ms) almost surely span over 150ms
+	if spread := sweep(0.9); spread < 150*time.Millisecond {
+		t.Errorf("probes with jitter 0.9 spread over only %v of a 400ms interval", spread)
+	}
+}
+
+func TestJitterDelayBounds(t *testing.T) {
+	opts := healthOptions{interval: time.Second, jitter: 0.5}
+	var low, high int
+	for range 1000 {
+		d := opts.jitterDelay()
+		if d < 0 || d >= 500*time.Millisecond {
+			t.Fatalf("jitterDelay() = %v, want it within [0, 500ms)", d)
+		}
+		if d < 250*time.Millisecond {
+			low++
+		} else {
+			high++
+		}
+	}
+	if low < 400 || high < 400 {
+		t.Fatalf("%d delays in the first half, %d in the second, want them spread evenly", low, high)
+	}
+	if d := (healthOptions{interval: time.Second}).jitterDelay(); d != 0 {
+		t.Fatalf("jitterDelay() = %v with jitter off", d)
+	}
+
+	//A probe delayed by the jitter must still time out within the interval
+	opts = healthOptions{interval: time.Second, timeout: 800 * time.Millisecond, jitter: 0.5}
+	for range 1000 {
+		if d := opts.jitterDelay(); d+opts.timeout >= opts.interval {
+			t.Fatalf("jitterDelay() = %v, a %v probe after it overruns the %v interval", d, opts.timeout, opts.interval)
+		}
+	}
+}
+
+func TestHTTPCheckerReusesConnections(t *testing.T) {
+	var conns atomic.Int64
+	//Too large for the client to keep the connection with the body unread
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, strings.Repeat("ok\n", 100000))
+	}))
+	srv.Config.ConnState = func(c net.Conn, s http.ConnState) {
+		if s == http.StateNew {
+			conns.Add(1)
+		}
+	}
+	srv.Start()
+	defer srv.Close()
+
+	b := newTestBackEnd(t, BackendConfig{URL: srv.URL}, backendOptions{})
+	for range 5 {
+		if !b.isBackendAlive(context.Background(), time.Second) {
+			t.Fatal("health check failed")
+		}
+	}
+	if n := conns.Load(); n != 1 {
+		t.Fatalf("5 health checks opened %d connections, want the first one reused", n)
+	}
+}
+
+func TestHealthOptionsValidate(t *testing.T) {
+	for _, tc := range []struct {
+		name              string
+		interval, timeout time.Duration
+		ok                bool
+	}{
+		{"timeout within interval", 10 * time.Second, time.Second, true},
+		{"timeout equals interval", time.Second, time.Second, false},
+		{"timeout over interval", time.Second, 2 * time.Second, false},
+		{"zero timeout", time.Second, 0, false},
+		{"zero interval", 0, time.Second, false},
+		{"negative interval", -time.Second, time.Second, false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			err := healthOptions{interval: tc.interval, timeout: tc.timeout}.validate()
+			if (err == nil) != tc.ok {
+				t.Fatalf("validate() = %v, want ok %v", err, tc.ok)
+			}
+		})
+	}
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"fmt"
+	"io/fs"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+)
+
+const unixPrefix = "unix:"
+
+// parseListenAddr checks that addr is host:port with an IP or hostname
+// and a valid port, or unix:<path>, and returns the port (0 for unix
+// sockets).
+func parseListenAddr(addr string) (int, error) {
+	if path, ok := strings.CutPrefix(addr, unixPrefix); ok {
+		if path == "" {
+			return 0, fmt.Errorf("missing socket path in %q", addr)
+		}
+		return 0, nil
+	}
+
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return 0, err
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil || port < 1 || port > 65535 {
+		return 0, fmt.Errorf("invalid port %q in %q", portStr, addr)
+	}
+	if host != "" && net.ParseIP(host) == nil && strings.ContainsAny(host, " /:") {
+		return 0, fmt.Errorf("invalid host %q in %q", host, addr)
+	}
+	return port, nil
+}
+
+// listenOn opens a TCP listener for addr, or a Unix socket for
+// unix:<path>. A stale socket file left by a previous run is removed
+// first; the listener removes the file again when it is closed.
+func listenOn(addr string) (net.Listener, error) {
+	path, ok := strings.CutPrefix(addr, unixPrefix)
+	if !ok {
+		return net.Listen("tcp", addr)
+	}
+
+	if fi, err := os.Lstat(path); err == nil {
+		if fi.Mode().Type() != fs.ModeSocket {
+			return nil, fmt.Errorf("%s exists and is not a socket", path)
+		}
+		if err := os.Remove(path); err != nil {
+			return nil, err
+		}
+	}
+	return net.Listen("unix", path)
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+)
+
+func TestParseListenAddr(t *testing.T) {
+	for _, tc := range []struct {
+		addr string
+		port int
+		ok   bool
+	}{
+		{"127.0.0.1:8080", 8080, true},
+		{":80", 80, true},
+		{"[::1]:9000", 9000, true},
+		{"lb.internal:443", 443, true},
+		{"unix:/run/lb.sock", 0, true},
+		{"unix:", 0, false},
+		{"127.0.0.1", 0, false},
+		{"127.0.0.1:0", 0, false},
+		{"127.0.0.1:70000", 0, false},
+		{"127.0.0.1:http", 0, false},
+		{"bad host:80", 0, false},
+	} {
+		port, err := parseListenAddr(tc.addr)
+		if (err == nil) != tc.ok || port != tc.port {
+			t.Errorf("parseListenAddr(%q) = %d, %v, want port %d and success %v", tc.addr, port, err, tc.port, tc.ok)
+		}
+	}
+}
+
+func TestListenOnLoopbackOnly(t *testing.T) {
+	ln, err := listenOn("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	addr := ln.Addr().(*net.TCPAddr)
+	if !addr.IP.IsLoopback() {
+		t.Fatalf("listening on %s, want a loopback address", addr)
+	}
+	go func() {
+		if conn, err := ln.Accept(); err == nil {
+			conn.Close()
+		}
+	}()
+	conn, err := net.Dial("tcp", addr.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+
+	//Another interface of this host must not reach it
+	ips, _ := net.InterfaceAddrs()
+	for _, a := range ips {
+		ipNet, ok := a.(*net.IPNet)
+		if !ok || ipNet.IP.IsLoopback() || ipNet.IP.To4() == nil {
+			continue
+		}
+		conn, err := net.Dial("tcp", net.JoinHostPort(ipNet.IP.String(), strconv.Itoa(addr.Port)))
+		if err == nil {
+			conn.Close()
+			t.Fatalf("reached the loopback listener through %s", ipNet.IP)
+		}
+	}
+}
+
+func TestListenOnUnixSocket(t *testing.T) {
+	srv := newTestServer(t, nameHandler("via-socket"))
+	l := newTestLB(t, srv.URL)
+
+	path := filepath.Join(t.TempDir(), "lb.sock")
+	//A socket file left by a crashed run must not block startup
+	stale, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stale.(*net.UnixListener).SetUnlinkOnClose(false)
+	stale.Close()
+
+	ln, err := listenOn(unixPrefix + path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go http.Serve(ln, l)
+
+	client := &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, "unix", path)
+		},
+	}}
+	resp, err := client.Get("http://lb/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if string(body) != "via-socket" {
+		t.Fatalf("body = %q, want the proxied response", body)
+	}
+
+	client.CloseIdleConnections()
+	ln.Close()
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Fatalf("socket file still present after close: %v", err)
+	}
+}
+
+func TestListenOnRefusesNonSocket(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "lb.sock")
+	if err := os.WriteFile(path, nil, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if ln, err := listenOn(unixPrefix + path); err == nil {
+		ln.Close()
+		t.Fatal("listenOn replaced a regular file")
+	}
+}
@@ -0,0 +1,26 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"os"
+)
+
+// setupLogging installs the default slog logger. Output from the
+// standard log package is routed through it as well.
+func setupLogging(format string) error {
+	var handler slog.Handler
+	switch format {
+	case "text":
+		handler = slog.NewTextHandler(os.Stderr, nil)
+	case "json":
+		handler = slog.NewJSONHandler(os.Stderr, nil)
+	default:
+		return fmt.Errorf("unknown log format %q, want text or json", format)
+	}
+
+	slog.SetDefault(slog.New(handler))
+	//log.Fatal is only used for startup errors
+	slog.SetLogLoggerLevel(slog.LevelError)
+	return nil
+}
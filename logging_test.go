@@ -0,0 +1,91 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"log/slog"
+	"sync"
+	"testing"
+)
+
+// logCapture collects the records logged through slog during a test.
+type logCapture struct {
+	mux sync.Mutex
+	buf bytes.Buffer
+}
+
+func (c *logCapture) Write(p []byte) (int, error) {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	return c.buf.Write(p)
+}
+
+// events returns the logged records whose event attribute is event.
+func (c *logCapture) events(t *testing.T, event string) []map[string]any {
+	t.Helper()
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	var records []map[string]any
+	for _, line := range bytes.Split(bytes.TrimSpace(c.buf.Bytes()), []byte("\n")) {
+		if len(line) == 0 {
+			continue
+		}
+		var rec map[string]any
+		if err := json.Unmarshal(line, &rec); err != nil {
+			t.Fatalf("decoding log line %s: %v", line, err)
+		}
+		if rec["event"] == event {
+			records = append(records, rec)
+		}
+	}
+	return records
+}
+
+// captureLogs sends slog output to the returned capture for the rest of
+// the test.
+func captureLogs(t *testing.T) *logCapture {
+	t.Helper()
+	c := &logCapture{}
+	prev := slog.Default()
+	slog.SetDefault(slog.New(slog.NewJSONHandler(c, &slog.HandlerOptions{Level: slog.LevelDebug})))
+	t.Cleanup(func() { slog.SetDefault(prev) })
+	return c
+}
+
+func TestSetupLogging(t *testing.T) {
+	defer slog.SetDefault(slog.Default())
+
+	for _, format := range []string{"text", "json"} {
+		if err := setupLogging(format); err != nil {
+			t.Errorf("setupLogging(%q): %v", format, err)
+		}
+	}
+	if err := setupLogging("xml"); err == nil {
+		t.Error("setupLogging accepted an unknown format")
+	}
+}
+
+func TestAccessLog(t *testing.T) {
+	srv := newTestServer(t, nameHandler("ok"))
+	l := newTestLB(t, srv.URL)
+	logs := captureLogs(t)
+
+	get(l, "/quiet")
+	if n := len(logs.events(t, "access")); n != 0 {
+		t.Fatalf("%d access log entries with -access-log off", n)
+	}
+
+	l.accessLog = true
+	get(l, "/x?y=z")
+	entries := logs.events(t, "access")
+	if len(entries) != 1 {
+		t.Fatalf("got %d access log entries, want 1", len(entries))
+	}
+	e := entries[0]
+	if e["method"] != "GET" || e["path"] != "/x" || e["client_ip"] != "192.0.2.1" || e["backend"] != srv.URL || e["status"] != float64(200) {
+		t.Errorf("entry = %v", e)
+	}
+	if _, ok := e["latency"]; !ok {
+		t.Error("entry has no latency")
+	}
+}
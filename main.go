@@ -1,147 +1,1244 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"flag"
 	"fmt"
 	"log"
-	"net"
+	"log/slog"
+	"maps"
 	"net/http"
 	"net/http/httputil"
 	"net/url"
+	"os"
+	"os/signal"
+	"slices"
+	"strings"
 	"sync"
 	"sync/atomic"
+	"syscall"
 	"time"
+
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"go.opentelemetry.io/otel/trace"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
 )
 
 func main() {
-	port := flag.Int("port", 8080, "Port to serve on")
+	port := flag.Int("port", 8080, "Port to serve on, on all interfaces")
+	mode := flag.String("mode", modeHTTP, "Proxy mode: http, or tcp to balance raw TCP connections (use -metrics-addr for metrics)")
+	listen := flag.String("listen", "", "Address to serve on as host:port, e.g. 127.0.0.1:8080, or unix:/path/to.sock; overrides -port")
+	configPath := flag.String("config", "", "Path to a YAML config file listing backends")
+	backendList := flag.String("backends", "", "Comma-separated backend URLs; replaces the backends from LB_BACKENDS and -config, other -config settings still apply")
+	metricsAddr := flag.String("metrics-addr", "", "Separate address to serve /metrics on (default: same port as the load balancer)")
+	adminAddr := flag.String("admin-addr", "127.0.0.1:9090", "Address to serve the /admin API on, keep it off public interfaces (empty disables the admin API)")
+	adminToken := flag.String("admin-token", "", "Bearer token required on every admin request (default: none, rely on -admin-addr being private)")
+	healthInterval := flag.Duration("health-interval", time.Minute, "Interval between backend health checks")
+	healthTimeout := flag.Duration("health-timeout", 5*time.Second, "Timeout for a single backend health check")
+	healthFall := flag.Int("health-fall", 3, "Consecutive failed health checks before a backend is marked dead")
+	healthRise := flag.Int("health-rise", 2, "Consecutive successful health checks before a backend is marked alive")
+	healthWebhook := flag.String("health-webhook", "", "URL that receives a JSON POST on every backend health transition")
+	healthBackoffMax := flag.Duration("health-backoff-max", 10*time.Minute, "Longest delay between health checks of a dead backend, doubling from -health-interval (-health-interval or less disables backoff)")
+	flapThreshold := flag.Int("flap-threshold", 0, "Health check result changes within -flap-window that mark a backend as flapping (0 disables)")
+	flapWindow := flag.Duration("flap-window", 10*time.Minute, "Window in which health check result changes are counted for flap detection")
+	flapExclude := flag.Bool("flap-exclude", false, "Take flapping backends out of rotation until they settle")
+	waitBackends := flag.Duration("wait-for-backends", 0, "How long to hold off serving at startup until a backend passes its health check (0 serves right away)")
+	healthMode := flag.String("health-mode", "", "Health check for backends without a health_mode setting: http, tcp or grpc (default http, tcp with -mode tcp)")
+	healthJitter := flag.Float64("health-jitter", 0, "Delay each periodic health check by a random fraction of -health-interval up to this, in [0, 1), to spread probes out (0 probes all backends at once)")
+	healthConcurrency := flag.Int("health-concurrency", 16, "Maximum number of backends health-checked in parallel")
+	hashKeyFlag := flag.String("hash-key", "", "What ip-hash and consistent-hash hash on: ip, path, header:<Name> or query:<name>, falling back to the client IP when missing (overrides consistent_hash.key in -config)")
+	strategyName := flag.String("strategy", "round-robin", "Backend selection strategy: "+strings.Join(slices.Sorted(maps.Keys(strategies)), ", "))
+	maxRetries := flag.Int("max-retries", 2, "Maximum number of other backends to retry on after a proxy failure")
+	retryBackoff := flag.Duration("retry-backoff", 0, "Wait before the first retry, doubled for each further one (0 retries right away)")
+	retryIdempotencyKey := flag.Bool("retry-idempotency-key", false, "Also retry POST and PATCH requests that carry an Idempotency-Key header")
+	breakerErrors := flag.Int("breaker-errors", 5, "Errors within -breaker-window that open a backend's circuit breaker (0 disables)")
+	breakerWindow := flag.Duration("breaker-window", 10*time.Second, "Window in which circuit breaker errors are counted")
+	breakerCooldown := flag.Duration("breaker-cooldown", 30*time.Second, "How long an open circuit breaker withholds traffic before a trial request")
+	passiveErrors := flag.Int("passive-errors", 3, "Proxy errors within -passive-window that mark a backend dead without waiting for a health check (0 disables)")
+	passiveWindow := flag.Duration("passive-window", 10*time.Second, "Window in which passive health check errors are counted")
+	maxBody := flag.Int64("max-body", 10<<20, "Largest request body in bytes, larger ones get 413 (0 means unlimited)")
+	maxResponseBody := flag.Int64("max-response-body", 0, "Largest upstream response body in bytes, larger ones get 502 or are cut off (0 means unlimited)")
+	maxConns := flag.Int("max-conns", 0, "Default limit of in-flight requests per backend (0 means unlimited)")
+	queueTimeout := flag.Duration("queue-timeout", 0, "How long a request waits for a free backend when all are at their limit (0 answers 503 right away)")
+	maxIdleConns := flag.Int("max-idle-conns", 256, "Idle upstream connections kept across all backends (0 means unlimited)")
+	disableKeepAlive := flag.Bool("disable-backend-keepalive", false, "Open a new upstream connection for every request instead of reusing idle ones; a backend's disable_keepalive setting does the same for one backend")
+	maxIdleConnsPerHost := flag.Int("max-idle-conns-per-host", 64, "Idle upstream connections kept per backend")
+	idleConnTimeout := flag.Duration("idle-conn-timeout", 90*time.Second, "How long an idle upstream connection is kept")
+	dialTimeout := flag.Duration("dial-timeout", 5*time.Second, "Timeout for connecting to a backend")
+	hostHeader := flag.String("host-header", hostHeaderPreserve, "Host header sent to backends: preserve (the client's) or backend (the backend URL's host)")
+	adaptiveLatency := flag.Duration("adaptive-weight-latency", 0, "Health check latency at which backends get their configured weight in weighted strategies; slower ones get proportionally less (0 disables)")
+	adaptiveMin := flag.Float64("adaptive-weight-min", 0.1, "Smallest fraction of its weight -adaptive-weight-latency leaves a slow backend")
+	adaptiveMax := flag.Float64("adaptive-weight-max", 1, "Largest fraction of its weight -adaptive-weight-latency gives a fast backend")
+	slowStart := flag.Duration("slow-start", 0, "Window over which a recovered backend ramps up to its full weight in weighted strategies (0 disables)")
+	outlier5xx := flag.Int("outlier-5xx", 0, "Consecutive 5xx responses that eject a backend as an outlier (0 disables)")
+	outlierEjection := flag.Duration("outlier-base-ejection", 30*time.Second, "Ejection time for a first-time outlier, multiplied for repeat offenses")
+	outlierMaxPercent := flag.Int("outlier-max-percent", 10, "Largest percentage of backends ejected as outliers at once")
+	trustForwarded := flag.Bool("trust-forwarded", false, "Keep inbound X-Forwarded-For/X-Real-IP/X-Forwarded-Proto headers from -trusted-proxies peers and take the client IP from them")
+	readHeaderTimeout := flag.Duration("read-header-timeout", 10*time.Second, "How long a client may take to send request headers")
+	readTimeout := flag.Duration("read-timeout", 0, "How long a client may take to send a whole request including the body; also limits WebSocket reads (0 disables)")
+	writeTimeout := flag.Duration("write-timeout", 0, "How long writing a response may take; also limits streaming and WebSocket responses (0 disables)")
+	idleTimeout := flag.Duration("idle-timeout", 2*time.Minute, "How long an idle client keep-alive connection is kept open")
+	maxHeaderBytes := flag.Int("max-header-bytes", 64<<10, "Largest request header block in bytes")
+	shutdownGrace := flag.Duration("shutdown-grace", 30*time.Second, "How long to wait for in-flight requests to finish on shutdown")
+	h2cFlag := flag.Bool("h2c", false, "Accept cleartext HTTP/2 from clients and speak it to http:// backends, as needed for proxying gRPC without TLS; those backends share multiplexed connections that -max-idle-conns, -max-idle-conns-per-host and keep-alive settings don't apply to, so -disable-backend-keepalive and disable_keepalive are rejected")
+	tlsCert := flag.String("tls-cert", "", "TLS certificate file; serves HTTPS when set together with -tls-key, reloaded together with the key on SIGHUP")
+	tlsKey := flag.String("tls-key", "", "TLS private key file")
+	redirectHTTP := flag.Int("redirect-http", 0, "Port of a plain HTTP listener that redirects to HTTPS, requires -tls-cert (0 disables)")
+	requestTimeout := flag.Duration("request-timeout", 0, "Deadline for each attempt at a backend, answered with 504 when exceeded; a backend's timeout setting overrides it (0 disables)")
+	proxyProtocol := flag.Bool("proxy-protocol", false, "Expect a PROXY protocol v1 or v2 header on every inbound connection and take the client address from it; only enable behind a balancer that sends one")
+	trustedProxiesFlag := flag.String("trusted-proxies", "", "Comma-separated CIDR ranges or IPs of proxies whose forwarding headers -trust-forwarded believes")
+	maxInFlight := flag.Int("max-in-flight", 0, "Limit of requests in flight across all backends, over it clients get 503 (0 means unlimited)")
+	maxInFlightWait := flag.Duration("max-in-flight-wait", 0, "How long a request over -max-in-flight waits for a slot before the 503 (0 refuses right away)")
+	cacheSize := flag.Int("cache-size", 0, "Number of GET responses kept in memory for as long as their Cache-Control max-age allows (0 disables caching)")
+	rateLimit := flag.Float64("rate-limit", 0, "Requests per second allowed per client IP (0 disables)")
+	rateBurst := flag.Int("rate-burst", 20, "Requests a client IP may burst above -rate-limit")
+	stickyCookie := flag.String("sticky-cookie", "", "Cookie name used to pin clients to a backend (empty disables sticky sessions)")
+	compress := flag.Bool("compress", false, "Gzip text responses for clients that accept it")
+	compressMinSize := flag.Int("compress-min-size", 1024, "Smallest response body in bytes that -compress applies to")
+	debugHeaders := flag.Bool("debug-headers", false, "Log the headers of every upstream request and response, with credentials redacted (noisy, for debugging)")
+	servedBy := flag.String("served-by-header", "", "Response header naming the backend that served the request, e.g. X-Served-By (empty disables, exposes backend URLs to clients)")
+	accessLog := flag.Bool("access-log", true, "Log every proxied request")
+	logFormat := flag.String("log-format", "text", "Log output format: text or json")
+	otlpEndpoint := flag.String("otlp-endpoint", "", "OTLP/HTTP collector URL to export request traces to, e.g. http://localhost:4318 (empty disables tracing)")
+	validate := flag.Bool("validate", false, "Check the flags and config, print a summary and exit without serving")
+	showVersion := flag.Bool("version", false, "Print the version and build details and exit")
 	flag.Parse()
 
-	servers := []string{
-		"http://localhost:8081",
-		"http://localhost:8082",
-		"http://localhost:8083",
-		"http://localhost:8084",
-		"http://localhost:8085",
-		"http://localhost:8086",
-		"http://localhost:8087",
-		"http://localhost:8088",
-		"http://localhost:8089",
+	if *showVersion {
+		printVersion(os.Stdout)
+		return
+	}
+
+	if err := setupLogging(*logFormat); err != nil {
+		log.Fatal(err)
+	}
+
+	addr := fmt.Sprintf(":%d", *port)
+	if *listen != "" {
+		p, err := parseListenAddr(*listen)
+		if err != nil {
+			log.Fatalf("-listen: %v", err)
+		}
+		addr, *port = *listen, p
+	}
+
+	if *mode != modeHTTP && *mode != modeTCP {
+		log.Fatalf("-mode must be %s or %s, got %q", modeHTTP, modeTCP, *mode)
+	}
+	if strings.ContainsAny(*servedBy, " \t:\r\n") {
+		log.Fatalf("-served-by-header: invalid header name %q", *servedBy)
+	}
+	if *mode == modeTCP && (*tlsCert != "" || *redirectHTTP != 0) {
+		log.Fatal("-tls-cert and -redirect-http are not supported with -mode tcp")
+	}
+
+	switch {
+	case *healthMode == "" && *mode == modeTCP:
+		*healthMode = healthModeTCP
+	case *healthMode != "" && *healthMode != healthModeHTTP && *healthMode != healthModeTCP && *healthMode != healthModeGRPC:
+		log.Fatalf("-health-mode must be %s, %s or %s, got %q", healthModeHTTP, healthModeTCP, healthModeGRPC, *healthMode)
+	}
+
+	if (*tlsCert == "") != (*tlsKey == "") {
+		log.Fatal("-tls-cert and -tls-key must be set together")
+	}
+	if *redirectHTTP != 0 && *tlsCert == "" {
+		log.Fatal("-redirect-http requires -tls-cert and -tls-key")
+	}
+	if *redirectHTTP != 0 && *port == 0 {
+		log.Fatal("-redirect-http needs a TCP -listen address")
+	}
+	if *otlpEndpoint != "" {
+		if u, err := url.Parse(*otlpEndpoint); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			log.Fatalf("-otlp-endpoint must be an http or https URL, got %q", *otlpEndpoint)
+		}
+	}
+	if *readHeaderTimeout <= 0 || *readTimeout < 0 || *writeTimeout < 0 || *idleTimeout < 0 || *maxHeaderBytes < 1 {
+		log.Fatal("-read-header-timeout and -max-header-bytes must be positive and -read-timeout, -write-timeout and -idle-timeout must not be negative")
+	}
+	if *flapThreshold < 0 || *flapWindow <= 0 {
+		log.Fatal("-flap-threshold must not be negative and -flap-window must be positive")
+	}
+	if *healthJitter < 0 || *healthJitter >= 1 {
+		log.Fatalf("-health-jitter must be in [0, 1), got %g", *healthJitter)
+	}
+	if *healthBackoffMax < 0 {
+		log.Fatal("-health-backoff-max must not be negative")
+	}
+	if *compressMinSize < 1 {
+		log.Fatal("-compress-min-size must be at least 1")
+	}
+	if *rateLimit < 0 || *rateBurst < 1 {
+		log.Fatal("-rate-limit must not be negative and -rate-burst must be at least 1")
+	}
+	if *requestTimeout < 0 {
+		log.Fatal("-request-timeout must not be negative")
+	}
+	if err := validHashKey(*hashKeyFlag); err != nil {
+		log.Fatalf("-hash-key: %v", err)
+	}
+	if *maxRetries < 0 || *retryBackoff < 0 {
+		log.Fatal("-max-retries and -retry-backoff must not be negative")
+	}
+	if *breakerErrors < 0 || *breakerWindow <= 0 || *breakerCooldown <= 0 {
+		log.Fatal("-breaker-errors must not be negative and -breaker-window/-breaker-cooldown must be positive")
+	}
+	if *passiveErrors < 0 || *passiveWindow <= 0 {
+		log.Fatal("-passive-errors must not be negative and -passive-window must be positive")
+	}
+	if *hostHeader != hostHeaderPreserve && *hostHeader != hostHeaderBackend {
+		log.Fatalf("-host-header must be %s or %s, got %q", hostHeaderPreserve, hostHeaderBackend, *hostHeader)
+	}
+	if *h2cFlag && *disableKeepAlive {
+		log.Fatal("-disable-backend-keepalive is not supported with -h2c")
+	}
+	if *maxIdleConns < 0 || *maxIdleConnsPerHost < 0 || *idleConnTimeout < 0 || *dialTimeout <= 0 {
+		log.Fatal("-max-idle-conns, -max-idle-conns-per-host and -idle-conn-timeout must not be negative and -dial-timeout must be positive")
+	}
+	if *maxConns < 0 || *queueTimeout < 0 || *maxBody < 0 || *maxResponseBody < 0 {
+		log.Fatal("-max-conns, -queue-timeout, -max-body and -max-response-body must not be negative")
+	}
+	proxies, err := parseTrustedProxies(*trustedProxiesFlag)
+	if err != nil {
+		log.Fatalf("-trusted-proxies: %v", err)
+	}
+	if *trustForwarded != (len(proxies) > 0) {
+		log.Fatal("-trust-forwarded and -trusted-proxies must be set together")
+	}
+	if *maxInFlight < 0 || *maxInFlightWait < 0 || *cacheSize < 0 || *waitBackends < 0 {
+		log.Fatal("-max-in-flight, -max-in-flight-wait, -cache-size and -wait-for-backends must not be negative")
+	}
+	if *outlier5xx < 0 || *outlierEjection <= 0 || *outlierMaxPercent < 0 || *outlierMaxPercent > 100 {
+		log.Fatal("-outlier-5xx must not be negative, -outlier-base-ejection must be positive and -outlier-max-percent within 0-100")
+	}
+	if *slowStart < 0 {
+		log.Fatal("-slow-start must not be negative")
+	}
+	if *adaptiveLatency < 0 || *adaptiveMin <= 0 || *adaptiveMax < *adaptiveMin {
+		log.Fatal("-adaptive-weight-latency must not be negative, -adaptive-weight-min must be positive and at most -adaptive-weight-max")
+	}
+	if *healthFall < 1 || *healthRise < 1 || *healthConcurrency < 1 {
+		log.Fatal("-health-fall, -health-rise and -health-concurrency must be at least 1")
 	}
 
-	lb := &LoadBalancer{}
+	healthOpts := healthOptions{
+		interval:    *healthInterval,
+		timeout:     *healthTimeout,
+		fall:        *healthFall,
+		rise:        *healthRise,
+		concurrency: *healthConcurrency,
+		backoffMax:  *healthBackoffMax,
+		jitter:      *healthJitter,
+		flap: flapOptions{
+			threshold: *flapThreshold,
+			window:    *flapWindow,
+			exclude:   *flapExclude,
+		},
+	}
+	if err := healthOpts.validate(); err != nil {
+		log.Fatalf("-health-interval/-health-timeout: %v", err)
+	}
 
-	for _, surl := range servers {
-		url, err := url.Parse(surl)
+	//Backends come from -backends, then LB_BACKENDS (with LB_WEIGHTS),
+	//then -config, then the built-in defaults
+	cfg := defaultConfig()
+	if *configPath != "" {
+		c, err := loadConfig(*configPath)
 		if err != nil {
 			log.Fatal(err)
 		}
+		cfg = c
+	}
+	backendSource := ""
+	switch envBackends, err := backendsFromEnv(); {
+	case *backendList != "":
+		backends, err := parseBackendList("-backends", *backendList)
+		if err != nil {
+			log.Fatal(err)
+		}
+		cfg.Backends = backends
+		backendSource = "-backends"
+	case err != nil:
+		log.Fatal(err)
+	case envBackends != nil:
+		cfg.Backends = envBackends
+		backendSource = "LB_BACKENDS"
+	}
+
+	backendOpts := backendOptions{
+		breaker: breakerOptions{
+			threshold: *breakerErrors,
+			window:    *breakerWindow,
+			cooldown:  *breakerCooldown,
+		},
+		passive: passiveOptions{
+			threshold: *passiveErrors,
+			window:    *passiveWindow,
+		},
+		outlier: outlierOptions{
+			threshold:    *outlier5xx,
+			baseEjection: *outlierEjection,
+			maxPercent:   *outlierMaxPercent,
+		},
+		forwarded: forwardTrust{enabled: *trustForwarded, proxies: proxies},
+		slowStart: *slowStart,
+		adaptive: adaptiveWeightOptions{
+			target: *adaptiveLatency,
+			min:    *adaptiveMin,
+			max:    *adaptiveMax,
+		},
+		hostHeader:      *hostHeader,
+		maxConns:        *maxConns,
+		healthMode:      *healthMode,
+		excludeFlapping: *flapExclude,
+		debugHeaders:    *debugHeaders,
+		maxResponseBody: *maxResponseBody,
+		servedByHeader:  *servedBy,
+		tracing:         *otlpEndpoint != "",
+		requestHeaders:  cfg.Headers.Request.compile(),
+		responseHeaders: cfg.Headers.Response.compile(),
+	}
+
+	page, err := cfg.Unavailable.load()
+	if err != nil {
+		log.Fatalf("unavailable page: %v", err)
+	}
+	backendOpts.unavailable = page
+
+	transport, err := newTransport(cfg.TLS, transportOptions{
+		maxIdleConns:        *maxIdleConns,
+		maxIdleConnsPerHost: *maxIdleConnsPerHost,
+		idleConnTimeout:     *idleConnTimeout,
+		disableKeepAlives:   *disableKeepAlive,
+		dialTimeout:         *dialTimeout,
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+	backendOpts.transport = transport
+	if *h2cFlag {
+		backendOpts.proxyTransport = newH2CTransport(transport)
+	}
+
+	lb := &LoadBalancer{
+		maxRetries:     *maxRetries,
+		retryBackoff:   *retryBackoff,
+		retryIdemKey:   *retryIdempotencyKey,
+		requestTimeout: *requestTimeout,
+		queueTimeout:   *queueTimeout,
+		maxBody:        *maxBody,
+		accessLog:      *accessLog,
+		stickyCookie:   *stickyCookie,
+		backendOpts:    backendOpts,
+		tracing:        backendOpts.tracing,
+	}
+	if *hashKeyFlag != "" {
+		cfg.ConsistentHash.Key = *hashKeyFlag
+	}
+
+	lb.name = defaultPoolName
+	lb.consistentHash = cfg.ConsistentHash
+	lb.strategy, err = newStrategy(*strategyName, cfg.ConsistentHash)
+	if err != nil {
+		log.Fatalf("-strategy: %v", err)
+	}
+	lb.healthOpts = healthOpts
+
+	lb.events.webhook = *healthWebhook
+
+	if *compress {
+		lb.compressMinSize = *compressMinSize
+	}
+
+	if err := lb.buildPools(cfg); err != nil {
+		log.Fatal(err)
+	}
+
+	if *stickyCookie != "" {
+		for _, p := range lb.allPools() {
+			p.strategy = &StickyStrategy{Cookie: *stickyCookie, Next: p.strategy}
+		}
+	}
+
+	if *validate {
+		lb.printConfigSummary(os.Stdout)
+		return
+	}
 
-		proxy := httputil.NewSingleHostReverseProxy(url)
-		proxy.ErrorHandler = func(w http.ResponseWriter, r *http.Request, err error) {
-			log.Printf("Error response from proxy: %v", err)
-			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+	if *otlpEndpoint != "" {
+		shutdownTracing, err := setupTracing(context.Background(), *otlpEndpoint)
+		if err != nil {
+			log.Fatalf("tracing: %v", err)
 		}
+		defer func() {
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			if err := shutdownTracing(ctx); err != nil {
+				slog.Error("Error flushing traces", "event", "shutdown", "error", err)
+			}
+		}()
+	}
 
-		lb.backends = append(lb.backends, &BackEnd{
-			mux:    sync.Mutex{},
-			RProxy: *proxy,
-			url:    url,
-		})
-		log.Printf("Configured server on port %s", url)
+	for _, p := range lb.allPools() {
+		lb.healthCheck(context.Background(), p, false)
 	}
 
-	lb.healthCheck()
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
 
-	go lb.PeriodicHealthCheck(time.Minute)
+	//Health checkers stop with ctx, shutdown waits for their last round
+	var healthCheckers sync.WaitGroup
+	for _, p := range lb.allPools() {
+		healthCheckers.Add(1)
+		go func(p *pool) {
+			defer healthCheckers.Done()
+			lb.PeriodicHealthCheck(ctx, p)
+		}(p)
+	}
+
+	if *waitBackends > 0 {
+		lb.waitForBackends(ctx, *waitBackends)
+	}
+
+	var certs *certStore
+	if *tlsCert != "" {
+		certs, err = newCertStore(*tlsCert, *tlsKey)
+		if err != nil {
+			log.Fatalf("Error loading TLS certificate: %v", err)
+		}
+		go certs.reloadOnSIGHUP(ctx)
+	}
+
+	switch {
+	case *configPath != "" && backendSource != "":
+		slog.Warn("Backends come from "+backendSource+", SIGHUP will not reload them", "event", "startup")
+	case *configPath != "":
+		go lb.reloadOnSIGHUP(ctx, *configPath)
+	}
+
+	if *maxInFlight > 0 {
+		lb.concurrency = newConcurrencyLimiter(*maxInFlight, *maxInFlightWait)
+	}
+	if *cacheSize > 0 {
+		lb.cache = newResponseCache(*cacheSize)
+	}
+
+	if *rateLimit > 0 {
+		lb.limiter = newRateLimiter(*rateLimit, *rateBurst)
+		go lb.limiter.evictLoop(ctx, time.Minute)
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("/", lb)
+	mux.HandleFunc("GET /healthz", lb.handleHealthz)
+	mux.HandleFunc("GET /ready", lb.handleReady)
+
+	if *adminAddr != "" {
+		adminHandler := lb.adminHandler(*adminToken)
+		go func() {
+			slog.Info("Admin server started", "event", "startup", "addr", *adminAddr, "token", *adminToken != "")
+			log.Fatal(http.ListenAndServe(*adminAddr, adminHandler))
+		}()
+	}
+
+	if *metricsAddr != "" {
+		metricsMux := http.NewServeMux()
+		metricsMux.Handle("/metrics", promhttp.Handler())
+		go func() {
+			slog.Info("Metrics server started", "event", "startup", "addr", *metricsAddr)
+			log.Fatal(http.ListenAndServe(*metricsAddr, metricsMux))
+		}()
+	} else {
+		mux.Handle("/metrics", promhttp.Handler())
+	}
+
+	var handler http.Handler = mux
+	if *h2cFlag {
+		handler = h2c.NewHandler(mux, &http2.Server{IdleTimeout: *idleTimeout})
+	}
 
 	server := http.Server{
-		Addr:    fmt.Sprintf(":%d", *port),
-		Handler: lb,
+		Addr:              addr,
+		Handler:           handler,
+		ReadHeaderTimeout: *readHeaderTimeout,
+		ReadTimeout:       *readTimeout,
+		WriteTimeout:      *writeTimeout,
+		IdleTimeout:       *idleTimeout,
+		MaxHeaderBytes:    *maxHeaderBytes,
+		ConnState:         trackConnState,
 	}
 
-	log.Printf("Load balancer started on port :%d\n", *port)
-	err := server.ListenAndServe()
+	ln, err := listenOn(addr)
 	if err != nil {
 		log.Fatal(err)
 	}
+	if *proxyProtocol {
+		ln = &proxyProtoListener{Listener: ln}
+	}
+
+	var srv interface {
+		Shutdown(context.Context) error
+		Close() error
+	} = &server
+	tp := &tcpProxy{lb: lb, dialTimeout: *dialTimeout}
+	if *mode == modeTCP {
+		srv = tp
+	}
+
+	serveErr := make(chan error, 2)
+	go func() {
+		if *mode == modeTCP {
+			slog.Info("Load balancer started", "event", "startup", "addr", addr, "mode", modeTCP)
+			serveErr <- tp.Serve(ln)
+			return
+		}
+		if certs != nil {
+			server.TLSConfig = serverTLSConfig(certs)
+			slog.Info("Load balancer started", "event", "startup", "addr", addr, "tls", true)
+			serveErr <- server.ServeTLS(ln, "", "")
+			return
+		}
+		slog.Info("Load balancer started", "event", "startup", "addr", addr, "tls", false)
+		serveErr <- server.Serve(ln)
+	}()
+
+	var redirectServer *http.Server
+	if *redirectHTTP != 0 {
+		redirectServer = &http.Server{
+			Addr:              fmt.Sprintf(":%d", *redirectHTTP),
+			Handler:           httpsRedirect(*port),
+			ReadHeaderTimeout: *readHeaderTimeout,
+			IdleTimeout:       *idleTimeout,
+			MaxHeaderBytes:    *maxHeaderBytes,
+		}
+		go func() {
+			slog.Info("HTTP redirect listener started", "event", "startup", "port", *redirectHTTP)
+			serveErr <- redirectServer.ListenAndServe()
+		}()
+	}
+
+	select {
+	case err := <-serveErr:
+		log.Fatal(err)
+	case <-ctx.Done():
+	}
+	stop()
+
+	if redirectServer != nil {
+		redirectServer.Close()
+	}
+
+	slog.Info("Shutting down", "event", "shutdown", "in_flight", lb.inFlight())
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), *shutdownGrace)
+	defer cancel()
+
+	drained := make(chan struct{})
+	go lb.logDrain(drained, time.Second)
+	err = srv.Shutdown(shutdownCtx)
+	close(drained)
+	if err != nil {
+		slog.Error("Graceful shutdown incomplete, closing remaining connections", "event", "shutdown", "in_flight", lb.inFlight(), "error", err)
+		srv.Close()
+	}
+
+	healthCheckers.Wait()
+	slog.Info("Load balancer stopped", "event", "shutdown")
+}
+
+// logDrain logs the number of in-flight requests every interval until
+// they are gone or done is closed.
+func (l *LoadBalancer) logDrain(done <-chan struct{}, every time.Duration) {
+	t := time.NewTicker(every)
+	defer t.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-t.C:
+		}
+
+		n := l.inFlight()
+		if n == 0 {
+			return
+		}
+		slog.Info("Waiting for in-flight requests", "event", "shutdown", "in_flight", n)
+	}
 }
 
 type BackEnd struct {
-	url    *url.URL
-	alive  bool
-	mux    sync.Mutex
-	RProxy httputil.ReverseProxy
+	url         *url.URL
+	id          string
+	weight      int
+	stripPrefix string
+	//Upstream connections are not reused
+	keepAliveOff bool
+	tags         map[string]string
+	//Request deadline overriding -request-timeout, 0 uses the global one
+	timeout time.Duration
+	health  healthCheckConfig
+	checker HealthChecker
+	//Read on every request, so kept lock-free
+	alive  atomic.Bool
+	active atomic.Int64
+	//In-flight request limit, 0 means unlimited
+	maxConns int64
+	served   atomic.Uint64
+	draining atomic.Bool
+	//Taken out of rotation by an operator, health checks leave it alone
+	disabled atomic.Bool
+	//Consecutive health check results, guarded by mux
+	checked   bool
+	successes int
+	failures  int
+	lastCheck time.Time
+	//Intervals left to skip while a dead backend backs off, guarded by mux
+	skipChecks int
+	//Recent probe results as a ring indexed by resultCount, guarded by mux
+	results     [healthResultHistory]healthResult
+	resultCount int
+	flapping    atomic.Bool
+	//Skip the backend while flapping is set
+	excludeFlapping bool
+	//Moving average of proxied request latency
+	latency ewma
+	//Recent probe latencies as a ring indexed by checkCount, guarded by mux
+	checkLatencies [healthLatencyHistory]time.Duration
+	checkCount     int
+	//Proxy errors seen in the current passive window, guarded by mux
+	proxyErrors      int
+	proxyErrorsSince time.Time
+	//When the backend last recovered, zero if it never went down
+	healthySince time.Time
+	slowStart    time.Duration
+	adaptive     adaptiveWeightOptions
+	mux          sync.Mutex
+	breaker      *circuitBreaker
+	outlier      *outlierDetector
+	RProxy       httputil.ReverseProxy
+}
+
+const (
+	modeHTTP = "http"
+	modeTCP  = "tcp"
+)
+
+const (
+	hostHeaderPreserve = "preserve"
+	hostHeaderBackend  = "backend"
+)
+
+// backendOptions holds the load balancer wide settings applied to
+// every backend.
+type backendOptions struct {
+	breaker   breakerOptions
+	passive   passiveOptions
+	outlier   outlierOptions
+	forwarded forwardTrust
+	//Host header sent upstream, hostHeaderPreserve or hostHeaderBackend
+	hostHeader string
+	//Default in-flight limit for backends that don't set max_conns
+	maxConns int
+	//Ramp-up window for recovered backends, 0 disables slow start
+	slowStart time.Duration
+	adaptive  adaptiveWeightOptions
+	//Upstream transport, http.DefaultTransport when nil
+	transport *http.Transport
+	//Overrides transport for proxied requests, health checks keep it
+	proxyTransport http.RoundTripper
+	//Header rewrites from the config file, nil when unset
+	requestHeaders  *headerOps
+	responseHeaders *headerOps
+	//Custom 503 page, nil answers plain text
+	unavailable *errorPage
+	//Propagate trace context to backends
+	tracing bool
+	//Health mode of backends without a health_mode, empty means http
+	healthMode string
+	//Take flapping backends out of rotation
+	excludeFlapping bool
+	//Log upstream request and response headers
+	debugHeaders bool
+	//Largest upstream response body, 0 means unlimited
+	maxResponseBody int64
+	//Response header set to the backend URL, empty leaves it out
+	servedByHeader string
+}
+
+func newBackEnd(bc BackendConfig, opts backendOptions) (*BackEnd, error) {
+	url, err := url.Parse(bc.URL)
+	if err != nil {
+		return nil, err
+	}
+
+	proxy := httputil.NewSingleHostReverseProxy(url)
+	if bc.StripPrefix != "" {
+		proxy.Director = stripPrefixDirector(proxy.Director, bc.StripPrefix)
+	}
+	proxy.Director = forwardedDirector(proxy.Director, opts.forwarded)
+	if opts.tracing {
+		proxy.Director = tracingDirector(proxy.Director)
+	}
+	if opts.requestHeaders != nil {
+		director := proxy.Director
+		proxy.Director = func(req *http.Request) {
+			director(req)
+			opts.requestHeaders.apply(req.Header)
+		}
+	}
+	if opts.hostHeader == hostHeaderBackend {
+		director := proxy.Director
+		proxy.Director = func(req *http.Request) {
+			director(req)
+			req.Host = url.Host
+		}
+	}
+	if opts.debugHeaders {
+		proxy.Director = debugHeadersDirector(proxy.Director, url.String())
+	}
+	switch {
+	case opts.proxyTransport != nil:
+		//h2c multiplexes requests over shared HTTP/2 connections, which
+		//the keep-alive and idle pool settings don't reach
+		if bc.DisableKeepAlive {
+			return nil, fmt.Errorf("backend %s: disable_keepalive is not supported with -h2c", bc.URL)
+		}
+		proxy.Transport = opts.proxyTransport
+	case bc.DisableKeepAlive && opts.transport != nil:
+		t := opts.transport.Clone()
+		t.DisableKeepAlives = true
+		proxy.Transport = t
+	case opts.transport != nil:
+		proxy.Transport = opts.transport
+	}
+	proxy.ErrorHandler = func(w http.ResponseWriter, r *http.Request, err error) {
+		slog.Error("Error response from proxy", "event", "proxy_error", "backend", url.String(), "client_ip", clientIP(r), "error", err)
+		backendErrorsTotal.WithLabelValues(url.String()).Inc()
+
+		//Let ServeHTTP decide whether to retry on another backend
+		if att := proxyAttemptFrom(r); att != nil {
+			att.err = err
+			return
+		}
+		writeProxyError(w, err, opts.unavailable)
+	}
+	proxy.ModifyResponse = func(resp *http.Response) error {
+		if att := proxyAttemptFrom(resp.Request); att != nil {
+			att.status = resp.StatusCode
+		}
+		if opts.debugHeaders {
+			logResponseHeaders(resp, url.String())
+		}
+		if opts.maxResponseBody > 0 {
+			if err := limitResponse(resp, opts.maxResponseBody, url.String()); err != nil {
+				return err
+			}
+		}
+		if opts.servedByHeader != "" {
+			resp.Header.Set(opts.servedByHeader, url.String())
+		}
+		opts.responseHeaders.apply(resp.Header)
+		return nil
+	}
+
+	health := bc.healthCheck()
+	if bc.HealthMode == "" && opts.healthMode != "" {
+		health.mode = opts.healthMode
+	}
+
+	return &BackEnd{
+		RProxy:          *proxy,
+		url:             url,
+		id:              backendID(url.String()),
+		weight:          bc.weight(),
+		health:          health,
+		checker:         newHealthChecker(health, opts.transport),
+		breaker:         newCircuitBreaker(opts.breaker, url.String()),
+		outlier:         newOutlierDetector(opts.outlier),
+		slowStart:       opts.slowStart,
+		adaptive:        opts.adaptive,
+		maxConns:        int64(bc.maxConns(opts.maxConns)),
+		stripPrefix:     bc.StripPrefix,
+		keepAliveOff:    bc.DisableKeepAlive,
+		tags:            bc.Tags,
+		timeout:         time.Duration(bc.Timeout),
+		excludeFlapping: opts.excludeFlapping,
+	}, nil
 }
 
 func (b *BackEnd) isAlive() bool {
+	return b.alive.Load()
+}
+
+// hasTags reports whether b carries every key/value pair of tags.
+func (b *BackEnd) hasTags(tags map[string]string) bool {
+	for k, v := range tags {
+		if b.tags[k] != v {
+			return false
+		}
+	}
+	return true
+}
+
+// isAvailable reports whether b may be picked by a strategy: it must be
+// healthy, enabled, not draining, below its connection limit, not ejected as an
+// outlier and its circuit breaker must not be open.
+func (b *BackEnd) isAvailable() bool {
+	if b.excludeFlapping && b.flapping.Load() {
+		return false
+	}
+	return b.isAlive() && !b.disabled.Load() && !b.draining.Load() && !b.saturated() && !b.outlier.ejected() && b.breaker.ready()
+}
+
+// weightScale lets slow start and adaptive weights express fractions of
+// a weight of 1.
+const weightScale = 100
+
+// effectiveWeight returns b's weight multiplied by weightScale, scaled by
+// health check latency when adaptive weights are on and reduced linearly
+// while the backend is within its slow-start window.
+func (b *BackEnd) effectiveWeight() int {
+	full := b.weight * weightScale
+	if full == 0 {
+		return 0
+	}
+	if b.adaptive.target > 0 {
+		_, avg := b.checkLatency()
+		full = max(int(float64(full)*b.adaptive.factor(avg)), 1)
+	}
+	if b.slowStart <= 0 {
+		return full
+	}
+
 	b.mux.Lock()
-	defer b.mux.Unlock()
-	return b.alive
+	since := b.healthySince
+	b.mux.Unlock()
+
+	elapsed := time.Since(since)
+	if since.IsZero() || elapsed >= b.slowStart {
+		return full
+	}
+
+	w := int(float64(full) * float64(elapsed) / float64(b.slowStart))
+	return max(w, 1)
+}
+
+// activeConns returns the number of requests b is serving right now.
+func (b *BackEnd) activeConns() int64 {
+	return b.active.Load()
+}
+
+// saturated reports whether b is at its in-flight request limit.
+func (b *BackEnd) saturated() bool {
+	return b.maxConns > 0 && b.activeConns() >= b.maxConns
+}
+
+// acquireConn reserves an in-flight slot, failing when b is saturated.
+func (b *BackEnd) acquireConn() bool {
+	if b.maxConns <= 0 {
+		b.active.Add(1)
+		return true
+	}
+
+	for {
+		cur := b.active.Load()
+		if cur >= b.maxConns {
+			return false
+		}
+		if b.active.CompareAndSwap(cur, cur+1) {
+			return true
+		}
+	}
+}
+
+func (b *BackEnd) releaseConn() {
+	b.active.Add(-1)
 }
 
 func (b *BackEnd) setAlive(alive bool) {
-	b.mux.Lock()
-	defer b.mux.Unlock()
-	b.alive = alive
+	b.alive.Store(alive)
 }
 
 type LoadBalancer struct {
-	backends []*BackEnd
-	counter  uint64
+	//The default pool, serving the top-level backends of the config
+	pool
+	//Named pools and the routes leading to them, fixed at startup
+	pools  map[string]*pool
+	routes []route
+	//Pool for requests no route matches, nil answers 404
+	fallback *pool
+
+	maxRetries   int
+	retryBackoff time.Duration
+	//Retry POST and PATCH when they carry an Idempotency-Key
+	retryIdemKey   bool
+	requestTimeout time.Duration
+	//Largest accepted request body in bytes, 0 means unlimited
+	maxBody int64
+	//How long to wait for a slot when every backend is saturated
+	queueTimeout time.Duration
+	accessLog    bool
+	stickyCookie string
+	//Settings for consistent-hash and ip-hash chosen at runtime
+	consistentHash ConsistentHashConfig
+	//Smallest response body gzipped for clients, 0 disables compression
+	compressMinSize int
+	//Per client IP limiter, nil when rate limiting is disabled
+	limiter *rateLimiter
+	//Limit of requests in flight across all pools, nil when unlimited
+	concurrency *concurrencyLimiter
+	//GET response cache, nil when disabled
+	cache       *responseCache
+	backendOpts backendOptions
+	events      eventBus
+	//Start a span per request, set when -otlp-endpoint is given
+	tracing bool
+	//Whole fleet maintenance, toggled via POST /admin/maintenance
+	maintenance atomic.Bool
+	retryAfter  atomic.Int64
 }
 
-func (l *LoadBalancer) nextBackend() *BackEnd {
-	//Setup next index based on current counter
-	next := atomic.AddUint64(&l.counter, uint64(1)) % uint64(len(l.backends))
+// waitForBackend polls p for an available backend until the queue
+// timeout or the request's own deadline passes.
+func (l *LoadBalancer) waitForBackend(p *pool, backends []*BackEnd, r *http.Request) *BackEnd {
+	ctx, cancel := context.WithTimeout(r.Context(), l.queueTimeout)
+	defer cancel()
 
-	//Find the next healthy backend servers
-	for i := 0; i < len(l.backends); i++ {
-		idx := (int(next) + i) % len(l.backends)
-		if l.backends[idx].isAlive() {
-			return l.backends[idx]
+	t := time.NewTicker(10 * time.Millisecond)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-t.C:
+			if b := p.nextBackend(backends, r); b != nil {
+				return b
+			}
 		}
 	}
+}
 
-	return nil
+// timeoutFor returns the request deadline for b, its own timeout or the
+// global -request-timeout. Zero means no deadline.
+func (l *LoadBalancer) timeoutFor(b *BackEnd) time.Duration {
+	if b.timeout > 0 {
+		return b.timeout
+	}
+	return l.requestTimeout
 }
 
-func (b *BackEnd) isBackendAlive() bool {
-	timeout := 5 * time.Second
-	conn, err := net.DialTimeout("tcp", b.url.Host, timeout)
-	if err != nil {
-		log.Printf("Site unreachable on port %s", err)
-		b.setAlive(false)
-		return false
+// inFlight returns the number of requests currently being proxied.
+func (l *LoadBalancer) inFlight() int64 {
+	var n int64
+	for _, p := range l.allPools() {
+		for _, b := range p.snapshot() {
+			n += b.activeConns()
+		}
 	}
-	defer conn.Close()
-	return true
+	return n
 }
 
-func (l *LoadBalancer) healthCheck() {
-	for _, b := range l.backends {
-		status := b.isBackendAlive()
-		b.setAlive(status)
-		if status {
-			log.Printf("Service on port %s is doing well", b.url.String())
-		} else {
-			log.Printf("Service on port %s is dead", b.url.String())
+// ServeHTTP routes r to a pool and proxies it to a backend picked by
+// the pool's strategy.
+//
+// WebSocket and other Upgrade requests are handled by the reverse proxy,
+// which hijacks the client connection and copies bytes both ways until
+// either side closes. Such connections count as in-flight for their
+// whole lifetime, so LeastConnectionsStrategy spreads them well, and
+// IPHashStrategy keeps reconnecting clients on the same backend. Any
+// ResponseWriter wrapper must keep implementing http.Hijacker.
+func (l *LoadBalancer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	requestsTotal.Inc()
+	start := time.Now()
+	r = l.backendOpts.forwarded.withClientIP(r)
+
+	var span trace.Span
+	if l.tracing {
+		r, span = startSpan(r)
+		defer span.End()
+	}
+
+	if l.serveMaintenance(w) {
+		l.finishRequest(r, span, nil, http.StatusServiceUnavailable, 0, start)
+		return
+	}
+
+	if l.concurrency != nil {
+		if !l.concurrency.acquire(r.Context()) {
+			writeUnavailable(w, l.backendOpts.unavailable, "Service Unavailable", 1)
+			l.finishRequest(r, span, nil, http.StatusServiceUnavailable, 0, start)
+			return
 		}
+		defer l.concurrency.release()
+	}
+
+	p := l.route(r)
+	if p == nil {
+		http.NotFound(w, r)
+		l.finishRequest(r, span, nil, http.StatusNotFound, 0, start)
+		return
+	}
+
+	//Checked before the cache so hits count against the client's budget too
+	if l.limiter != nil && !l.limiter.allow(clientIP(r)) {
+		http.Error(w, "Too Many Requests", http.StatusTooManyRequests)
+		l.finishRequest(r, span, nil, http.StatusTooManyRequests, 0, start)
+		return
+	}
+
+	if l.compressMinSize > 0 && acceptsGzip(r) {
+		gw := newGzipResponseWriter(w, l.compressMinSize)
+		defer gw.Close()
+		w = gw
+	}
+
+	var key string
+	var cw *cacheWriter
+	if l.cache != nil && cacheableRequest(r) {
+		key = cacheKey(r)
+		if e := l.cache.get(key); e != nil {
+			e.write(w)
+			l.finishRequest(r, span, nil, e.status, 0, start)
+			return
+		}
+
+		w.Header().Set("X-Cache", "MISS")
+		cw = &cacheWriter{ResponseWriter: w, stickyCookie: l.stickyCookie}
+		w = cw
+	}
+
+	var aborted bool
+	if !l.accessLog && span == nil {
+		_, _, aborted = l.proxy(p, w, r)
+	} else {
+		rec := &statusRecorder{ResponseWriter: w}
+		var b *BackEnd
+		var retries int
+		b, retries, aborted = l.proxy(p, rec, r)
+		l.finishRequest(r, span, b, rec.status, retries, start)
+	}
+
+	//Cut the client off the way ReverseProxy would have, a truncated
+	//response must not make it into the cache either
+	if aborted {
+		panic(http.ErrAbortHandler)
+	}
+	if cw != nil {
+		l.cache.store(key, cw)
 	}
 }
 
-func (l *LoadBalancer) PeriodicHealthCheck(interval time.Duration) {
-	t := time.NewTicker(interval)
-	<-t.C
-	l.healthCheck()
+// finishRequest records a served request in the access log and on its
+// span, either of which may be disabled.
+func (l *LoadBalancer) finishRequest(r *http.Request, span trace.Span, b *BackEnd, status, retries int, start time.Time) {
+	if span != nil {
+		finishSpan(span, b, status, retries)
+	}
+	if l.accessLog {
+		logAccess(r, b, status, retries, start)
+	}
 }
 
-func (l *LoadBalancer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	b := l.nextBackend()
-	if b == nil {
-		http.Error(w, "Service Unavailable", http.StatusServiceUnavailable)
-		return
+// proxy forwards r to a backend of p, retrying on other backends after
+// connection failures, and returns the backend that was tried last and
+// the number of retries made. aborted reports that the response was cut
+// off after its headers went out, the caller must abort the handler.
+func (l *LoadBalancer) proxy(p *pool, w http.ResponseWriter, r *http.Request) (*BackEnd, int, bool) {
+	if l.maxBody > 0 {
+		if r.ContentLength > l.maxBody {
+			http.Error(w, "Request Entity Too Large", http.StatusRequestEntityTooLarge)
+			return nil, 0, false
+		}
+		r.Body = http.MaxBytesReader(w, r.Body, l.maxBody)
 	}
 
+	//Buffer the body up front so a failed attempt can be replayed, when
+	//the request can't be retried it is streamed straight to the backend
+	canRetry := l.maxRetries > 0 && retryable(r, l.retryIdemKey)
+	var body []byte
+	if canRetry {
+		var err error
+		body, err = bufferBody(r)
+		if err != nil {
+			var tooLarge *http.MaxBytesError
+			if errors.As(err, &tooLarge) {
+				http.Error(w, "Request Entity Too Large", http.StatusRequestEntityTooLarge)
+				return nil, 0, false
+			}
+			http.Error(w, "Bad Request", http.StatusBadRequest)
+			return nil, 0, false
+		}
+	}
+
+	candidates := p.candidates()
+	var last *BackEnd
+	var lastErr error
+	var retries int
+	rec := &statusRecorder{ResponseWriter: w}
+	for attempt := 0; attempt <= l.maxRetries; attempt++ {
+		if attempt > 0 && !sleepContext(r.Context(), retryDelay(l.retryBackoff, attempt)) {
+			return last, retries, false
+		}
+
+		b := p.nextBackend(candidates, r)
+		if b == nil && l.queueTimeout > 0 {
+			b = l.waitForBackend(p, candidates, r)
+		}
+		if b == nil {
+			break
+		}
+		last = b
+		if attempt > 0 {
+			retries = attempt
+			retriesTotal.Inc()
+		}
+
+		if l.stickyCookie != "" {
+			setStickyCookie(w, r, l.stickyCookie, b)
+		}
+
+		rewindBody(r, body)
+		var aborted bool
+		aborted, lastErr = l.tryBackend(p, b, rec, r)
+		if lastErr == nil || aborted {
+			return b, retries, aborted
+		}
+
+		var tooLarge *http.MaxBytesError
+		if errors.As(lastErr, &tooLarge) {
+			http.Error(w, "Request Entity Too Large", http.StatusRequestEntityTooLarge)
+			return b, retries, false
+		}
+
+		//Another backend would most likely send the same oversized response
+		if errors.Is(lastErr, errResponseTooLarge) {
+			if rec.status == 0 {
+				writeProxyError(w, lastErr, l.backendOpts.unavailable)
+			}
+			return b, retries, false
+		}
+
+		//A slow backend is not retried, the next one would likely be slow too
+		if errors.Is(lastErr, errUpstreamTimeout) {
+			slog.Warn("Backend timed out", "event", "proxy_timeout", "backend", b.url.String(), "client_ip", clientIP(r), "latency", l.timeoutFor(b))
+			writeProxyError(w, lastErr, l.backendOpts.unavailable)
+			return b, retries, false
+		}
+		//Nothing can be retried once the client has seen part of a response
+		if r.Context().Err() != nil || rec.status != 0 {
+			return b, retries, false
+		}
+		if !canRetry && !notSent(lastErr) {
+			if l.maxRetries > 0 {
+				slog.Warn("Backend failed, not retrying non-idempotent request", "event", "proxy_no_retry", "backend", b.url.String(), "client_ip", clientIP(r), "method", r.Method, "error", lastErr)
+			}
+			break
+		}
+
+		//Treat the backend as suspect for the rest of this request
+		slog.Warn("Backend failed, retrying", "event", "proxy_retry", "backend", b.url.String(), "client_ip", clientIP(r), "attempt", attempt+1, "error", lastErr)
+		candidates = without(candidates, b)
+	}
+
+	writeProxyError(w, lastErr, l.backendOpts.unavailable)
+	if lastErr != nil {
+		return last, retries, false
+	}
+	return nil, retries, false
+}
+
+// tryBackend calls serveBackend and reports the http.ErrAbortHandler
+// panic ReverseProxy raises when copying the body fails as aborted, so
+// the request can still be logged before the handler is aborted.
+func (l *LoadBalancer) tryBackend(p *pool, b *BackEnd, w http.ResponseWriter, r *http.Request) (aborted bool, err error) {
+	defer func() {
+		if v := recover(); v != nil {
+			if v != http.ErrAbortHandler {
+				panic(v)
+			}
+			aborted = true
+		}
+	}()
+	return false, l.serveBackend(p, b, w, r)
+}
+
+// serveBackend proxies r to b of pool p and returns the connection-level error,
+// if any. Nothing has been written to w when an error is returned.
+func (l *LoadBalancer) serveBackend(p *pool, b *BackEnd, w http.ResponseWriter, r *http.Request) error {
+	if !b.acquireConn() {
+		return errBackendSaturated
+	}
+	defer b.releaseConn()
+
+	gen, ok := b.breaker.acquire()
+	if !ok {
+		return errBreakerOpen
+	}
+	r, att := withProxyAttempt(r)
+	//ReverseProxy panics with http.ErrAbortHandler when the body copy
+	//fails, count that as a failure so a half-open trial isn't held
+	//forever. A body cut off at -max-response-body is not the backend's
+	//fault, like an oversized body declared up front.
+	completed := false
+	defer func() {
+		if completed {
+			return
+		}
+		success := errors.Is(att.err, errResponseTooLarge)
+		if state, changed := b.breaker.record(gen, success); changed {
+			slog.Warn("Circuit breaker changed state", "event", "breaker_transition", "backend", b.url.String(), "status", state.String())
+		}
+	}()
+	b.served.Add(1)
+
+	label := b.url.String()
+	backendRequestsTotal.WithLabelValues(label).Inc()
+
+	//Upgraded connections are long-lived, so only plain requests get a deadline
+	if timeout := l.timeoutFor(b); timeout > 0 && r.Header.Get("Upgrade") == "" {
+		ctx, cancel := context.WithTimeout(r.Context(), timeout)
+		defer cancel()
+		r = r.WithContext(ctx)
+	}
+
+	start := time.Now()
 	b.RProxy.ServeHTTP(w, r)
+	completed = true
+	elapsed := time.Since(start)
+	//Upgraded connections would only skew the latency histogram
+	if att.status != http.StatusSwitchingProtocols {
+		upstreamLatency.WithLabelValues(label).Observe(elapsed.Seconds())
+		//Failed attempts return early, except timeouts which are slow by definition
+		if att.err == nil || errors.Is(r.Context().Err(), context.DeadlineExceeded) {
+			b.latency.observe(elapsed)
+		}
+	}
+
+	//Oversized bodies say nothing about the backend's health
+	var tooLarge *http.MaxBytesError
+	if errors.As(att.err, &tooLarge) || errors.Is(att.err, errResponseTooLarge) {
+		b.breaker.record(gen, true)
+		return att.err
+	}
+
+	success := att.err == nil && att.status < http.StatusInternalServerError
+	if state, changed := b.breaker.record(gen, success); changed {
+		slog.Warn("Circuit breaker changed state", "event", "breaker_transition", "backend", label, "status", state.String())
+	}
+
+	if att.err == nil && att.status != 0 {
+		p.recordOutlier(b, att.status)
+	}
+
+	//Errors caused by the client going away or our own deadline say nothing about the backend
+	if att.err != nil && r.Context().Err() == nil && b.recordProxyError(l.backendOpts.passive) {
+		l.notifyHealth(b, false)
+		slog.Warn("Service went down", "event", "health_transition", "backend", label, "status", "dead", "source", "passive", "errors", l.backendOpts.passive.threshold)
+	}
+
+	if att.err != nil && errors.Is(r.Context().Err(), context.DeadlineExceeded) {
+		return errUpstreamTimeout
+	}
+	return att.err
 }
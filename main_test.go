@@ -0,0 +1,338 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// newTestServer starts an upstream server that is closed with the test.
+func newTestServer(t *testing.T, h http.HandlerFunc) *httptest.Server {
+	t.Helper()
+	s := httptest.NewServer(h)
+	t.Cleanup(s.Close)
+	return s
+}
+
+// nameHandler answers every request with name.
+func nameHandler(name string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, name)
+	}
+}
+
+// countingHandler counts the requests it answers with 200.
+func countingHandler(n *atomic.Int64) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		n.Add(1)
+	}
+}
+
+// newTestLB returns a load balancer whose default pool holds one alive
+// backend per URL.
+func newTestLB(t *testing.T, urls ...string) *LoadBalancer {
+	t.Helper()
+	l := &LoadBalancer{}
+	l.name = defaultPoolName
+	l.healthOpts = healthOptions{
+		interval:    time.Minute,
+		timeout:     time.Second,
+		fall:        1,
+		rise:        1,
+		concurrency: 4,
+	}
+	l.fallback = &l.pool
+	addTestBackends(t, l, urls...)
+	return l
+}
+
+// addTestBackends adds an alive backend per URL to the default pool of
+// l, built with l.backendOpts.
+func addTestBackends(t *testing.T, l *LoadBalancer, urls ...string) []*BackEnd {
+	t.Helper()
+	var backends []*BackEnd
+	for _, u := range urls {
+		b := newTestBackEnd(t, BackendConfig{URL: u}, l.backendOpts)
+		if err := l.addBackend(b); err != nil {
+			t.Fatal(err)
+		}
+		backends = append(backends, b)
+	}
+	return backends
+}
+
+// newTestBackEnd builds an alive backend from bc.
+func newTestBackEnd(t *testing.T, bc BackendConfig, opts backendOptions) *BackEnd {
+	t.Helper()
+	if err := bc.validate(); err != nil {
+		t.Fatal(err)
+	}
+	b, err := newBackEnd(bc, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b.setAlive(true)
+	return b
+}
+
+// serve sends req to h and returns the recorded response.
+func serve(h http.Handler, req *http.Request) *httptest.ResponseRecorder {
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	return rec
+}
+
+// get sends a GET for target to h.
+func get(h http.Handler, target string) *httptest.ResponseRecorder {
+	return serve(h, httptest.NewRequest(http.MethodGet, target, nil))
+}
+
+func TestEmptyLoadBalancerAnswers503(t *testing.T) {
+	var l LoadBalancer
+	rec := get(&l, "/")
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Fatalf("status = %d, want 503", rec.Code)
+	}
+}
+
+func TestNextBackendEmpty(t *testing.T) {
+	var p pool
+	if b := p.nextBackend(nil, httptest.NewRequest(http.MethodGet, "/", nil)); b != nil {
+		t.Fatalf("nextBackend() = %v, want nil", b.url)
+	}
+}
+
+func TestShutdownWaitsForSlowRequest(t *testing.T) {
+	started := make(chan struct{})
+	slow := newTestServer(t, func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		time.Sleep(200 * time.Millisecond)
+		io.WriteString(w, "done")
+	})
+	l := newTestLB(t, slow.URL)
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := &http.Server{Handler: l}
+	go srv.Serve(ln)
+
+	type result struct {
+		body string
+		err  error
+	}
+	res := make(chan result, 1)
+	go func() {
+		resp, err := http.Get("http://" + ln.Addr().String())
+		if err != nil {
+			res <- result{err: err}
+			return
+		}
+		defer resp.Body.Close()
+		body, err := io.ReadAll(resp.Body)
+		res <- result{string(body), err}
+	}()
+
+	<-started
+	if n := l.inFlight(); n != 1 {
+		t.Errorf("inFlight() = %d, want 1", n)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := srv.Shutdown(ctx); err != nil {
+		t.Fatalf("Shutdown: %v", err)
+	}
+
+	r := <-res
+	if r.err != nil || r.body != "done" {
+		t.Fatalf("slow request got %q, %v, want it to complete", r.body, r.err)
+	}
+}
+
+func TestHostHeader(t *testing.T) {
+	srv := newTestServer(t, func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, r.Host)
+	})
+	backendHost := strings.TrimPrefix(srv.URL, "http://")
+
+	for _, tc := range []struct {
+		mode string
+		want string
+	}{
+		{"", "client.example"},
+		{hostHeaderPreserve, "client.example"},
+		{hostHeaderBackend, backendHost},
+	} {
+		l := newTestLB(t)
+		l.backendOpts.hostHeader = tc.mode
+		addTestBackends(t, l, srv.URL)
+
+		if rec := get(l, "http://client.example/"); rec.Body.String() != tc.want {
+			t.Errorf("mode %q: backend saw Host %q, want %q", tc.mode, rec.Body, tc.want)
+		}
+	}
+}
+
+func TestDrainLogsDecreasingCounts(t *testing.T) {
+	srv := newTestServer(t, func(w http.ResponseWriter, r *http.Request) {
+		d, _ := time.ParseDuration(r.URL.Query().Get("sleep"))
+		time.Sleep(d)
+	})
+	l := newTestLB(t, srv.URL)
+	logs := captureLogs(t)
+
+	var wg sync.WaitGroup
+	for _, d := range []string{"100ms", "200ms", "300ms"} {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			get(l, "/?sleep="+d)
+		}()
+	}
+	for l.inFlight() < 3 {
+		time.Sleep(time.Millisecond)
+	}
+
+	done := make(chan struct{})
+	finished := make(chan struct{})
+	go func() {
+		l.logDrain(done, 40*time.Millisecond)
+		close(finished)
+	}()
+	wg.Wait()
+	<-finished
+	close(done)
+
+	var counts []float64
+	for _, e := range logs.events(t, "shutdown") {
+		counts = append(counts, e["in_flight"].(float64))
+	}
+	if len(counts) < 3 {
+		t.Fatalf("logged in-flight counts %v, want one every 40ms while draining", counts)
+	}
+	for i := 1; i < len(counts); i++ {
+		if counts[i] > counts[i-1] {
+			t.Fatalf("in-flight counts %v went up", counts)
+		}
+	}
+	if counts[0] != 3 || counts[len(counts)-1] != 1 {
+		t.Fatalf("in-flight counts %v, want them to fall from 3 to 1", counts)
+	}
+}
+
+func TestSlowHeadersConnectionClosed(t *testing.T) {
+	l := newTestLB(t, newTestServer(t, nameHandler("ok")).URL)
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := &http.Server{Handler: l, ReadHeaderTimeout: 100 * time.Millisecond}
+	go srv.Serve(ln)
+	defer srv.Close()
+
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	//Send a header line every 30ms and never finish the request
+	start := time.Now()
+	io.WriteString(conn, "GET / HTTP/1.1\r\nHost: lb\r\n")
+	for i := 0; time.Since(start) < 2*time.Second; i++ {
+		time.Sleep(30 * time.Millisecond)
+		if _, err := io.WriteString(conn, "X-Drip: "+strings.Repeat("a", i)+"\r\n"); err != nil {
+			break
+		}
+	}
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	io.ReadAll(conn)
+	if d := time.Since(start); d > time.Second {
+		t.Fatalf("dribbling client kept its connection for %v with a 100ms header timeout", d)
+	}
+}
+
+func TestOversizedHeadersRejected(t *testing.T) {
+	l := newTestLB(t, newTestServer(t, nameHandler("ok")).URL)
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := &http.Server{Handler: l, MaxHeaderBytes: 1 << 10}
+	go srv.Serve(ln)
+	defer srv.Close()
+
+	req, _ := http.NewRequest(http.MethodGet, "http://"+ln.Addr().String()+"/", nil)
+	req.Header.Set("X-Big", strings.Repeat("a", 8<<10))
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusRequestHeaderFieldsTooLarge {
+		t.Fatalf("status = %d, want 431", resp.StatusCode)
+	}
+}
+
+// runMain runs main with args in a child process, since it exits on bad
+// flags, and returns its combined output.
+func runMain(t *testing.T, args ...string) (string, error) {
+	t.Helper()
+	cmd := exec.Command(os.Args[0], append([]string{"-test.run=^TestMainProcess$", "--"}, args...)...)
+	cmd.Env = append(os.Environ(), "LB_TEST_MAIN=1")
+	out, err := cmd.CombinedOutput()
+	return string(out), err
+}
+
+func TestMainProcess(t *testing.T) {
+	if os.Getenv("LB_TEST_MAIN") != "1" {
+		t.Skip("only runs as the child of runMain")
+	}
+	args := os.Args
+	for i, arg := range args {
+		if arg == "--" {
+			args = args[i+1:]
+			break
+		}
+	}
+	os.Args = append([]string{"load-balancer"}, args...)
+	flag.CommandLine = flag.NewFlagSet(os.Args[0], flag.ExitOnError)
+	main()
+	os.Exit(0)
+}
+
+func TestHealthFlags(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		args []string
+		want string
+	}{
+		{"defaults", nil, "config OK"},
+		{"timeout within interval", []string{"-health-interval", "10s", "-health-timeout", "2s"}, "config OK"},
+		{"timeout equals interval", []string{"-health-interval", "2s", "-health-timeout", "2s"}, "health timeout must be positive and smaller than interval 2s"},
+		{"timeout over interval", []string{"-health-interval", "1s", "-health-timeout", "5s"}, "health timeout must be positive and smaller than interval 1s"},
+		{"zero interval", []string{"-health-interval", "0"}, "health interval must be positive"},
+		{"bad duration", []string{"-health-interval", "often"}, "invalid value \"often\" for flag -health-interval"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			out, err := runMain(t, append(tc.args, "-validate", "-backends", "http://a:80")...)
+			if ok := tc.want == "config OK"; (err == nil) != ok {
+				t.Fatalf("exit error = %v, want success %v\n%s", err, ok, out)
+			}
+			if !strings.Contains(out, tc.want) {
+				t.Fatalf("output is missing %q:\n%s", tc.want, out)
+			}
+		})
+	}
+}
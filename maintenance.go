@@ -0,0 +1,57 @@
+package main
+
+import (
+	"encoding/json"
+	"log/slog"
+	"net/http"
+)
+
+// defaultRetryAfter is the Retry-After in seconds sent during
+// maintenance when the admin request doesn't set one.
+const defaultRetryAfter = 60
+
+// maintenanceRequest is the body of POST /admin/maintenance.
+type maintenanceRequest struct {
+	Enabled bool `json:"enabled"`
+	//Seconds clients are told to wait, defaultRetryAfter when zero
+	RetryAfter int `json:"retry_after"`
+}
+
+// serveMaintenance answers with 503 and reports true while the load
+// balancer is in maintenance mode.
+func (l *LoadBalancer) serveMaintenance(w http.ResponseWriter) bool {
+	if !l.maintenance.Load() {
+		return false
+	}
+
+	writeUnavailable(w, l.backendOpts.unavailable, "Service Unavailable", int(l.retryAfter.Load()))
+	return true
+}
+
+// handleMaintenance serves POST /admin/maintenance. While enabled every
+// new request is refused with 503 and /ready fails; requests already in
+// flight are left to finish.
+func (l *LoadBalancer) handleMaintenance(w http.ResponseWriter, r *http.Request) {
+	var req maintenanceRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "invalid JSON body: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if req.RetryAfter < 0 {
+		http.Error(w, "retry_after must not be negative", http.StatusBadRequest)
+		return
+	}
+	if req.RetryAfter == 0 {
+		req.RetryAfter = defaultRetryAfter
+	}
+
+	l.retryAfter.Store(int64(req.RetryAfter))
+	if l.maintenance.Swap(req.Enabled) != req.Enabled {
+		slog.Warn("Maintenance mode changed", "event", "maintenance", "enabled", req.Enabled, "in_flight", l.inFlight())
+	}
+
+	writeJSON(w, http.StatusOK, map[string]any{
+		"enabled":     req.Enabled,
+		"retry_after": req.RetryAfter,
+	})
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	requestsTotal = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "lb_requests_total",
+		Help: "Total number of requests received by the load balancer.",
+	})
+
+	connectionsAccepted = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "lb_connections_accepted_total",
+		Help: "Client connections accepted by the HTTP listener.",
+	})
+
+	connectionsActive = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "lb_connections_active",
+		Help: "Client connections currently open, busy or idle in keep-alive.",
+	})
+
+	connectionsClosed = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "lb_connections_closed_total",
+		Help: "Client connections closed, including ones handed off by a protocol upgrade.",
+	})
+
+	globalInFlight = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "lb_in_flight_requests",
+		Help: "Requests holding a slot of the -max-in-flight limit.",
+	})
+
+	globalRejectedTotal = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "lb_in_flight_rejected_total",
+		Help: "Requests refused because the -max-in-flight limit was reached.",
+	})
+
+	backendRequestsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "lb_backend_requests_total",
+		Help: "Number of requests proxied to each backend.",
+	}, []string{"backend"})
+
+	retriesTotal = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "lb_retries_total",
+		Help: "Number of times a request was retried on another backend.",
+	})
+
+	backendErrorsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "lb_backend_errors_total",
+		Help: "Number of proxy errors returned by each backend.",
+	}, []string{"backend"})
+
+	upstreamLatency = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "lb_upstream_latency_seconds",
+		Help:    "Latency of proxied upstream requests.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"backend"})
+
+	breakerStateGauge = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "lb_breaker_state",
+		Help: "Circuit breaker state of each backend: 0 closed, 1 open, 2 half-open.",
+	}, []string{"backend"})
+
+	breakerTripsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "lb_breaker_trips_total",
+		Help: "Number of times each backend's circuit breaker opened.",
+	}, []string{"backend"})
+
+	healthCheckLatency = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "lb_health_check_latency_seconds",
+		Help: "Duration of the last health check of each backend.",
+	}, []string{"backend"})
+)
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+func TestMetricsPerBackend(t *testing.T) {
+	a := newTestServer(t, nameHandler("a"))
+	b := newTestServer(t, nameHandler("b"))
+	l := newTestLB(t, a.URL, b.URL)
+	for range 6 {
+		if rec := get(l, "/"); rec.Code != http.StatusOK {
+			t.Fatalf("status = %d", rec.Code)
+		}
+	}
+
+	rec := get(promhttp.Handler(), "/metrics")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("/metrics status = %d", rec.Code)
+	}
+	//The test servers listen on fresh ports, so their series start at zero
+	for _, u := range []string{a.URL, b.URL} {
+		for _, want := range []string{
+			fmt.Sprintf(`lb_backend_requests_total{backend=%q} 3`, u),
+			fmt.Sprintf(`lb_upstream_latency_seconds_count{backend=%q} 3`, u),
+		} {
+			if !strings.Contains(rec.Body.String(), want+"\n") {
+				t.Errorf("/metrics is missing %s", want)
+			}
+		}
+	}
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// maxEjectionMultiplier caps how far repeat ejections stretch the base
+// ejection time.
+const maxEjectionMultiplier = 10
+
+// outlierOptions configures outlier detection. A zero threshold
+// disables it.
+type outlierOptions struct {
+	//Consecutive 5xx responses that eject a backend
+	threshold int
+	//Ejection time for the first offense, multiplied for repeat ones
+	baseEjection time.Duration
+	//Largest share of the pool, in percent, that may be ejected at once
+	maxPercent int
+}
+
+// outlierDetector tracks consecutive 5xx responses seen on live traffic
+// and temporarily ejects a backend that keeps failing, Envoy style.
+type outlierDetector struct {
+	opts outlierOptions
+
+	mux          sync.Mutex
+	consecutive  int
+	ejections    int
+	ejectedUntil time.Time
+}
+
+func newOutlierDetector(opts outlierOptions) *outlierDetector {
+	return &outlierDetector{opts: opts}
+}
+
+// ejected reports whether the backend is currently ejected.
+func (o *outlierDetector) ejected() bool {
+	if o == nil || o.opts.threshold <= 0 {
+		return false
+	}
+
+	o.mux.Lock()
+	defer o.mux.Unlock()
+	return time.Now().Before(o.ejectedUntil)
+}
+
+// record counts status and reports whether the threshold was reached.
+func (o *outlierDetector) record(status int) bool {
+	if o == nil || o.opts.threshold <= 0 {
+		return false
+	}
+
+	o.mux.Lock()
+	defer o.mux.Unlock()
+
+	if status < http.StatusInternalServerError {
+		o.consecutive = 0
+		//Forget past offenses once the backend behaved for as long as
+		//its last ejection lasted
+		if o.ejections > 0 && time.Since(o.ejectedUntil) > o.ejectionTime() {
+			o.ejections = 0
+		}
+		return false
+	}
+
+	o.consecutive++
+	return o.consecutive >= o.opts.threshold
+}
+
+// eject takes the backend out of rotation and returns for how long.
+func (o *outlierDetector) eject() time.Duration {
+	o.mux.Lock()
+	defer o.mux.Unlock()
+
+	o.ejections++
+	o.consecutive = 0
+	d := o.ejectionTime()
+	o.ejectedUntil = time.Now().Add(d)
+	return d
+}
+
+func (o *outlierDetector) ejectionTime() time.Duration {
+	return o.opts.baseEjection * time.Duration(min(max(o.ejections, 1), maxEjectionMultiplier))
+}
+
+// recordOutlier feeds a proxied response status into b's outlier
+// detector and ejects b if it crossed the threshold, unless that would
+// exceed the maximum ejection percentage. One backend may always be
+// ejected so small pools are still protected.
+func (p *pool) recordOutlier(b *BackEnd, status int) {
+	if !b.outlier.record(status) {
+		return
+	}
+
+	backends := p.snapshot()
+	ejected := 0
+	for _, other := range backends {
+		if other.outlier.ejected() {
+			ejected++
+		}
+	}
+
+	limit := len(backends) * b.outlier.opts.maxPercent / 100
+	if ejected > 0 && ejected+1 > limit {
+		slog.Warn("Outlier not ejected, too many backends ejected already", "event", "outlier", "backend", b.url.String(), "ejected", ejected)
+		return
+	}
+
+	d := b.outlier.eject()
+	slog.Warn("Outlier ejected", "event", "outlier", "backend", b.url.String(), "status", status, "duration", d)
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"net/http"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestOutlierEjectsAndReadmits(t *testing.T) {
+	var failing atomic.Int64
+	bad := newTestServer(t, func(w http.ResponseWriter, r *http.Request) {
+		failing.Add(1)
+		w.WriteHeader(http.StatusInternalServerError)
+	})
+	good := newTestServer(t, nameHandler("good"))
+
+	l := newTestLB(t)
+	l.backendOpts.outlier = outlierOptions{threshold: 2, baseEjection: 100 * time.Millisecond, maxPercent: 50}
+	backends := addTestBackends(t, l, bad.URL, good.URL)
+
+	for range 10 {
+		get(l, "/")
+	}
+	if n := failing.Load(); n != 2 {
+		t.Fatalf("failing backend got %d requests, want 2 before ejection", n)
+	}
+	if !backends[0].outlier.ejected() {
+		t.Fatal("failing backend not ejected")
+	}
+
+	time.Sleep(120 * time.Millisecond)
+	if backends[0].outlier.ejected() {
+		t.Fatal("backend still ejected after the ejection time")
+	}
+	for range 4 {
+		get(l, "/")
+	}
+	if n := failing.Load(); n != 4 {
+		t.Fatalf("failing backend got %d requests in total, want 2 more after readmission", n)
+	}
+
+	//A repeat offense keeps it out twice as long
+	time.Sleep(120 * time.Millisecond)
+	if !backends[0].outlier.ejected() {
+		t.Fatal("repeat offender readmitted after the base ejection time")
+	}
+}
+
+func TestOutlierMaxEjectionPercent(t *testing.T) {
+	l := newTestLB(t)
+	l.backendOpts.outlier = outlierOptions{threshold: 1, baseEjection: time.Minute, maxPercent: 25}
+	backends := addTestBackends(t, l, "http://a", "http://b", "http://c", "http://d")
+
+	l.recordOutlier(backends[0], http.StatusBadGateway)
+	l.recordOutlier(backends[1], http.StatusBadGateway)
+	if !backends[0].outlier.ejected() {
+		t.Fatal("first outlier not ejected")
+	}
+	if backends[1].outlier.ejected() {
+		t.Fatal("second outlier ejected beyond 25% of the pool")
+	}
+}
+
+func TestOutlierSuccessResetsCount(t *testing.T) {
+	o := newOutlierDetector(outlierOptions{threshold: 3, baseEjection: time.Minute, maxPercent: 100})
+	for _, status := range []int{500, 503, 200, 500, 502} {
+		if o.record(status) {
+			t.Fatalf("threshold reached at status %d with a success in between", status)
+		}
+	}
+	if !o.record(http.StatusServiceUnavailable) {
+		t.Fatal("threshold not reached after 3 consecutive 5xx")
+	}
+}
@@ -0,0 +1,284 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"maps"
+	"net"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+)
+
+// defaultPoolName names the pool built from the top-level backends.
+const defaultPoolName = "default"
+
+// pool is a set of backends sharing a strategy and health settings.
+type pool struct {
+	name string
+	//backends is replaced, never modified in place, so a snapshot
+	//taken under mux stays valid after the lock is released. Always go
+	//through snapshot, addBackend and removeBackend to access it.
+	mux      sync.RWMutex
+	backends []*BackEnd
+
+	//Guarded by mux, it can be swapped via POST /admin/strategy
+	strategy   Strategy
+	healthOpts healthOptions
+	//Only backends carrying all of these tags receive traffic
+	matchTags map[string]string
+	//Share of traffic sent to canary backends, nil when disabled
+	canary *canarySplit
+}
+
+// snapshot returns the current backend list.
+func (p *pool) snapshot() []*BackEnd {
+	p.mux.RLock()
+	defer p.mux.RUnlock()
+	return p.backends
+}
+
+// candidates returns the backends eligible for a request: those matching
+// the pool's tag filter, narrowed to the canary or stable subset when a
+// canary split is configured.
+func (p *pool) candidates() []*BackEnd {
+	backends := p.snapshot()
+	if len(p.matchTags) > 0 {
+		matched := make([]*BackEnd, 0, len(backends))
+		for _, b := range backends {
+			if b.hasTags(p.matchTags) {
+				matched = append(matched, b)
+			}
+		}
+		backends = matched
+	}
+
+	if p.canary != nil {
+		backends = p.canary.pick(backends)
+	}
+	return backends
+}
+
+// addBackend appends b to the pool, rejecting duplicate URLs.
+func (p *pool) addBackend(b *BackEnd) error {
+	p.mux.Lock()
+	defer p.mux.Unlock()
+
+	for _, other := range p.backends {
+		if other.url.String() == b.url.String() {
+			return fmt.Errorf("%w: %s", errDuplicateBackend, b.url)
+		}
+	}
+
+	backends := make([]*BackEnd, len(p.backends), len(p.backends)+1)
+	copy(backends, p.backends)
+	p.backends = append(backends, b)
+	return nil
+}
+
+// findBackend returns the backend with the given URL, or nil.
+func (p *pool) findBackend(rawURL string) *BackEnd {
+	for _, b := range p.snapshot() {
+		if b.url.String() == rawURL {
+			return b
+		}
+	}
+	return nil
+}
+
+// findBackendByID returns the backend whose id is id, or nil.
+func (p *pool) findBackendByID(id string) *BackEnd {
+	for _, b := range p.snapshot() {
+		if b.id == id {
+			return b
+		}
+	}
+	return nil
+}
+
+// removeBackend drops b from the pool. In-flight requests holding b
+// are unaffected.
+func (p *pool) removeBackend(b *BackEnd) bool {
+	p.mux.Lock()
+	defer p.mux.Unlock()
+
+	for _, other := range p.backends {
+		if other == b {
+			p.backends = without(p.backends, b)
+			p.forget(b)
+			return true
+		}
+	}
+	return false
+}
+
+// forget drops the state the strategy of p keeps for b, which has left
+// the pool. p.mux must be held.
+func (p *pool) forget(b *BackEnd) {
+	if f, ok := p.strategy.(backendForgetter); ok {
+		f.forget(b)
+	}
+}
+
+func (p *pool) nextBackend(backends []*BackEnd, r *http.Request) *BackEnd {
+	//No backends configured, nothing to pick from
+	if len(backends) == 0 {
+		return nil
+	}
+
+	//Fall back to round-robin when no strategy was set
+	p.mux.RLock()
+	strategy := p.strategy
+	p.mux.RUnlock()
+	if strategy == nil {
+		strategy = defaultStrategy
+	}
+
+	return strategy.Pick(backends, r)
+}
+
+// setStrategy replaces the strategy of p for all following picks.
+func (p *pool) setStrategy(s Strategy) {
+	p.mux.Lock()
+	p.strategy = s
+	p.mux.Unlock()
+}
+
+// allPools returns the default pool followed by the named pools in
+// name order.
+func (l *LoadBalancer) allPools() []*pool {
+	pools := []*pool{&l.pool}
+	for _, name := range slices.Sorted(maps.Keys(l.pools)) {
+		pools = append(pools, l.pools[name])
+	}
+	return pools
+}
+
+// poolByName returns the named pool, the default pool for "" or
+// defaultPoolName, or nil.
+func (l *LoadBalancer) poolByName(name string) *pool {
+	if name == "" || name == defaultPoolName {
+		return &l.pool
+	}
+	return l.pools[name]
+}
+
+// route sends requests matching host, sni, pathPrefix and methods,
+// where set, to a pool.
+type route struct {
+	host       string
+	sni        string
+	pathPrefix string
+	methods    []string
+	pool       *pool
+}
+
+func (rt *route) matches(r *http.Request) bool {
+	if rt.host != "" && !strings.EqualFold(rt.host, requestHost(r)) {
+		return false
+	}
+	if rt.sni != "" && (r.TLS == nil || !strings.EqualFold(rt.sni, r.TLS.ServerName)) {
+		return false
+	}
+	if len(rt.methods) > 0 && !slices.Contains(rt.methods, r.Method) {
+		return false
+	}
+	if rt.pathPrefix != "" {
+		if _, ok := stripPathPrefix(r.URL.Path, rt.pathPrefix); !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// route returns the pool for r: the first matching route wins, then the
+// fallback pool. Without any routes the default pool serves everything,
+// even when it is empty. It returns nil when nothing matches.
+func (l *LoadBalancer) route(r *http.Request) *pool {
+	for i := range l.routes {
+		if l.routes[i].matches(r) {
+			return l.routes[i].pool
+		}
+	}
+	if l.fallback == nil && len(l.routes) == 0 {
+		return &l.pool
+	}
+	return l.fallback
+}
+
+// requestHost returns the Host of r without a port.
+func requestHost(r *http.Request) string {
+	if host, _, err := net.SplitHostPort(r.Host); err == nil {
+		return host
+	}
+	return r.Host
+}
+
+// buildPools fills the default pool from cfg.Backends, creates the named
+// pools and wires up the routes. The default pool's strategy and health
+// settings must already be set; named pools start from them.
+func (l *LoadBalancer) buildPools(cfg *Config) error {
+	l.matchTags = cfg.MatchTags
+	l.canary = cfg.Canary.split()
+	if err := l.addBackends(&l.pool, cfg.Backends); err != nil {
+		return err
+	}
+
+	l.pools = make(map[string]*pool, len(cfg.Pools))
+	for _, name := range slices.Sorted(maps.Keys(cfg.Pools)) {
+		pc := cfg.Pools[name]
+		strategy, err := newStrategy(pc.Strategy, cfg.ConsistentHash)
+		if err != nil {
+			return fmt.Errorf("pool %s: %w", name, err)
+		}
+
+		p := &pool{
+			name:       name,
+			strategy:   strategy,
+			healthOpts: pc.Health.apply(l.healthOpts),
+			matchTags:  pc.MatchTags,
+			canary:     pc.Canary.split(),
+		}
+		if err := p.healthOpts.validate(); err != nil {
+			return fmt.Errorf("pool %s: %w", name, err)
+		}
+		if err := l.addBackends(p, pc.Backends); err != nil {
+			return err
+		}
+		l.pools[name] = p
+	}
+
+	for _, rc := range cfg.Routes {
+		l.routes = append(l.routes, route{
+			host:       rc.Host,
+			sni:        rc.SNI,
+			pathPrefix: rc.PathPrefix,
+			methods:    rc.Methods,
+			pool:       l.poolByName(rc.Pool),
+		})
+	}
+
+	switch {
+	case cfg.DefaultPool != "":
+		l.fallback = l.poolByName(cfg.DefaultPool)
+	case len(cfg.Backends) > 0:
+		l.fallback = &l.pool
+	}
+	return nil
+}
+
+func (l *LoadBalancer) addBackends(p *pool, backends []BackendConfig) error {
+	for _, bc := range backends {
+		b, err := newBackEnd(bc, l.backendOpts)
+		if err != nil {
+			return err
+		}
+
+		if err := p.addBackend(b); err != nil {
+			return err
+		}
+		slog.Info("Configured server", "event", "backend_configured", "pool", p.name, "backend", b.url.String())
+	}
+	return nil
+}
@@ -0,0 +1,295 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// Run with -race: serving, health checks and admin changes all touch the
+// backend list at the same time.
+func TestConcurrentServeAndMutate(t *testing.T) {
+	srv := newTestServer(t, nameHandler("ok"))
+	l := newTestLB(t, srv.URL)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	var wg sync.WaitGroup
+	for range 4 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for ctx.Err() == nil {
+				get(l, "/")
+			}
+		}()
+	}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for ctx.Err() == nil {
+			l.healthCheck(ctx, &l.pool, false)
+		}
+	}()
+
+	for i := range 50 {
+		//Same server under different URLs so every copy answers
+		b := newTestBackEnd(t, BackendConfig{URL: fmt.Sprintf("%s/copy%d", srv.URL, i)}, l.backendOpts)
+		if err := l.addBackend(b); err != nil {
+			t.Fatal(err)
+		}
+		if i%2 == 0 && !l.removeBackend(b) {
+			t.Fatalf("removing %s failed", b.url)
+		}
+	}
+	cancel()
+	wg.Wait()
+
+	if n := len(l.snapshot()); n != 26 {
+		t.Fatalf("%d backends, want 26", n)
+	}
+	if rec := get(l, "/"); rec.Code != http.StatusOK {
+		t.Fatalf("status = %d", rec.Code)
+	}
+}
+
+// newRoutedLB builds a load balancer from the YAML config content, with
+// every backend alive.
+func newRoutedLB(t *testing.T, content string) *LoadBalancer {
+	t.Helper()
+	cfg, err := loadConfig(writeConfig(t, content))
+	if err != nil {
+		t.Fatal(err)
+	}
+	l := newTestLB(t)
+	l.fallback = nil
+	if err := l.buildPools(cfg); err != nil {
+		t.Fatal(err)
+	}
+	for _, p := range l.allPools() {
+		for _, b := range p.snapshot() {
+			b.setAlive(true)
+		}
+	}
+	return l
+}
+
+func TestHostAndPrefixRouting(t *testing.T) {
+	api := newTestServer(t, nameHandler("api"))
+	static := newTestServer(t, nameHandler("static"))
+	web := newTestServer(t, nameHandler("web"))
+
+	l := newRoutedLB(t, fmt.Sprintf(`
+pools:
+  api:
+    backends: [%s]
+  static:
+    backends: [%s]
+  web:
+    backends: [%s]
+routes:
+  - host: static.example.com
+    pool: static
+  - path_prefix: /api
+    pool: api
+default_pool: web
+`, api.URL, static.URL, web.URL))
+
+	for _, tc := range []struct {
+		target, want string
+	}{
+		{"http://static.example.com/api/users", "static"},
+		{"http://STATIC.example.com:8080/", "static"},
+		{"http://www.example.com/api", "api"},
+		{"http://www.example.com/api/users", "api"},
+		{"http://www.example.com/apiv2", "web"},
+		{"http://www.example.com/", "web"},
+	} {
+		if rec := get(l, tc.target); rec.Body.String() != tc.want {
+			t.Errorf("%s went to %q, want %q", tc.target, rec.Body, tc.want)
+		}
+	}
+}
+
+func TestUnmatchedRequestWithoutDefaultPool(t *testing.T) {
+	api := newTestServer(t, nameHandler("api"))
+	l := newRoutedLB(t, fmt.Sprintf(`
+pools:
+  api:
+    backends: [%s]
+routes:
+  - path_prefix: /api
+    pool: api
+`, api.URL))
+
+	if rec := get(l, "/other"); rec.Code != http.StatusNotFound {
+		t.Fatalf("unmatched request: status = %d, want 404", rec.Code)
+	}
+}
+
+func TestRootPathPrefixMatchesEverything(t *testing.T) {
+	all := newTestServer(t, nameHandler("all"))
+	l := newRoutedLB(t, fmt.Sprintf(`
+pools:
+  all:
+    backends: [%s]
+routes:
+  - path_prefix: /
+    pool: all
+`, all.URL))
+
+	for _, target := range []string{"/", "/users", "/api/v1/x"} {
+		if rec := get(l, target); rec.Body.String() != "all" {
+			t.Errorf("%s: %d %q, want the all pool", target, rec.Code, rec.Body)
+		}
+	}
+}
+
+func TestMatchTagsRestrictsSelection(t *testing.T) {
+	l := newRoutedLB(t, `
+match_tags:
+  zone: us-east
+backends:
+  - {url: "http://east-1", tags: {zone: us-east, tier: web}}
+  - {url: "http://west-1", tags: {zone: us-west, tier: web}}
+  - {url: "http://east-2", tags: {zone: us-east}}
+  - http://untagged
+`)
+
+	picked := make(map[string]int)
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	for range 40 {
+		picked[l.nextBackend(l.candidates(), req).url.Host]++
+	}
+	if len(picked) != 2 || picked["east-1"] == 0 || picked["east-2"] == 0 {
+		t.Fatalf("picks = %v, want only the us-east backends", picked)
+	}
+
+	rec := adminRequest(l, http.MethodGet, "/admin/stats", "")
+	if !strings.Contains(rec.Body.String(), `"tags":{"tier":"web","zone":"us-east"}`) {
+		t.Errorf("stats don't show the tags: %s", rec.Body)
+	}
+}
+
+func TestMethodRouting(t *testing.T) {
+	replica := newTestServer(t, nameHandler("replica"))
+	primary := newTestServer(t, nameHandler("primary"))
+	l := newRoutedLB(t, fmt.Sprintf(`
+pools:
+  replica:
+    backends: [%s]
+  primary:
+    backends: [%s]
+routes:
+  - methods: [GET, HEAD]
+    pool: replica
+default_pool: primary
+`, replica.URL, primary.URL))
+
+	for _, tc := range []struct {
+		method, want string
+	}{
+		{http.MethodGet, "replica"},
+		{http.MethodPost, "primary"},
+		{http.MethodPut, "primary"},
+		{http.MethodDelete, "primary"},
+	} {
+		rec := serve(l, httptest.NewRequest(tc.method, "/orders", nil))
+		if rec.Body.String() != tc.want {
+			t.Errorf("%s went to %q, want %q", tc.method, rec.Body, tc.want)
+		}
+	}
+	//HEAD has no body to tell the pools apart, so check the route itself
+	if p := l.route(httptest.NewRequest(http.MethodHead, "/", nil)); p != l.pools["replica"] {
+		t.Error("HEAD not routed to the replica pool")
+	}
+}
+
+func TestMethodRouteValidation(t *testing.T) {
+	_, err := loadConfig(writeConfig(t, `
+pools:
+  replica:
+    backends: [http://a]
+routes:
+  - methods: [get]
+    pool: replica
+`))
+	if err == nil {
+		t.Fatal("loadConfig accepted a lowercase method")
+	}
+}
+
+func TestSNIRouting(t *testing.T) {
+	api := newTestServer(t, nameHandler("api"))
+	web := newTestServer(t, nameHandler("web"))
+	l := newRoutedLB(t, fmt.Sprintf(`
+pools:
+  api:
+    backends: [%s]
+  web:
+    backends: [%s]
+routes:
+  - sni: api.example.com
+    pool: api
+default_pool: web
+`, api.URL, web.URL))
+
+	certs, err := newCertStore(writeTestCert(t, t.TempDir(), "lb"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := serveTLS(t, l, serverTLSConfig(certs))
+
+	for _, tc := range []struct {
+		sni, host, want string
+	}{
+		//The handshake decides, whatever Host says
+		{"api.example.com", "www.example.com", "api"},
+		{"API.example.com", "", "api"},
+		{"www.example.com", "api.example.com", "web"},
+	} {
+		client := &http.Client{Transport: &http.Transport{
+			TLSClientConfig: &tls.Config{ServerName: tc.sni, InsecureSkipVerify: true},
+		}}
+		req, _ := http.NewRequest(http.MethodGet, "https://"+addr+"/", nil)
+		if tc.host != "" {
+			req.Host = tc.host
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if string(body) != tc.want {
+			t.Errorf("SNI %q, Host %q went to %q, want %q", tc.sni, tc.host, body, tc.want)
+		}
+	}
+
+	//Plain HTTP has no SNI and never matches the route
+	if rec := get(l, "http://api.example.com/"); rec.Body.String() != "web" {
+		t.Errorf("request without TLS went to %q, want web", rec.Body)
+	}
+}
+
+func TestPoolHealthTimeoutMustFitInterval(t *testing.T) {
+	//The pool inherits the 1s default timeout and only shortens the interval
+	cfg, err := loadConfig(writeConfig(t, `
+pools:
+  api:
+    backends: [http://a:80]
+    health: {interval: 500ms}
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = newTestLB(t).buildPools(cfg)
+	if err == nil || !strings.Contains(err.Error(), "pool api: health timeout") {
+		t.Fatalf("buildPools = %v, want the pool's health timeout rejected", err)
+	}
+}
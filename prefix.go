@@ -0,0 +1,42 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+)
+
+// stripPathPrefix removes prefix from path on a segment boundary, so
+// "/api" strips "/api" and "/api/users" but not "/apiv2". Stripping the
+// whole path leaves "/". The prefix "/" matches every path and strips
+// nothing.
+func stripPathPrefix(path, prefix string) (string, bool) {
+	prefix = strings.TrimSuffix(prefix, "/")
+	if prefix == "" {
+		return path, true
+	}
+
+	rest, ok := strings.CutPrefix(path, prefix)
+	if !ok || (rest != "" && rest[0] != '/') {
+		return path, false
+	}
+	if rest == "" {
+		rest = "/"
+	}
+	return rest, true
+}
+
+// stripPrefixDirector wraps director so prefix is removed from the
+// request path before it is joined with the backend URL.
+func stripPrefixDirector(director func(*http.Request), prefix string) func(*http.Request) {
+	return func(req *http.Request) {
+		if path, ok := stripPathPrefix(req.URL.Path, prefix); ok {
+			req.URL.Path = path
+			if raw, ok := stripPathPrefix(req.URL.RawPath, prefix); ok {
+				req.URL.RawPath = raw
+			} else {
+				req.URL.RawPath = ""
+			}
+		}
+		director(req)
+	}
+}
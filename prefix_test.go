@@ -0,0 +1,57 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"testing"
+)
+
+func TestStripPathPrefix(t *testing.T) {
+	for _, tc := range []struct {
+		path, prefix string
+		want         string
+		ok           bool
+	}{
+		{"/api/users", "/api", "/users", true},
+		{"/api/users", "/api/", "/users", true},
+		{"/api", "/api", "/", true},
+		{"/api/", "/api", "/", true},
+		{"/api/", "/api/", "/", true},
+		{"/apiv2/users", "/api", "/apiv2/users", false},
+		{"/other", "/api", "/other", false},
+		{"/api/v1/x", "/api/v1", "/x", true},
+		{"/anything", "/", "/anything", true},
+		{"/", "/", "/", true},
+	} {
+		got, ok := stripPathPrefix(tc.path, tc.prefix)
+		if got != tc.want || ok != tc.ok {
+			t.Errorf("stripPathPrefix(%q, %q) = %q, %v, want %q, %v", tc.path, tc.prefix, got, ok, tc.want, tc.ok)
+		}
+	}
+}
+
+func TestStripPrefixThroughProxy(t *testing.T) {
+	srv := newTestServer(t, func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, r.URL.EscapedPath()+"?"+r.URL.RawQuery)
+	})
+
+	for _, tc := range []struct {
+		backend, strip, target, want string
+	}{
+		{"", "", "/api/users", "/api/users?"},
+		{"", "/api", "/api/users?id=1", "/users?id=1"},
+		{"", "/api", "/api", "/?"},
+		{"", "/api", "/apiv2", "/apiv2?"},
+		{"/base", "/api", "/api/users", "/base/users?"},
+		{"", "/api", "/api/a%2Fb", "/a%2Fb?"},
+	} {
+		l := newTestLB(t)
+		b := newTestBackEnd(t, BackendConfig{URL: srv.URL + tc.backend, StripPrefix: tc.strip}, l.backendOpts)
+		if err := l.addBackend(b); err != nil {
+			t.Fatal(err)
+		}
+		if rec := get(l, tc.target); rec.Body.String() != tc.want {
+			t.Errorf("backend %q strip %q: %s reached the backend as %q, want %q", tc.backend, tc.strip, tc.target, rec.Body, tc.want)
+		}
+	}
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestReadProxyV1(t *testing.T) {
+	for _, tc := range []struct {
+		header string
+		want   string
+		ok     bool
+	}{
+		{"PROXY TCP4 203.0.113.7 10.0.0.1 56324 443\r\n", "203.0.113.7:56324", true},
+		{"PROXY TCP6 2001:db8::7 2001:db8::1 56324 443\r\n", "[2001:db8::7]:56324", true},
+		{"PROXY UNKNOWN\r\n", "", true},
+		{"PROXY TCP4 203.0.113.7 10.0.0.1 56324\r\n", "", false},
+		{"PROXY UDP4 203.0.113.7 10.0.0.1 56324 443\r\n", "", false},
+		{"PROXY TCP4 not-an-ip 10.0.0.1 56324 443\r\n", "", false},
+		{"PROXY TCP4 203.0.113.7 10.0.0.1 99999 443\r\n", "", false},
+		{"PROXY TCP4 203.0.113.7 10.0.0.1 56324 443\n", "", false},
+		{"PROXY " + strings.Repeat("x", 120) + "\r\n", "", false},
+		{"GET / HTTP/1.1\r\n", "", false},
+	} {
+		addr, err := readProxyHeader(bufio.NewReader(strings.NewReader(tc.header + "GET / HTTP/1.1\r\n")))
+		if (err == nil) != tc.ok {
+			t.Errorf("%q: error %v, want success %v", tc.header, err, tc.ok)
+			continue
+		}
+		got := ""
+		if addr != nil {
+			got = addr.String()
+		}
+		if got != tc.want {
+			t.Errorf("%q: address %q, want %q", tc.header, got, tc.want)
+		}
+	}
+}
+
+func TestReadProxyV2(t *testing.T) {
+	header := func(command, family byte, addrs []byte) []byte {
+		h := append([]byte{}, proxyV2Signature...)
+		h = append(h, 0x20|command, family<<4|1)
+		h = binary.BigEndian.AppendUint16(h, uint16(len(addrs)))
+		return append(h, addrs...)
+	}
+	//Source 203.0.113.7:56324, destination 10.0.0.1:443
+	tcp4 := []byte{203, 0, 113, 7, 10, 0, 0, 1, 0xdc, 0x04, 0x01, 0xbb}
+
+	for _, tc := range []struct {
+		name   string
+		header []byte
+		want   string
+	}{
+		{"proxy tcp4", header(1, 1, tcp4), "203.0.113.7:56324"},
+		{"local", header(0, 1, tcp4), ""},
+		{"unix", header(1, 3, make([]byte, 216)), ""},
+	} {
+		r := bufio.NewReader(strings.NewReader(string(tc.header) + "GET / HTTP/1.1\r\n"))
+		addr, err := readProxyHeader(r)
+		if err != nil {
+			t.Errorf("%s: %v", tc.name, err)
+			continue
+		}
+		got := ""
+		if addr != nil {
+			got = addr.String()
+		}
+		if got != tc.want {
+			t.Errorf("%s: address %q, want %q", tc.name, got, tc.want)
+		}
+		//The request behind the header is left for the HTTP server
+		if rest, _ := io.ReadAll(r); string(rest) != "GET / HTTP/1.1\r\n" {
+			t.Errorf("%s: %q left after the header", tc.name, rest)
+		}
+	}
+}
+
+func TestProxyProtoListenerRecoversClientIP(t *testing.T) {
+	l := newTestLB(t, newTestServer(t, headersHandler).URL)
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := &http.Server{Handler: l}
+	go srv.Serve(&proxyProtoListener{Listener: ln})
+	defer srv.Close()
+
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	io.WriteString(conn, "PROXY TCP4 203.0.113.7 10.0.0.1 56324 80\r\nGET / HTTP/1.1\r\nHost: lb\r\nConnection: close\r\n\r\n")
+
+	resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var h http.Header
+	if err := json.NewDecoder(resp.Body).Decode(&h); err != nil {
+		t.Fatal(err)
+	}
+	if got := h.Get("X-Real-IP"); got != "203.0.113.7" {
+		t.Fatalf("backend saw client %q, want the address from the PROXY header", got)
+	}
+}
+
+func TestProxyProtoListenerRejectsPlainTraffic(t *testing.T) {
+	l := newTestLB(t, newTestServer(t, nameHandler("ok")).URL)
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := &http.Server{Handler: l}
+	go srv.Serve(&proxyProtoListener{Listener: ln})
+	defer srv.Close()
+
+	if resp, err := http.Get("http://" + ln.Addr().String()); err == nil {
+		resp.Body.Close()
+		t.Fatalf("request without a PROXY header answered %d", resp.StatusCode)
+	}
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestRateLimitAnswers429(t *testing.T) {
+	var hits atomic.Int64
+	srv := newTestServer(t, countingHandler(&hits))
+	l := newTestLB(t, srv.URL)
+	l.limiter = newRateLimiter(1, 3)
+
+	var limited int
+	for range 10 {
+		if get(l, "/").Code == http.StatusTooManyRequests {
+			limited++
+		}
+	}
+	if limited != 7 || hits.Load() != 3 {
+		t.Fatalf("%d of 10 requests limited and %d proxied, want 7 and 3 with a burst of 3", limited, hits.Load())
+	}
+
+	//Other clients have buckets of their own
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.RemoteAddr = "198.51.100.1:1234"
+	if rec := serve(l, req); rec.Code != http.StatusOK {
+		t.Fatalf("other client: status = %d, want 200", rec.Code)
+	}
+}
+
+func TestRateLimiterRefillsAndEvicts(t *testing.T) {
+	rl := newRateLimiter(50, 1)
+	if !rl.allow("a") || rl.allow("a") {
+		t.Fatal("burst of 1 not enforced")
+	}
+	time.Sleep(30 * time.Millisecond)
+	if !rl.allow("a") {
+		t.Fatal("bucket did not refill")
+	}
+
+	time.Sleep(30 * time.Millisecond)
+	rl.evict()
+	if n := len(rl.buckets); n != 0 {
+		t.Fatalf("%d buckets left after eviction, want 0", n)
+	}
+}
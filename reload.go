@@ -0,0 +1,137 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"maps"
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// reload swaps the backends of every pool for the ones described by
+// cfg. Backends whose URL and settings are unchanged keep their health
+// state and in-flight counts; new ones get a fresh proxy and are
+// health-checked before they join the pool; removed ones are drained in
+// the background. Pools and routes themselves are fixed at startup.
+func (l *LoadBalancer) reload(cfg *Config) error {
+	//Build everything first so an invalid backend leaves all pools as is
+	next := map[*pool][]BackendConfig{&l.pool: cfg.Backends}
+	for name, pc := range cfg.Pools {
+		p := l.pools[name]
+		if p == nil {
+			slog.Warn("New pool ignored, pools change only on restart", "event", "reload", "pool", name)
+			continue
+		}
+		next[p] = pc.Backends
+	}
+	for name := range l.pools {
+		if _, ok := cfg.Pools[name]; !ok {
+			slog.Warn("Removed pool kept, pools change only on restart", "event", "reload", "pool", name)
+		}
+	}
+
+	built := make(map[*pool][]*BackEnd, len(next))
+	for p, backends := range next {
+		var bs []*BackEnd
+		for _, bc := range backends {
+			b, err := newBackEnd(bc, l.backendOpts)
+			if err != nil {
+				return err
+			}
+			bs = append(bs, b)
+		}
+		built[p] = bs
+	}
+
+	for _, p := range l.allPools() {
+		if bs, ok := built[p]; ok {
+			l.reloadPool(p, bs)
+		}
+	}
+	return nil
+}
+
+func (l *LoadBalancer) reloadPool(p *pool, backends []*BackEnd) {
+	current := make(map[string]*BackEnd)
+	for _, b := range p.snapshot() {
+		current[b.url.String()] = b
+	}
+
+	var next []*BackEnd
+	var added, kept int
+	seen := make(map[string]bool)
+	for _, b := range backends {
+		key := b.url.String()
+		if seen[key] {
+			continue
+		}
+		seen[key] = true
+
+		if old, ok := current[key]; ok && old.sameSettings(b) {
+			next = append(next, old)
+			delete(current, key)
+			kept++
+			continue
+		}
+
+		l.checkHealth(context.Background(), b, p.healthOpts)
+		next = append(next, b)
+		added++
+	}
+
+	p.mux.Lock()
+	p.backends = next
+	for _, b := range current {
+		p.forget(b)
+	}
+	p.mux.Unlock()
+
+	//Whatever is left in current is no longer part of the pool
+	for _, b := range current {
+		b.draining.Store(true)
+		go func(b *BackEnd) {
+			waitDrained(context.Background(), b)
+			slog.Info("Removed server drained", "event", "backend_removed", "pool", p.name, "backend", b.url.String())
+		}(b)
+	}
+
+	slog.Info("Configuration reloaded", "event", "reload", "pool", p.name, "added", added, "removed", len(current), "kept", kept)
+}
+
+// sameSettings reports whether o was built from the same backend settings.
+func (b *BackEnd) sameSettings(o *BackEnd) bool {
+	return b.url.String() == o.url.String() &&
+		b.weight == o.weight &&
+		b.maxConns == o.maxConns &&
+		b.stripPrefix == o.stripPrefix &&
+		b.keepAliveOff == o.keepAliveOff &&
+		b.timeout == o.timeout &&
+		maps.Equal(b.tags, o.tags) &&
+		b.health.equal(o.health)
+}
+
+// reloadOnSIGHUP re-reads the config file at path on every SIGHUP until
+// ctx is cancelled. An invalid file is logged and the pool left as is.
+func (l *LoadBalancer) reloadOnSIGHUP(ctx context.Context, path string) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-hup:
+		}
+
+		cfg, err := loadConfig(path)
+		if err != nil {
+			slog.Error("Configuration reload failed", "event", "reload", "error", err)
+			continue
+		}
+		if err := l.reload(cfg); err != nil {
+			slog.Error("Configuration reload failed", "event", "reload", "error", err)
+		}
+	}
+}
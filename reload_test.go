@@ -0,0 +1,59 @@
+package main
+
+import "testing"
+
+func TestReloadKeepsUnchangedBackends(t *testing.T) {
+	a := newTestServer(t, nameHandler("a"))
+	b := newTestServer(t, nameHandler("b"))
+	c := newTestServer(t, nameHandler("c"))
+	l := newTestLB(t, a.URL, b.URL)
+	old := l.snapshot()
+	old[0].served.Store(7)
+
+	cfg := &Config{Backends: []BackendConfig{{URL: a.URL}, {URL: c.URL}}}
+	if err := l.reload(cfg); err != nil {
+		t.Fatal(err)
+	}
+
+	now := l.snapshot()
+	if len(now) != 2 {
+		t.Fatalf("%d backends after reload, want 2", len(now))
+	}
+	if now[0] != old[0] || now[0].served.Load() != 7 {
+		t.Error("unchanged backend was rebuilt")
+	}
+	if now[1].url.String() != c.URL || !now[1].isAlive() {
+		t.Errorf("added backend %s alive=%v, want it health-checked before joining", now[1].url, now[1].isAlive())
+	}
+	if !old[1].draining.Load() {
+		t.Error("removed backend is not draining")
+	}
+}
+
+func TestReloadRebuildsChangedBackends(t *testing.T) {
+	a := newTestServer(t, nameHandler("a"))
+	l := newTestLB(t, a.URL)
+	old := l.snapshot()[0]
+
+	cfg := &Config{Backends: []BackendConfig{{URL: a.URL, Weight: ptr(5)}}}
+	if err := l.reload(cfg); err != nil {
+		t.Fatal(err)
+	}
+	if b := l.snapshot()[0]; b == old || b.weight != 5 {
+		t.Fatalf("backend with a new weight kept its old settings")
+	}
+}
+
+func TestReloadInvalidConfigLeavesPool(t *testing.T) {
+	a := newTestServer(t, nameHandler("a"))
+	l := newTestLB(t, a.URL)
+	old := l.snapshot()
+
+	cfg := &Config{Backends: []BackendConfig{{URL: a.URL}, {URL: "://bad"}}}
+	if err := l.reload(cfg); err == nil {
+		t.Fatal("reload accepted an invalid URL")
+	}
+	if now := l.snapshot(); len(now) != 1 || now[0] != old[0] {
+		t.Fatal("failed reload changed the pool")
+	}
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+)
+
+// limitResponse enforces max on the body of resp. A declared length over
+// max fails before anything reaches the client, so it can still get a
+// 502; a body that only turns out too large while streaming is cut off.
+func limitResponse(resp *http.Response, max int64, backend string) error {
+	if resp.ContentLength > max {
+		return fmt.Errorf("%w: %d bytes", errResponseTooLarge, resp.ContentLength)
+	}
+	resp.Body = &limitedBody{ReadCloser: resp.Body, remaining: max, max: max, backend: backend, att: proxyAttemptFrom(resp.Request)}
+	return nil
+}
+
+// limitedBody fails reads once more than max bytes have come through,
+// which makes the reverse proxy abort the client connection. The attempt,
+// if any, learns why so the breaker doesn't hold it against the backend.
+type limitedBody struct {
+	io.ReadCloser
+	remaining int64
+	max       int64
+	backend   string
+	att       *proxyAttempt
+}
+
+func (l *limitedBody) Read(p []byte) (int, error) {
+	if l.remaining < 0 {
+		return 0, errResponseTooLarge
+	}
+	//Ask for one byte past the limit to tell an exact fit from an overflow
+	if int64(len(p)) > l.remaining+1 {
+		p = p[:l.remaining+1]
+	}
+	n, err := l.ReadCloser.Read(p)
+	l.remaining -= int64(n)
+	if l.remaining < 0 {
+		slog.Warn("Upstream response too large, truncating", "event", "response_too_large", "backend", l.backend, "limit", l.max)
+		if l.att != nil {
+			l.att.err = errResponseTooLarge
+		}
+		return n + int(l.remaining), errResponseTooLarge
+	}
+	return n, err
+}
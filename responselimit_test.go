@@ -0,0 +1,115 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// sizedHandler answers with ?n= bytes, streamed without a
+// Content-Length when ?stream is set.
+func sizedHandler(w http.ResponseWriter, r *http.Request) {
+	n, _ := strconv.Atoi(r.URL.Query().Get("n"))
+	body := strings.Repeat("x", n)
+	if r.URL.Query().Has("stream") {
+		io.WriteString(w, body[:n/2])
+		w.(http.Flusher).Flush()
+		io.WriteString(w, body[n/2:])
+		return
+	}
+	w.Header().Set("Content-Length", strconv.Itoa(n))
+	io.WriteString(w, body)
+}
+
+func TestMaxResponseBody(t *testing.T) {
+	srv := newTestServer(t, sizedHandler)
+	l := newTestLB(t)
+	l.backendOpts.maxResponseBody = 1000
+	addTestBackends(t, l, srv.URL)
+
+	//A declared length over the limit is caught before anything is sent
+	if rec := get(l, "/?n=1001"); rec.Code != http.StatusBadGateway {
+		t.Fatalf("oversized response: status = %d, want 502", rec.Code)
+	}
+	if rec := get(l, "/?n=1000"); rec.Code != http.StatusOK || rec.Body.Len() != 1000 {
+		t.Fatalf("response at the limit: %d with %d bytes, want it passed through", rec.Code, rec.Body.Len())
+	}
+
+	//A streamed body is cut off at the limit once its headers are out
+	req := httptest.NewRequest(http.MethodGet, "/?n=4000&stream", nil)
+	req = req.WithContext(context.WithValue(req.Context(), http.ServerContextKey, &http.Server{}))
+	rec := httptest.NewRecorder()
+	func() {
+		defer func() { recover() }()
+		l.ServeHTTP(rec, req)
+	}()
+	if rec.Code != http.StatusOK || rec.Body.Len() > 1000 {
+		t.Fatalf("streamed oversized response: %d with %d bytes, want it truncated at 1000", rec.Code, rec.Body.Len())
+	}
+
+	//Unlimited by default
+	plain := newTestLB(t, srv.URL)
+	if rec := get(plain, "/?n=100000"); rec.Code != http.StatusOK || rec.Body.Len() != 100000 {
+		t.Fatalf("without a limit: %d with %d bytes", rec.Code, rec.Body.Len())
+	}
+}
+
+func TestStreamedOversizedResponseIsNotABackendFailure(t *testing.T) {
+	srv := newTestServer(t, sizedHandler)
+	l := newTestLB(t)
+	l.accessLog = true
+	l.backendOpts.maxResponseBody = 1000
+	l.backendOpts.breaker = breakerOptions{threshold: 1, window: time.Minute, cooldown: 20 * time.Millisecond}
+	b := addTestBackends(t, l, srv.URL)[0]
+	logs := captureLogs(t)
+
+	//Open the breaker so the oversized response is the half-open trial
+	failRequest(b.breaker)
+	time.Sleep(30 * time.Millisecond)
+
+	//ReverseProxy only aborts requests that came through an http.Server
+	req := httptest.NewRequest(http.MethodGet, "/big?n=4000&stream", nil)
+	req = req.WithContext(context.WithValue(req.Context(), http.ServerContextKey, &http.Server{}))
+	func() {
+		defer func() {
+			if v := recover(); v != http.ErrAbortHandler {
+				t.Fatalf("recovered %v, want http.ErrAbortHandler", v)
+			}
+		}()
+		l.ServeHTTP(httptest.NewRecorder(), req)
+	}()
+
+	if s := b.breaker.currentState(); s != breakerClosed {
+		t.Fatalf("breaker is %s after a response cut off at the limit, want closed", s)
+	}
+	access := logs.events(t, "access")
+	if len(access) != 1 || access[0]["path"] != "/big" || access[0]["status"] != float64(http.StatusOK) {
+		t.Fatalf("access log = %v, want the aborted request with the status its client saw", access)
+	}
+}
+
+func TestLimitedBody(t *testing.T) {
+	for _, tc := range []struct {
+		size int
+		err  error
+	}{
+		{10, nil},
+		{9, nil},
+		{11, errResponseTooLarge},
+	} {
+		resp := &http.Response{Body: io.NopCloser(strings.NewReader(strings.Repeat("x", tc.size))), ContentLength: -1, Request: httptest.NewRequest(http.MethodGet, "/", nil)}
+		if err := limitResponse(resp, 10, "test"); err != nil {
+			t.Fatal(err)
+		}
+		body, err := io.ReadAll(resp.Body)
+		if !errors.Is(err, tc.err) || len(body) > 10 {
+			t.Errorf("%d byte body: read %d bytes, error %v, want %v", tc.size, len(body), err, tc.err)
+		}
+	}
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"time"
+)
+
+type proxyAttemptKey struct{}
+
+// proxyAttempt carries the outcome of a single proxied try so the
+// reverse proxy ErrorHandler can report failures back to ServeHTTP
+// instead of answering the client directly.
+type proxyAttempt struct {
+	err    error
+	status int
+}
+
+var (
+	errBreakerOpen      = errors.New("circuit breaker open")
+	errBackendSaturated = errors.New("backend at connection limit")
+	errUpstreamTimeout  = errors.New("backend timed out")
+	errResponseTooLarge = errors.New("upstream response too large")
+)
+
+// writeProxyError answers the client after the last attempt failed with
+// err: 504 when the backend timed out, 503 when no backend could take
+// the request and 502 when the backend refused, reset or garbled it.
+// Only the 503 uses the custom unavailable page.
+func writeProxyError(w http.ResponseWriter, err error, page *errorPage) {
+	switch {
+	case errors.Is(err, errUpstreamTimeout), errors.Is(err, context.DeadlineExceeded):
+		http.Error(w, "Gateway Timeout", http.StatusGatewayTimeout)
+	case err == nil, errors.Is(err, errBreakerOpen), errors.Is(err, errBackendSaturated):
+		writeUnavailable(w, page, "Service Unavailable", 0)
+	default:
+		http.Error(w, "Bad Gateway", http.StatusBadGateway)
+	}
+}
+
+func withProxyAttempt(r *http.Request) (*http.Request, *proxyAttempt) {
+	att := &proxyAttempt{}
+	return r.WithContext(context.WithValue(r.Context(), proxyAttemptKey{}, att)), att
+}
+
+func proxyAttemptFrom(r *http.Request) *proxyAttempt {
+	att, _ := r.Context().Value(proxyAttemptKey{}).(*proxyAttempt)
+	return att
+}
+
+// retryable reports whether r may be resent to another backend after
+// it reached one. Only idempotent methods qualify, plus POST and PATCH
+// carrying an Idempotency-Key when idempotencyKey is set.
+func retryable(r *http.Request, idempotencyKey bool) bool {
+	switch r.Method {
+	case http.MethodGet, http.MethodHead, http.MethodPut, http.MethodDelete, http.MethodOptions:
+		return true
+	case http.MethodPost, http.MethodPatch:
+		return idempotencyKey && r.Header.Get("Idempotency-Key") != ""
+	}
+	return false
+}
+
+// notSent reports whether err means the request never left for the
+// backend, which makes another backend safe to try for any method.
+func notSent(err error) bool {
+	return errors.Is(err, errBreakerOpen) || errors.Is(err, errBackendSaturated)
+}
+
+// retryDelay returns the wait before the given retry attempt: base for
+// the first, doubled for each further one.
+func retryDelay(base time.Duration, attempt int) time.Duration {
+	if base <= 0 || attempt < 1 {
+		return 0
+	}
+	return base << min(attempt-1, 16)
+}
+
+// sleepContext waits for d and reports false if ctx ended first.
+func sleepContext(ctx context.Context, d time.Duration) bool {
+	if d <= 0 {
+		return ctx.Err() == nil
+	}
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-ctx.Done():
+		return false
+	case <-t.C:
+		return true
+	}
+}
+
+// bufferBody reads the request body into memory so it can be replayed
+// against another backend. A nil slice means the request has no body.
+func bufferBody(r *http.Request) ([]byte, error) {
+	if r.Body == nil || r.Body == http.NoBody {
+		return nil, nil
+	}
+	defer r.Body.Close()
+	return io.ReadAll(r.Body)
+}
+
+func rewindBody(r *http.Request, body []byte) {
+	if body == nil {
+		return
+	}
+	r.Body = io.NopCloser(bytes.NewReader(body))
+}
+
+// without returns backends minus b, leaving the original slice untouched.
+func without(backends []*BackEnd, b *BackEnd) []*BackEnd {
+	out := make([]*BackEnd, 0, len(backends))
+	for _, other := range backends {
+		if other != b {
+			out = append(out, other)
+		}
+	}
+	return out
+}
@@ -0,0 +1,340 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// deadURL returns the URL of a server that has already been shut down,
+// so connections to it are refused.
+func deadURL(t *testing.T) string {
+	t.Helper()
+	s := httptest.NewServer(http.NotFoundHandler())
+	s.Close()
+	return s.URL
+}
+
+func TestRetryOnDeadBackend(t *testing.T) {
+	live := newTestServer(t, nameHandler("live"))
+	l := newTestLB(t, deadURL(t), live.URL)
+	l.maxRetries = 1
+
+	for i := range 4 {
+		rec := get(l, "/")
+		if rec.Code != http.StatusOK || rec.Body.String() != "live" {
+			t.Fatalf("request %d: %d %q, want 200 from the live backend", i, rec.Code, rec.Body)
+		}
+	}
+}
+
+func TestNoRetryWithoutMaxRetries(t *testing.T) {
+	live := newTestServer(t, nameHandler("live"))
+	l := newTestLB(t, deadURL(t), live.URL)
+
+	var failed int
+	for range 4 {
+		if get(l, "/").Code == http.StatusBadGateway {
+			failed++
+		}
+	}
+	if failed == 0 {
+		t.Fatal("no request hit the dead backend with retries disabled")
+	}
+}
+
+// inOrderStrategy picks the first available backend, so retries walk the
+// backends in the order they were added.
+type inOrderStrategy struct{}
+
+func (inOrderStrategy) Pick(backends []*BackEnd, r *http.Request) *BackEnd {
+	for _, b := range backends {
+		if b.isAvailable() {
+			return b
+		}
+	}
+	return nil
+}
+
+func TestRetryBackoffReachesHealthyBackend(t *testing.T) {
+	live := newTestServer(t, nameHandler("live"))
+	l := newTestLB(t, deadURL(t), deadURL(t), live.URL)
+	l.strategy = inOrderStrategy{}
+	l.maxRetries = 2
+	l.retryBackoff = 20 * time.Millisecond
+	l.accessLog = true
+	logs := captureLogs(t)
+
+	start := time.Now()
+	rec := get(l, "/")
+	if rec.Code != http.StatusOK || rec.Body.String() != "live" {
+		t.Fatalf("%d %q, want 200 from the live backend after 2 retries", rec.Code, rec.Body)
+	}
+	//20ms before the first retry and 40ms before the second
+	if d := time.Since(start); d < 60*time.Millisecond {
+		t.Errorf("request took %v, want at least 60ms of backoff", d)
+	}
+	access := logs.events(t, "access")
+	if len(access) != 1 || access[0]["retries"] != float64(2) {
+		t.Fatalf("access log = %v, want one entry with 2 retries", access)
+	}
+
+	//One retry short of the live backend fails
+	l.maxRetries = 1
+	if rec := get(l, "/"); rec.Code != http.StatusBadGateway {
+		t.Fatalf("status = %d with max retries 1, want 502", rec.Code)
+	}
+}
+
+func TestRetryDelay(t *testing.T) {
+	var got []time.Duration
+	for attempt := range 5 {
+		got = append(got, retryDelay(10*time.Millisecond, attempt))
+	}
+	want := []time.Duration{0, 10 * time.Millisecond, 20 * time.Millisecond, 40 * time.Millisecond, 80 * time.Millisecond}
+	if !slices.Equal(got, want) {
+		t.Fatalf("delays = %v, want %v", got, want)
+	}
+	if d := retryDelay(0, 3); d != 0 {
+		t.Fatalf("delay without a base = %v, want 0", d)
+	}
+}
+
+func TestRetryOnlyIdempotentRequests(t *testing.T) {
+	var resets, served atomic.Int64
+	broken := newTestServer(t, func(w http.ResponseWriter, r *http.Request) {
+		resets.Add(1)
+		resetHandler(w, r)
+	})
+	live := newTestServer(t, func(w http.ResponseWriter, r *http.Request) {
+		served.Add(1)
+		echoBodyHandler(w, r)
+	})
+	l := newTestLB(t, broken.URL, live.URL)
+	l.strategy = inOrderStrategy{}
+	l.maxRetries = 1
+	logs := captureLogs(t)
+
+	for _, tc := range []struct {
+		method   string
+		key      bool
+		idemKey  bool
+		want     int
+		logEvent string
+	}{
+		{http.MethodGet, false, false, http.StatusOK, "proxy_retry"},
+		{http.MethodPut, false, false, http.StatusOK, "proxy_retry"},
+		{http.MethodPost, false, false, http.StatusBadGateway, "proxy_no_retry"},
+		{http.MethodPost, true, false, http.StatusBadGateway, "proxy_no_retry"},
+		{http.MethodPost, false, true, http.StatusBadGateway, "proxy_no_retry"},
+		{http.MethodPost, true, true, http.StatusOK, "proxy_retry"},
+	} {
+		l.retryIdemKey = tc.idemKey
+		resets.Store(0)
+		served.Store(0)
+		before := len(logs.events(t, tc.logEvent))
+
+		req := httptest.NewRequest(tc.method, "/", strings.NewReader("payload"))
+		if tc.key {
+			req.Header.Set("Idempotency-Key", "order-1")
+		}
+		rec := serve(l, req)
+		if rec.Code != tc.want {
+			t.Errorf("%s, key %v, -retry-idempotency-key %v: status = %d, want %d", tc.method, tc.key, tc.idemKey, rec.Code, tc.want)
+		}
+		wantServed := int64(0)
+		if tc.want == http.StatusOK {
+			wantServed = 1
+			if rec.Body.String() != "payload" {
+				t.Errorf("%s: retried with body %q", tc.method, rec.Body)
+			}
+		}
+		if resets.Load() != 1 || served.Load() != wantServed {
+			t.Errorf("%s, key %v: broken backend hit %d times, live one %d, want 1 and %d", tc.method, tc.key, resets.Load(), served.Load(), wantServed)
+		}
+		if len(logs.events(t, tc.logEvent)) != before+1 {
+			t.Errorf("%s, key %v: no %s event logged", tc.method, tc.key, tc.logEvent)
+		}
+	}
+}
+
+func TestRequestTimeoutAnswers504(t *testing.T) {
+	release := make(chan struct{})
+	cancelled := make(chan struct{})
+	slow := newTestServer(t, func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-release:
+		case <-r.Context().Done():
+			close(cancelled)
+		}
+	})
+	defer close(release)
+
+	l := newTestLB(t, slow.URL)
+	l.requestTimeout = 50 * time.Millisecond
+	b := l.snapshot()[0]
+
+	start := time.Now()
+	if rec := get(l, "/"); rec.Code != http.StatusGatewayTimeout {
+		t.Fatalf("status = %d, want 504", rec.Code)
+	}
+	if d := time.Since(start); d > time.Second {
+		t.Errorf("request took %v with a 50ms timeout", d)
+	}
+	if n := b.activeConns(); n != 0 {
+		t.Errorf("backend still counts %d in-flight requests", n)
+	}
+	select {
+	case <-cancelled:
+	case <-time.After(time.Second):
+		t.Error("upstream request was not cancelled")
+	}
+}
+
+func TestPerBackendTimeout(t *testing.T) {
+	slow := func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-time.After(150 * time.Millisecond):
+			io.WriteString(w, "reports")
+		case <-r.Context().Done():
+		}
+	}
+	l := newTestLB(t)
+	l.requestTimeout = 50 * time.Millisecond
+	api := newTestBackEnd(t, BackendConfig{URL: newTestServer(t, slow).URL}, l.backendOpts)
+	reports := newTestBackEnd(t, BackendConfig{URL: newTestServer(t, slow).URL, Timeout: Duration(time.Second)}, l.backendOpts)
+	for _, b := range []*BackEnd{api, reports} {
+		if err := l.addBackend(b); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if d := l.timeoutFor(api); d != 50*time.Millisecond {
+		t.Errorf("backend without a timeout got %v, want the global 50ms", d)
+	}
+	if d := l.timeoutFor(reports); d != time.Second {
+		t.Errorf("backend with its own timeout got %v, want 1s", d)
+	}
+
+	//Round-robin alternates, so each backend answers half the requests
+	codes := map[int]int{}
+	for range 4 {
+		rec := get(l, "/")
+		codes[rec.Code]++
+		if rec.Code == http.StatusOK && rec.Body.String() != "reports" {
+			t.Fatalf("body = %q", rec.Body)
+		}
+	}
+	if codes[http.StatusOK] != 2 || codes[http.StatusGatewayTimeout] != 2 {
+		t.Fatalf("status counts = %v, want 2 timeouts from the 50ms backend and 2 answers from the 1s one", codes)
+	}
+}
+
+func TestProxyErrorStatusCodes(t *testing.T) {
+	hang := func(w http.ResponseWriter, r *http.Request) { <-r.Context().Done() }
+	for _, tc := range []struct {
+		name  string
+		setup func(l *LoadBalancer)
+		want  int
+	}{
+		{"connection refused", func(l *LoadBalancer) {
+			addTestBackends(t, l, deadURL(t))
+		}, http.StatusBadGateway},
+		{"connection reset", func(l *LoadBalancer) {
+			addTestBackends(t, l, newTestServer(t, resetHandler).URL)
+		}, http.StatusBadGateway},
+		{"deadline exceeded", func(l *LoadBalancer) {
+			l.requestTimeout = 20 * time.Millisecond
+			addTestBackends(t, l, newTestServer(t, hang).URL)
+		}, http.StatusGatewayTimeout},
+		{"no healthy backend", func(l *LoadBalancer) {
+			addTestBackends(t, l, newTestServer(t, nameHandler("ok")).URL)[0].setAlive(false)
+		}, http.StatusServiceUnavailable},
+		{"empty pool", func(l *LoadBalancer) {}, http.StatusServiceUnavailable},
+	} {
+		l := newTestLB(t)
+		tc.setup(l)
+		if rec := get(l, "/"); rec.Code != tc.want {
+			t.Errorf("%s: status = %d, want %d", tc.name, rec.Code, tc.want)
+		}
+	}
+}
+
+func TestWriteProxyError(t *testing.T) {
+	for _, tc := range []struct {
+		err  error
+		want int
+	}{
+		{errUpstreamTimeout, http.StatusGatewayTimeout},
+		{context.DeadlineExceeded, http.StatusGatewayTimeout},
+		{errBreakerOpen, http.StatusServiceUnavailable},
+		{errBackendSaturated, http.StatusServiceUnavailable},
+		{nil, http.StatusServiceUnavailable},
+		{errResponseTooLarge, http.StatusBadGateway},
+		{io.ErrUnexpectedEOF, http.StatusBadGateway},
+	} {
+		rec := httptest.NewRecorder()
+		writeProxyError(rec, tc.err, nil)
+		if rec.Code != tc.want {
+			t.Errorf("writeProxyError(%v) = %d, want %d", tc.err, rec.Code, tc.want)
+		}
+	}
+}
+
+// echoBodyHandler answers with the request body.
+func echoBodyHandler(w http.ResponseWriter, r *http.Request) {
+	io.Copy(w, r.Body)
+}
+
+func TestRetryReplaysBody(t *testing.T) {
+	live := newTestServer(t, echoBodyHandler)
+	l := newTestLB(t, deadURL(t), live.URL)
+	l.maxRetries = 1
+
+	for i := range 2 {
+		req := httptest.NewRequest(http.MethodPut, "/", strings.NewReader("payload"))
+		rec := serve(l, req)
+		if rec.Code != http.StatusOK || rec.Body.String() != "payload" {
+			t.Fatalf("request %d: %d %q, want the body replayed to the live backend", i, rec.Code, rec.Body)
+		}
+	}
+}
+
+func TestMaxBodyAnswers413(t *testing.T) {
+	var hits atomic.Int64
+	srv := newTestServer(t, func(w http.ResponseWriter, r *http.Request) {
+		hits.Add(1)
+		echoBodyHandler(w, r)
+	})
+
+	for _, retries := range []int{0, 1} {
+		l := newTestLB(t, srv.URL)
+		l.maxBody = 8
+		l.maxRetries = retries
+
+		rec := serve(l, httptest.NewRequest(http.MethodPut, "/", strings.NewReader("small")))
+		if rec.Code != http.StatusOK || rec.Body.String() != "small" {
+			t.Errorf("retries %d, small body: %d %q", retries, rec.Code, rec.Body)
+		}
+
+		before := hits.Load()
+		if rec := serve(l, httptest.NewRequest(http.MethodPut, "/", strings.NewReader("far too large"))); rec.Code != http.StatusRequestEntityTooLarge {
+			t.Errorf("retries %d, declared length: status = %d, want 413", retries, rec.Code)
+		}
+		if hits.Load() != before {
+			t.Errorf("retries %d: oversized body with a declared length reached the backend", retries)
+		}
+
+		//Without a Content-Length the limit only shows while reading
+		req := httptest.NewRequest(http.MethodPut, "/", io.MultiReader(strings.NewReader("far too large")))
+		req.ContentLength = -1
+		if rec := serve(l, req); rec.Code != http.StatusRequestEntityTooLarge {
+			t.Errorf("retries %d, chunked: status = %d, want 413", retries, rec.Code)
+		}
+	}
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// StatusCodes is a set of HTTP status codes written as a single code,
+// a range such as "200-299", or a list of either, e.g. [200, 204] or
+// "200-299,304".
+type StatusCodes []statusRange
+
+type statusRange struct {
+	lo, hi int
+}
+
+func (s *StatusCodes) UnmarshalYAML(n *yaml.Node) error {
+	var items []string
+	switch {
+	case n.Tag == "!!null":
+		return nil
+	case n.Kind == yaml.SequenceNode:
+		if err := n.Decode(&items); err != nil {
+			return err
+		}
+	default:
+		items = strings.Split(n.Value, ",")
+	}
+	return s.parse(items)
+}
+
+func (s *StatusCodes) UnmarshalJSON(data []byte) error {
+	var raw []json.RawMessage
+	if err := json.Unmarshal(data, &raw); err != nil {
+		raw = []json.RawMessage{data}
+	}
+
+	var items []string
+	for _, r := range raw {
+		var v any
+		if err := json.Unmarshal(r, &v); err != nil {
+			return err
+		}
+		switch v := v.(type) {
+		case float64:
+			items = append(items, strconv.FormatFloat(v, 'f', -1, 64))
+		case string:
+			items = append(items, strings.Split(v, ",")...)
+		default:
+			return fmt.Errorf("status codes must be numbers or strings such as \"200-299\"")
+		}
+	}
+	return s.parse(items)
+}
+
+func (s *StatusCodes) parse(items []string) error {
+	codes := make(StatusCodes, 0, len(items))
+	for _, item := range items {
+		item = strings.TrimSpace(item)
+		lo, hi, isRange := strings.Cut(item, "-")
+		if !isRange {
+			hi = lo
+		}
+		r, err := parseStatusRange(lo, hi)
+		if err != nil {
+			return fmt.Errorf("invalid status code %q: %w", item, err)
+		}
+		codes = append(codes, r)
+	}
+	*s = codes
+	return nil
+}
+
+func parseStatusRange(lo, hi string) (statusRange, error) {
+	var r statusRange
+	var err error
+	if r.lo, err = strconv.Atoi(strings.TrimSpace(lo)); err != nil {
+		return r, err
+	}
+	if r.hi, err = strconv.Atoi(strings.TrimSpace(hi)); err != nil {
+		return r, err
+	}
+	if r.lo < 100 || r.hi > 599 {
+		return r, fmt.Errorf("must be within 100-599")
+	}
+	if r.lo > r.hi {
+		return r, fmt.Errorf("range start is above its end")
+	}
+	return r, nil
+}
+
+// contains reports whether code is one of s.
+func (s StatusCodes) contains(code int) bool {
+	for _, r := range s {
+		if code >= r.lo && code <= r.hi {
+			return true
+		}
+	}
+	return false
+}
+
+func (s StatusCodes) String() string {
+	parts := make([]string, len(s))
+	for i, r := range s {
+		if r.lo == r.hi {
+			parts[i] = strconv.Itoa(r.lo)
+		} else {
+			parts[i] = fmt.Sprintf("%d-%d", r.lo, r.hi)
+		}
+	}
+	return strings.Join(parts, ",")
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+)
+
+// statusHandler answers every request with code.
+func statusHandler(code int) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(code)
+	}
+}
+
+func TestHealthStatusRange(t *testing.T) {
+	noContent := newTestServer(t, statusHandler(http.StatusNoContent))
+	failing := newTestServer(t, statusHandler(http.StatusInternalServerError))
+	cfg, err := loadConfig(writeConfig(t, fmt.Sprintf(`
+backends:
+  - url: %s
+    health_status: 200-299
+  - url: %s
+    health_status: 200-299
+`, noContent.URL, failing.URL)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i, want := range []bool{true, false} {
+		b := newTestBackEnd(t, cfg.Backends[i], backendOptions{})
+		if got := b.isBackendAlive(context.Background(), time.Second); got != want {
+			t.Errorf("%s: alive = %v, want %v under 200-299", b.url, got, want)
+		}
+	}
+
+	//Without a setting 2xx still passes
+	b := newTestBackEnd(t, BackendConfig{URL: noContent.URL}, backendOptions{})
+	if !b.isBackendAlive(context.Background(), time.Second) {
+		t.Error("204 failed the default health check")
+	}
+}
+
+func TestParseStatusCodes(t *testing.T) {
+	for _, tc := range []struct {
+		yaml string
+		want string
+		in   []int
+		out  []int
+	}{
+		{"200-299", "200-299", []int{200, 204, 299}, []int{199, 300, 500}},
+		{"200,204", "200,204", []int{200, 204}, []int{201, 500}},
+		{"[200, 301-302]", "200,301-302", []int{200, 301, 302}, []int{303}},
+	} {
+		cfg, err := loadConfig(writeConfig(t, "backends:\n  - url: http://a\n    health_status: "+tc.yaml+"\n"))
+		if err != nil {
+			t.Errorf("%s: %v", tc.yaml, err)
+			continue
+		}
+		codes := cfg.Backends[0].HealthStatus
+		if codes.String() != tc.want {
+			t.Errorf("%s parsed as %s, want %s", tc.yaml, codes, tc.want)
+		}
+		for _, c := range tc.in {
+			if !codes.contains(c) {
+				t.Errorf("%s does not contain %d", tc.yaml, c)
+			}
+		}
+		for _, c := range tc.out {
+			if codes.contains(c) {
+				t.Errorf("%s contains %d", tc.yaml, c)
+			}
+		}
+	}
+
+	for _, bad := range []string{"299-200", "200-", "ok", "600", "99-200"} {
+		if _, err := loadConfig(writeConfig(t, "backends:\n  - url: http://a\n    health_status: "+bad+"\n")); err == nil {
+			t.Errorf("loadConfig accepted health_status %q", bad)
+		}
+	}
+
+	var codes StatusCodes
+	if err := json.Unmarshal([]byte(`[200, "300-399"]`), &codes); err != nil || codes.String() != "200,300-399" {
+		t.Errorf("JSON list parsed as %s, %v", codes, err)
+	}
+	if err := json.Unmarshal([]byte(`"204"`), &codes); err != nil || codes.String() != "204" {
+		t.Errorf("JSON string parsed as %s, %v", codes, err)
+	}
+}
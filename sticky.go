@@ -0,0 +1,59 @@
+package main
+
+import (
+	"fmt"
+	"hash/fnv"
+	"net/http"
+)
+
+// StickyStrategy routes clients carrying a session cookie back to the
+// backend named in it and defers to Next for everyone else, or when the
+// pinned backend is unavailable.
+type StickyStrategy struct {
+	Cookie string
+	Next   Strategy
+}
+
+func (s *StickyStrategy) Pick(backends []*BackEnd, r *http.Request) *BackEnd {
+	if c, err := r.Cookie(s.Cookie); err == nil {
+		for _, b := range backends {
+			if b.id == c.Value && b.isAvailable() {
+				return b
+			}
+		}
+	}
+
+	return s.Next.Pick(backends, r)
+}
+
+func (s *StickyStrategy) forget(b *BackEnd) {
+	if f, ok := s.Next.(backendForgetter); ok {
+		f.forget(b)
+	}
+}
+
+// backendID derives a stable identifier from the backend URL so cookies
+// survive restarts without exposing internal addresses.
+func backendID(rawURL string) string {
+	h := fnv.New64a()
+	h.Write([]byte(rawURL))
+	return fmt.Sprintf("%016x", h.Sum64())
+}
+
+// setStickyCookie pins the client to b unless it already is.
+func setStickyCookie(w http.ResponseWriter, r *http.Request, name string, b *BackEnd) {
+	if c, err := r.Cookie(name); err == nil && c.Value == b.id {
+		return
+	}
+
+	//Drop the cookie set for a backend that failed on a previous attempt
+	w.Header().Del("Set-Cookie")
+	http.SetCookie(w, &http.Cookie{
+		Name:     name,
+		Value:    b.id,
+		Path:     "/",
+		HttpOnly: true,
+		Secure:   r.TLS != nil,
+		SameSite: http.SameSiteLaxMode,
+	})
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// newStickyLB returns a round-robin load balancer with sticky sessions
+// over one backend per name.
+func newStickyLB(t *testing.T, names ...string) (*LoadBalancer, []*BackEnd) {
+	t.Helper()
+	l := newTestLB(t)
+	l.stickyCookie = "lb_backend"
+	l.strategy = &StickyStrategy{Cookie: l.stickyCookie, Next: &RoundRobinStrategy{}}
+	var backends []*BackEnd
+	for _, name := range names {
+		backends = append(backends, addTestBackends(t, l, newTestServer(t, nameHandler(name)).URL)...)
+	}
+	return l, backends
+}
+
+// stickyCookie returns the session cookie set on rec, nil when none is.
+func stickyCookie(rec *httptest.ResponseRecorder) *http.Cookie {
+	for _, c := range rec.Result().Cookies() {
+		if c.Name == "lb_backend" {
+			return c
+		}
+	}
+	return nil
+}
+
+func TestStickySessionsPinClient(t *testing.T) {
+	l, _ := newStickyLB(t, "a", "b", "c")
+
+	first := get(l, "/")
+	cookie := stickyCookie(first)
+	if cookie == nil {
+		t.Fatal("first response set no cookie")
+	}
+
+	for range 10 {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.AddCookie(cookie)
+		rec := serve(l, req)
+		if rec.Body.String() != first.Body.String() {
+			t.Fatalf("pinned client reached %q, want %q", rec.Body, first.Body)
+		}
+		if stickyCookie(rec) != nil {
+			t.Fatal("cookie set again for a client that already has it")
+		}
+	}
+}
+
+func TestStickySessionsResetWhenBackendDown(t *testing.T) {
+	l, backends := newStickyLB(t, "a", "b")
+	backends[0].setAlive(false)
+
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.AddCookie(&http.Cookie{Name: "lb_backend", Value: backends[0].id})
+	rec := serve(l, req)
+	if rec.Body.String() != "b" {
+		t.Fatalf("body = %q, want the healthy backend", rec.Body)
+	}
+	if c := stickyCookie(rec); c == nil || c.Value != backends[1].id {
+		t.Fatalf("cookie = %v, want it reset to the new backend", c)
+	}
+}
@@ -0,0 +1,380 @@
+package main
+
+import (
+	"fmt"
+	"hash/fnv"
+	"maps"
+	"math/rand/v2"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// Strategy picks the backend that should serve a request.
+// Implementations must be safe for concurrent use and return nil
+// when no suitable backend is available.
+type Strategy interface {
+	Pick(backends []*BackEnd, r *http.Request) *BackEnd
+}
+
+// backendForgetter is implemented by strategies keeping per-backend
+// state. The pool calls forget once a backend has left it.
+type backendForgetter interface {
+	forget(b *BackEnd)
+}
+
+// defaultStrategy is used by a LoadBalancer that has no strategy set.
+var defaultStrategy Strategy = &RoundRobinStrategy{}
+
+// strategies maps the names accepted by -strategy and the pool strategy
+// setting to their constructors.
+var strategies = map[string]func(ch ConsistentHashConfig) Strategy{
+	"round-robin":         func(ConsistentHashConfig) Strategy { return &RoundRobinStrategy{} },
+	"least-conn":          func(ConsistentHashConfig) Strategy { return &LeastConnectionsStrategy{} },
+	"weighted-least-conn": func(ConsistentHashConfig) Strategy { return &WeightedLeastConnectionsStrategy{} },
+	"weighted":            func(ConsistentHashConfig) Strategy { return &WeightedRoundRobinStrategy{} },
+	"weighted-random":     func(ConsistentHashConfig) Strategy { return &WeightedRandomStrategy{} },
+	"random":              func(ConsistentHashConfig) Strategy { return &RandomStrategy{} },
+	"ip-hash":             func(ch ConsistentHashConfig) Strategy { return &IPHashStrategy{Key: ch.Key} },
+	"power-of-two":        func(ConsistentHashConfig) Strategy { return &PowerOfTwoStrategy{} },
+	"least-latency":       func(ConsistentHashConfig) Strategy { return &LeastLatencyStrategy{} },
+	"consistent-hash": func(ch ConsistentHashConfig) Strategy {
+		return &ConsistentHashStrategy{Key: ch.Key, VirtualNodes: ch.VirtualNodes}
+	},
+}
+
+// newStrategy returns the strategy registered under name, with "" meaning
+// round-robin. ch configures consistent-hash.
+func newStrategy(name string, ch ConsistentHashConfig) (Strategy, error) {
+	if name == "" {
+		name = "round-robin"
+	}
+	newFn, ok := strategies[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown strategy %q, valid strategies are %s", name, strings.Join(slices.Sorted(maps.Keys(strategies)), ", "))
+	}
+	return newFn(ch), nil
+}
+
+// RoundRobinStrategy cycles through the healthy backends in order.
+type RoundRobinStrategy struct {
+	counter uint64
+}
+
+func (s *RoundRobinStrategy) Pick(backends []*BackEnd, r *http.Request) *BackEnd {
+	if len(backends) == 0 {
+		return nil
+	}
+
+	//Setup next index based on current counter
+	next := atomic.AddUint64(&s.counter, uint64(1)) % uint64(len(backends))
+
+	//Find the next healthy backend servers
+	for i := 0; i < len(backends); i++ {
+		idx := (int(next) + i) % len(backends)
+		if backends[idx].isAvailable() {
+			return backends[idx]
+		}
+	}
+
+	return nil
+}
+
+// LeastConnectionsStrategy sends each request to the healthy backend
+// with the fewest in-flight requests. Ties are broken round-robin so
+// idle backends share load evenly.
+type LeastConnectionsStrategy struct {
+	counter uint64
+}
+
+func (s *LeastConnectionsStrategy) Pick(backends []*BackEnd, r *http.Request) *BackEnd {
+	if len(backends) == 0 {
+		return nil
+	}
+
+	//Rotate the starting point so ties don't always go to the first backend
+	start := atomic.AddUint64(&s.counter, uint64(1)) % uint64(len(backends))
+
+	var best *BackEnd
+	var bestConns int64
+	for i := 0; i < len(backends); i++ {
+		b := backends[(int(start)+i)%len(backends)]
+		if !b.isAvailable() {
+			continue
+		}
+
+		conns := b.activeConns()
+		if best == nil || conns < bestConns {
+			best = b
+			bestConns = conns
+		}
+	}
+
+	return best
+}
+
+// WeightedLeastConnectionsStrategy sends each request to the healthy
+// backend with the fewest in-flight requests per unit of weight, so a
+// backend of weight 4 takes four times the concurrent load of a weight 1
+// one before it loses out. Backends with weight 0 never receive traffic.
+type WeightedLeastConnectionsStrategy struct {
+	counter uint64
+}
+
+func (s *WeightedLeastConnectionsStrategy) Pick(backends []*BackEnd, r *http.Request) *BackEnd {
+	if len(backends) == 0 {
+		return nil
+	}
+
+	//Rotate the starting point so ties don't always go to the first backend
+	start := atomic.AddUint64(&s.counter, uint64(1)) % uint64(len(backends))
+
+	var best *BackEnd
+	var bestConns, bestWeight int64
+	for i := 0; i < len(backends); i++ {
+		b := backends[(int(start)+i)%len(backends)]
+		weight := int64(b.effectiveWeight())
+		if weight <= 0 || !b.isAvailable() {
+			continue
+		}
+
+		//conns/weight < bestConns/bestWeight without dividing
+		conns := b.activeConns()
+		if best == nil || conns*bestWeight < bestConns*weight {
+			best = b
+			bestConns = conns
+			bestWeight = weight
+		}
+	}
+
+	return best
+}
+
+// WeightedRoundRobinStrategy implements smooth weighted round-robin
+// (as used by nginx): every pick each healthy backend gains its weight,
+// the one with the highest running total wins and is then reduced by
+// the sum of all weights. Backends with weight 0 never receive traffic
+// and recovering backends ramp up during their slow-start window.
+//
+// The running totals belong to the strategy, so one swapped in via
+// POST /admin/strategy starts afresh instead of sharing them with picks
+// still running on the instance it replaced.
+type WeightedRoundRobinStrategy struct {
+	mux     sync.Mutex
+	current map[*BackEnd]int
+}
+
+func (s *WeightedRoundRobinStrategy) Pick(backends []*BackEnd, r *http.Request) *BackEnd {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	//backends may be only part of the pool, such as its canary subset,
+	//so totals are dropped when a backend leaves the pool, not here
+	if s.current == nil {
+		s.current = make(map[*BackEnd]int, len(backends))
+	}
+
+	var best *BackEnd
+	total := 0
+	for _, b := range backends {
+		weight := b.effectiveWeight()
+		if weight <= 0 || !b.isAvailable() {
+			continue
+		}
+
+		s.current[b] += weight
+		total += weight
+		if best == nil || s.current[b] > s.current[best] {
+			best = b
+		}
+	}
+
+	if best == nil {
+		return nil
+	}
+
+	s.current[best] -= total
+	return best
+}
+
+func (s *WeightedRoundRobinStrategy) forget(b *BackEnd) {
+	s.mux.Lock()
+	delete(s.current, b)
+	s.mux.Unlock()
+}
+
+// RandomStrategy picks a healthy backend uniformly at random.
+type RandomStrategy struct{}
+
+func (s *RandomStrategy) Pick(backends []*BackEnd, r *http.Request) *BackEnd {
+	n := len(backends)
+	if n == 0 {
+		return nil
+	}
+
+	start := rand.IntN(n)
+	for i := 0; i < n; i++ {
+		if b := backends[(start+i)%n]; b.isAvailable() {
+			return b
+		}
+	}
+	return nil
+}
+
+// IPHashStrategy pins each client IP, or the request attribute named by
+// Key (see hashKey), to a backend. The hash is taken over the full
+// backend list, so when the chosen backend is down the request walks
+// forward to the next healthy one and clients of the other backends keep
+// their affinity.
+type IPHashStrategy struct {
+	Key string
+}
+
+func (s *IPHashStrategy) Pick(backends []*BackEnd, r *http.Request) *BackEnd {
+	if len(backends) == 0 {
+		return nil
+	}
+
+	h := fnv.New32a()
+	h.Write([]byte(hashKey(r, s.Key)))
+	start := int(h.Sum32() % uint32(len(backends)))
+
+	for i := 0; i < len(backends); i++ {
+		idx := (start + i) % len(backends)
+		if backends[idx].isAvailable() {
+			return backends[idx]
+		}
+	}
+
+	return nil
+}
+
+// PowerOfTwoStrategy samples two random backends and picks the one with
+// fewer in-flight requests. It needs no shared counter and stays close
+// to least-connections without looking at every backend.
+type PowerOfTwoStrategy struct{}
+
+func (s *PowerOfTwoStrategy) Pick(backends []*BackEnd, r *http.Request) *BackEnd {
+	n := len(backends)
+	if n == 0 {
+		return nil
+	}
+
+	i, j := twoRandom(n)
+	a, b := backends[i], backends[j]
+	switch {
+	case a.isAvailable() && b.isAvailable():
+		if b.activeConns() < a.activeConns() {
+			return b
+		}
+		return a
+	case a.isAvailable():
+		return a
+	case b.isAvailable():
+		return b
+	}
+
+	//Both samples were unhealthy, scan from a random offset instead
+	start := rand.IntN(n)
+	for i := 0; i < n; i++ {
+		if c := backends[(start+i)%n]; c.isAvailable() {
+			return c
+		}
+	}
+	return nil
+}
+
+// twoRandom draws two distinct indexes below n, or the same one twice
+// when n is 1, so a sample never compares a backend with itself.
+func twoRandom(n int) (int, int) {
+	i := rand.IntN(n)
+	if n == 1 {
+		return i, i
+	}
+	j := rand.IntN(n - 1)
+	if j >= i {
+		j++
+	}
+	return i, j
+}
+
+// LeastLatencyStrategy samples two random backends and picks the one
+// with the lower moving average of response latency. Sampling instead
+// of always taking the fastest keeps it from being flooded, and
+// backends without samples yet win so they get measured.
+type LeastLatencyStrategy struct{}
+
+func (s *LeastLatencyStrategy) Pick(backends []*BackEnd, r *http.Request) *BackEnd {
+	n := len(backends)
+	if n == 0 {
+		return nil
+	}
+
+	i, j := twoRandom(n)
+	a, b := backends[i], backends[j]
+	switch {
+	case a.isAvailable() && b.isAvailable():
+		if b.latency.value() < a.latency.value() {
+			return b
+		}
+		return a
+	case a.isAvailable():
+		return a
+	case b.isAvailable():
+		return b
+	}
+
+	//Both samples were unhealthy, scan from a random offset instead
+	start := rand.IntN(n)
+	for i := 0; i < n; i++ {
+		if c := backends[(start+i)%n]; c.isAvailable() {
+			return c
+		}
+	}
+	return nil
+}
+
+// WeightedRandomStrategy picks a healthy backend with probability
+// proportional to its weight using a single draw over the cumulative
+// weights. Unlike WeightedRoundRobinStrategy it keeps no per-backend
+// state.
+//
+// Rand may be set to make picks deterministic; otherwise each instance
+// seeds its own generator on first use.
+type WeightedRandomStrategy struct {
+	Rand *rand.Rand
+
+	mux sync.Mutex
+}
+
+func (s *WeightedRandomStrategy) Pick(backends []*BackEnd, r *http.Request) *BackEnd {
+	candidates := make([]*BackEnd, 0, len(backends))
+	cumulative := make([]int, 0, len(backends))
+	total := 0
+	for _, b := range backends {
+		weight := b.effectiveWeight()
+		if weight <= 0 || !b.isAvailable() {
+			continue
+		}
+
+		total += weight
+		candidates = append(candidates, b)
+		cumulative = append(cumulative, total)
+	}
+
+	if total == 0 {
+		return nil
+	}
+
+	s.mux.Lock()
+	if s.Rand == nil {
+		s.Rand = rand.New(rand.NewPCG(rand.Uint64(), rand.Uint64()))
+	}
+	n := s.Rand.IntN(total)
+	s.mux.Unlock()
+
+	i, _ := slices.BinarySearch(cumulative, n+1)
+	return candidates[i]
+}
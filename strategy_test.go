@@ -0,0 +1,468 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"math/rand/v2"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// fakeBackends returns n alive backends that are never dialled.
+func fakeBackends(t *testing.T, n int) []*BackEnd {
+	t.Helper()
+	backends := make([]*BackEnd, n)
+	for i := range backends {
+		backends[i] = newTestBackEnd(t, BackendConfig{URL: fmt.Sprintf("http://backend-%d", i)}, backendOptions{})
+	}
+	return backends
+}
+
+// ptr returns a pointer to v, for optional config fields.
+func ptr[T any](v T) *T {
+	return &v
+}
+
+// pickCounts picks n times and counts how often each backend won.
+func pickCounts(s Strategy, backends []*BackEnd, n int) map[*BackEnd]int {
+	counts := make(map[*BackEnd]int)
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	for range n {
+		counts[s.Pick(backends, req)]++
+	}
+	return counts
+}
+
+func TestDefaultStrategyIsRoundRobin(t *testing.T) {
+	backends := fakeBackends(t, 3)
+	var p pool
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+
+	//Same order as the original counter-based nextBackend
+	first := p.nextBackend(backends, req)
+	start := -1
+	for i, b := range backends {
+		if b == first {
+			start = i
+		}
+	}
+	for i := 1; i < 9; i++ {
+		want := backends[(start+i)%len(backends)]
+		if got := p.nextBackend(backends, req); got != want {
+			t.Fatalf("pick %d = %s, want %s", i, got.url, want.url)
+		}
+	}
+}
+
+func TestNewStrategy(t *testing.T) {
+	for name, want := range map[string]Strategy{
+		"":                    &RoundRobinStrategy{},
+		"round-robin":         &RoundRobinStrategy{},
+		"least-conn":          &LeastConnectionsStrategy{},
+		"weighted-least-conn": &WeightedLeastConnectionsStrategy{},
+		"weighted":            &WeightedRoundRobinStrategy{},
+		"weighted-random":     &WeightedRandomStrategy{},
+		"random":              &RandomStrategy{},
+		"ip-hash":             &IPHashStrategy{},
+		"power-of-two":        &PowerOfTwoStrategy{},
+		"least-latency":       &LeastLatencyStrategy{},
+		"consistent-hash":     &ConsistentHashStrategy{},
+	} {
+		s, err := newStrategy(name, ConsistentHashConfig{})
+		if err != nil {
+			t.Errorf("newStrategy(%q): %v", name, err)
+			continue
+		}
+		if got, want := fmt.Sprintf("%T", s), fmt.Sprintf("%T", want); got != want {
+			t.Errorf("newStrategy(%q) = %s, want %s", name, got, want)
+		}
+	}
+
+	_, err := newStrategy("fastest", ConsistentHashConfig{})
+	if err == nil || !strings.Contains(err.Error(), "least-conn, least-latency") {
+		t.Fatalf("newStrategy(\"fastest\") error = %v, want one listing the valid strategies", err)
+	}
+}
+
+func TestRoundRobinSkipsDeadBackends(t *testing.T) {
+	backends := fakeBackends(t, 3)
+	backends[1].setAlive(false)
+
+	counts := pickCounts(&RoundRobinStrategy{}, backends, 30)
+	if counts[backends[1]] != 0 {
+		t.Errorf("dead backend picked %d times", counts[backends[1]])
+	}
+	if counts[backends[0]]+counts[backends[2]] != 30 {
+		t.Errorf("counts = %v, want all 30 picks on the live backends", counts)
+	}
+
+	for _, b := range backends {
+		b.setAlive(false)
+	}
+	if b := (&RoundRobinStrategy{}).Pick(backends, httptest.NewRequest(http.MethodGet, "/", nil)); b != nil {
+		t.Errorf("picked %s with every backend dead", b.url)
+	}
+}
+
+func TestLeastConnectionsPicksIdleBackend(t *testing.T) {
+	backends := fakeBackends(t, 3)
+	backends[0].active.Store(5)
+	backends[2].active.Store(2)
+
+	counts := pickCounts(&LeastConnectionsStrategy{}, backends, 10)
+	if counts[backends[1]] != 10 {
+		t.Fatalf("counts = %v, want every pick on the idle backend", counts)
+	}
+}
+
+func TestLeastConnectionsFavorsIdleBackendsUnderLoad(t *testing.T) {
+	var slowHits, fastHits atomic.Int64
+	slow := newTestServer(t, func(w http.ResponseWriter, r *http.Request) {
+		slowHits.Add(1)
+		time.Sleep(50 * time.Millisecond)
+	})
+	fast := newTestServer(t, countingHandler(&fastHits))
+
+	l := newTestLB(t, slow.URL, fast.URL)
+	l.strategy = &LeastConnectionsStrategy{}
+
+	var wg sync.WaitGroup
+	for range 20 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for range 5 {
+				if rec := get(l, "/"); rec.Code != http.StatusOK {
+					t.Errorf("status = %d", rec.Code)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	if slowHits.Load()*2 > fastHits.Load() {
+		t.Fatalf("slow backend got %d requests, fast one %d, want the fast one to get at least twice as many", slowHits.Load(), fastHits.Load())
+	}
+}
+
+func TestWeightedLeastConnectionsPicksBiggerBusierBackend(t *testing.T) {
+	big := newTestBackEnd(t, BackendConfig{URL: "http://big", Weight: ptr(4)}, backendOptions{})
+	small := newTestBackEnd(t, BackendConfig{URL: "http://small", Weight: ptr(1)}, backendOptions{})
+	off := newTestBackEnd(t, BackendConfig{URL: "http://off", Weight: ptr(0)}, backendOptions{})
+	backends := []*BackEnd{big, small, off}
+
+	for _, tc := range []struct {
+		bigConns, smallConns int64
+		want                 *BackEnd
+	}{
+		{3, 1, big},   //3/4 beats 1/1 although big has more in flight
+		{6, 1, small}, //6/4 loses to 1/1
+	} {
+		big.active.Store(tc.bigConns)
+		small.active.Store(tc.smallConns)
+		counts := pickCounts(&WeightedLeastConnectionsStrategy{}, backends, 10)
+		if counts[tc.want] != 10 {
+			t.Errorf("big %d, small %d in flight: picks = big %d, small %d, want every pick on %s",
+				tc.bigConns, tc.smallConns, counts[big], counts[small], tc.want.url.Host)
+		}
+	}
+
+	//Idle backends tie and share picks, the zero-weight one gets none
+	big.active.Store(0)
+	small.active.Store(0)
+	counts := pickCounts(&WeightedLeastConnectionsStrategy{}, backends, 12)
+	if counts[off] != 0 || counts[big] == 0 || counts[small] == 0 {
+		t.Fatalf("idle picks = big %d, small %d, off %d", counts[big], counts[small], counts[off])
+	}
+}
+
+func TestWeightedRoundRobinSplit(t *testing.T) {
+	heavy := newTestBackEnd(t, BackendConfig{URL: "http://heavy", Weight: ptr(3)}, backendOptions{})
+	light := newTestBackEnd(t, BackendConfig{URL: "http://light", Weight: ptr(1)}, backendOptions{})
+	backends := []*BackEnd{heavy, light}
+
+	s := &WeightedRoundRobinStrategy{}
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	var order []string
+	counts := make(map[*BackEnd]int)
+	for range 8 {
+		b := s.Pick(backends, req)
+		counts[b]++
+		order = append(order, b.url.Host)
+	}
+	if counts[heavy] != 6 || counts[light] != 2 {
+		t.Fatalf("picks = %v, want 6 heavy and 2 light", order)
+	}
+	//Smooth: the light backend never goes twice in a row
+	for i := 1; i < len(order); i++ {
+		if order[i] == "light" && order[i-1] == "light" {
+			t.Fatalf("picks = %v, want the light backend spread out", order)
+		}
+	}
+}
+
+func TestWeightedRoundRobinZeroWeight(t *testing.T) {
+	on := newTestBackEnd(t, BackendConfig{URL: "http://on"}, backendOptions{})
+	off := newTestBackEnd(t, BackendConfig{URL: "http://off", Weight: ptr(0)}, backendOptions{})
+
+	counts := pickCounts(&WeightedRoundRobinStrategy{}, []*BackEnd{on, off}, 10)
+	if counts[off] != 0 {
+		t.Fatalf("zero-weight backend picked %d times", counts[off])
+	}
+}
+
+func TestWeightedRoundRobinStatePerInstance(t *testing.T) {
+	heavy := newTestBackEnd(t, BackendConfig{URL: "http://heavy", Weight: ptr(3)}, backendOptions{})
+	light := newTestBackEnd(t, BackendConfig{URL: "http://light", Weight: ptr(1)}, backendOptions{})
+	backends := []*BackEnd{heavy, light}
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	sequence := func(s Strategy, n int) []*BackEnd {
+		var picks []*BackEnd
+		for range n {
+			picks = append(picks, s.Pick(backends, req))
+		}
+		return picks
+	}
+
+	//Advance one instance partway through its cycle
+	old := &WeightedRoundRobinStrategy{}
+	sequence(old, 3)
+
+	//A fresh instance, as swapped in by the admin API, starts from the top
+	want := sequence(&WeightedRoundRobinStrategy{}, 8)
+	if got := sequence(&WeightedRoundRobinStrategy{}, 8); !slices.Equal(got, want) {
+		t.Fatal("two fresh instances picked different sequences")
+	}
+	if got := sequence(old, 8); slices.Equal(got, want) {
+		t.Fatal("an advanced instance picked the same sequence as a fresh one")
+	}
+}
+
+func TestIPHashIsStable(t *testing.T) {
+	backends := fakeBackends(t, 5)
+	s := &IPHashStrategy{}
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.RemoteAddr = "203.0.113.7:5000"
+
+	want := s.Pick(backends, req)
+	for i := range 100 {
+		req.RemoteAddr = fmt.Sprintf("203.0.113.7:%d", 5000+i)
+		if got := s.Pick(backends, req); got != want {
+			t.Fatalf("call %d picked %s, want %s", i, got.url, want.url)
+		}
+	}
+}
+
+func TestIPHashFallsBackToNextAlive(t *testing.T) {
+	backends := fakeBackends(t, 5)
+	s := &IPHashStrategy{}
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.RemoteAddr = "203.0.113.7:5000"
+
+	first := s.Pick(backends, req)
+	first.setAlive(false)
+	second := s.Pick(backends, req)
+	if second == first {
+		t.Fatal("picked the dead backend")
+	}
+	//Other clients of the healthy backends keep their affinity
+	for i := range 50 {
+		other := httptest.NewRequest(http.MethodGet, "/", nil)
+		other.RemoteAddr = fmt.Sprintf("198.51.100.%d:80", i)
+		first.setAlive(true)
+		before := s.Pick(backends, other)
+		first.setAlive(false)
+		if after := s.Pick(backends, other); before != first && after != before {
+			t.Fatalf("client %s moved from %s to %s", other.RemoteAddr, before.url, after.url)
+		}
+	}
+	if got := s.Pick(backends, req); got != second {
+		t.Fatalf("fallback is not deterministic: %s then %s", second.url, got.url)
+	}
+}
+
+func BenchmarkNextBackend(b *testing.B) {
+	backends := make([]*BackEnd, 9)
+	for i := range backends {
+		be, err := newBackEnd(BackendConfig{URL: fmt.Sprintf("http://backend-%d", i)}, backendOptions{})
+		if err != nil {
+			b.Fatal(err)
+		}
+		be.setAlive(true)
+		backends[i] = be
+	}
+	var p pool
+	p.backends = backends
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+
+	b.ReportAllocs()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			p.nextBackend(p.candidates(), req)
+		}
+	})
+}
+
+func TestSlowStartRampsUpShare(t *testing.T) {
+	opts := backendOptions{slowStart: 300 * time.Millisecond}
+	steady := newTestBackEnd(t, BackendConfig{URL: "http://steady"}, opts)
+	recovered := newTestBackEnd(t, BackendConfig{URL: "http://recovered"}, opts)
+	backends := []*BackEnd{steady, recovered}
+
+	health := healthOptions{fall: 1, rise: 1}
+	recovered.recordHealth(false, health)
+	recovered.recordHealth(true, health)
+
+	s := &WeightedRoundRobinStrategy{}
+	var shares []int
+	for i := range 3 {
+		if i > 0 {
+			time.Sleep(160 * time.Millisecond)
+		}
+		shares = append(shares, pickCounts(s, backends, 200)[recovered])
+	}
+
+	if !(shares[0] < shares[1] && shares[1] < shares[2]) {
+		t.Fatalf("recovered backend got %v of 200 picks over time, want a rising share", shares)
+	}
+	if shares[0] > 20 || shares[2] < 90 {
+		t.Fatalf("recovered backend got %v of 200 picks, want near nothing at first and half at the end", shares)
+	}
+}
+
+// maxLoad places n requests that never finish with s and returns the
+// highest in-flight count any backend ends up with.
+func maxLoad(t *testing.T, s Strategy, n int) int64 {
+	t.Helper()
+	backends := fakeBackends(t, 100)
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	for range n {
+		s.Pick(backends, req).acquireConn()
+	}
+	var load int64
+	for _, b := range backends {
+		load = max(load, b.activeConns())
+	}
+	return load
+}
+
+func TestPowerOfTwoKeepsMaxLoadBelowRandom(t *testing.T) {
+	random := maxLoad(t, &RandomStrategy{}, 2000)
+	twoChoices := maxLoad(t, &PowerOfTwoStrategy{}, 2000)
+	//Averages 20 per backend: random lands in the thirties, two choices stays close to 20
+	if twoChoices >= random || twoChoices > 25 {
+		t.Fatalf("max load %d with power of two, %d with random", twoChoices, random)
+	}
+}
+
+func TestTwoChoicesNeverSampleABackendTwice(t *testing.T) {
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	for _, tc := range []struct {
+		name  string
+		s     Strategy
+		worse func(b *BackEnd)
+	}{
+		{"power-of-two", &PowerOfTwoStrategy{}, func(b *BackEnd) { b.acquireConn() }},
+		{"least-latency", &LeastLatencyStrategy{}, func(b *BackEnd) { b.latency.observe(time.Second) }},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			backends := fakeBackends(t, 2)
+			tc.worse(backends[0])
+			backends[1].latency.observe(time.Millisecond)
+			for range 1000 {
+				if got := tc.s.Pick(backends, req); got != backends[1] {
+					t.Fatalf("picked %s, want the better of two backends every time", got.url)
+				}
+			}
+		})
+	}
+}
+
+func TestLeastLatencyShiftsTrafficFromSlowBackend(t *testing.T) {
+	var slowHits, fastHits atomic.Int64
+	slow := newTestServer(t, func(w http.ResponseWriter, r *http.Request) {
+		slowHits.Add(1)
+		time.Sleep(20 * time.Millisecond)
+	})
+	fast := countingHandler(&fastHits)
+	l := newTestLB(t, slow.URL, newTestServer(t, fast).URL, newTestServer(t, fast).URL)
+	l.strategy = &LeastLatencyStrategy{}
+
+	//Every backend needs a sample before latency can steer picks
+	for l.snapshot()[0].latency.value() == 0 {
+		get(l, "/")
+	}
+	slowHits.Store(0)
+	fastHits.Store(0)
+	for range 90 {
+		get(l, "/")
+	}
+
+	//Every sample pairs the slow backend with a faster one
+	if slowHits.Load() > 5 {
+		t.Fatalf("slow backend got %d of 90 requests, want next to none", slowHits.Load())
+	}
+	s := newBackendStatus(l.snapshot()[0])
+	if s.LatencyEWMAMS < 10 {
+		t.Fatalf("stats latency_ewma_ms = %v for a 20ms backend", s.LatencyEWMAMS)
+	}
+}
+
+func TestEWMA(t *testing.T) {
+	var e ewma
+	if e.value() != 0 {
+		t.Fatalf("value() = %v before any sample", e.value())
+	}
+	e.observe(100 * time.Millisecond)
+	if e.value() != 100*time.Millisecond {
+		t.Fatalf("value() = %v after one sample, want it as is", e.value())
+	}
+	e.observe(0)
+	if e.value() != 80*time.Millisecond {
+		t.Fatalf("value() = %v, want 80ms with alpha 0.2", e.value())
+	}
+}
+
+func TestWeightedRandomDistribution(t *testing.T) {
+	weights := []int{5, 3, 2, 0}
+	var backends []*BackEnd
+	for i, w := range weights {
+		backends = append(backends, newTestBackEnd(t, BackendConfig{URL: fmt.Sprintf("http://backend-%d", i), Weight: ptr(w)}, backendOptions{}))
+	}
+	dead := newTestBackEnd(t, BackendConfig{URL: "http://dead", Weight: ptr(10)}, backendOptions{})
+	dead.setAlive(false)
+	backends = append(backends, dead)
+
+	const draws = 100000
+	s := &WeightedRandomStrategy{Rand: rand.New(rand.NewPCG(1, 2))}
+	counts := pickCounts(s, backends, draws)
+
+	if counts[dead] != 0 || counts[backends[3]] != 0 {
+		t.Fatalf("dead or zero-weight backend picked: %d, %d", counts[dead], counts[backends[3]])
+	}
+	for i, w := range weights[:3] {
+		want := float64(w) / 10
+		got := float64(counts[backends[i]]) / draws
+		if math.Abs(got-want) > 0.01 {
+			t.Errorf("backend %d of weight %d got %.3f of picks, want %.2f", i, w, got, want)
+		}
+	}
+}
+
+func TestWeightedRandomInjectedRandIsDeterministic(t *testing.T) {
+	backends := fakeBackends(t, 4)
+	a := &WeightedRandomStrategy{Rand: rand.New(rand.NewPCG(7, 7))}
+	b := &WeightedRandomStrategy{Rand: rand.New(rand.NewPCG(7, 7))}
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	for i := range 50 {
+		if x, y := a.Pick(backends, req), b.Pick(backends, req); x != y {
+			t.Fatalf("pick %d differs with the same seed: %s and %s", i, x.url, y.url)
+		}
+	}
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+)
+
+// tcpProxy balances raw TCP connections over the default pool. Each
+// accepted connection is piped to one backend for its whole lifetime.
+// Its Serve, Shutdown and Close mirror http.Server.
+type tcpProxy struct {
+	lb          *LoadBalancer
+	dialTimeout time.Duration
+
+	mux   sync.Mutex
+	ln    net.Listener
+	conns map[net.Conn]struct{}
+	wg    sync.WaitGroup
+}
+
+// Serve accepts connections on ln until Shutdown or Close is called.
+func (t *tcpProxy) Serve(ln net.Listener) error {
+	t.mux.Lock()
+	t.ln = ln
+	t.mux.Unlock()
+
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+			return err
+		}
+
+		t.track(conn, true)
+		t.wg.Add(1)
+		go func() {
+			defer t.wg.Done()
+			defer t.track(conn, false)
+			defer conn.Close()
+			t.handle(conn)
+		}()
+	}
+}
+
+func (t *tcpProxy) track(conn net.Conn, add bool) {
+	t.mux.Lock()
+	defer t.mux.Unlock()
+	if t.conns == nil {
+		t.conns = make(map[net.Conn]struct{})
+	}
+	if add {
+		t.conns[conn] = struct{}{}
+	} else {
+		delete(t.conns, conn)
+	}
+}
+
+// Shutdown stops accepting and waits for open connections to finish
+// until ctx is done.
+func (t *tcpProxy) Shutdown(ctx context.Context) error {
+	t.mux.Lock()
+	if t.ln != nil {
+		t.ln.Close()
+	}
+	t.mux.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		t.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Close drops every open connection.
+func (t *tcpProxy) Close() error {
+	t.mux.Lock()
+	defer t.mux.Unlock()
+	if t.ln != nil {
+		t.ln.Close()
+	}
+	for conn := range t.conns {
+		conn.Close()
+	}
+	return nil
+}
+
+// handle picks a backend for client, retrying others when the dial
+// fails, and copies bytes both ways until either side is done.
+func (t *tcpProxy) handle(client net.Conn) {
+	//Strategies look at requests, so describe the connection as one
+	r := &http.Request{
+		RemoteAddr: client.RemoteAddr().String(),
+		URL:        &url.URL{Path: "/"},
+		Header:     make(http.Header),
+	}
+
+	p := &t.lb.pool
+	candidates := p.candidates()
+	for attempt := 0; attempt <= t.lb.maxRetries; attempt++ {
+		b := p.nextBackend(candidates, r)
+		if b == nil {
+			break
+		}
+
+		err := t.serveBackend(b, client)
+		if err == nil {
+			return
+		}
+
+		slog.Warn("Backend failed, retrying", "event", "proxy_retry", "backend", b.url.String(), "client_ip", clientIP(r), "attempt", attempt+1, "error", err)
+		candidates = without(candidates, b)
+	}
+	slog.Warn("No backend available for connection", "event", "proxy_error", "client_ip", clientIP(r))
+}
+
+// serveBackend pipes client to b. Only failures to connect are
+// returned; once connected the copy runs to completion.
+func (t *tcpProxy) serveBackend(b *BackEnd, client net.Conn) error {
+	if !b.acquireConn() {
+		return errBackendSaturated
+	}
+	defer b.releaseConn()
+
+	gen, ok := b.breaker.acquire()
+	if !ok {
+		return errBreakerOpen
+	}
+
+	upstream, err := net.DialTimeout("tcp", b.dialAddr(), t.dialTimeout)
+	if err != nil {
+		b.breaker.record(gen, false)
+		backendErrorsTotal.WithLabelValues(b.url.String()).Inc()
+		if b.recordProxyError(t.lb.backendOpts.passive) {
+			t.lb.notifyHealth(b, false)
+			slog.Warn("Service went down", "event", "health_transition", "backend", b.url.String(), "status", "dead", "source", "passive", "errors", t.lb.backendOpts.passive.threshold)
+		}
+		return err
+	}
+	defer upstream.Close()
+	b.breaker.record(gen, true)
+
+	b.served.Add(1)
+	backendRequestsTotal.WithLabelValues(b.url.String()).Inc()
+
+	done := make(chan struct{})
+	go func() {
+		pipe(upstream, client)
+		close(done)
+	}()
+	pipe(client, upstream)
+	<-done
+	return nil
+}
+
+// pipe copies src to dst and then half-closes dst so the other side
+// sees EOF while the reverse direction keeps flowing.
+func pipe(dst, src net.Conn) {
+	io.Copy(dst, src)
+	if cw, ok := dst.(interface{ CloseWrite() error }); ok {
+		cw.CloseWrite()
+	} else {
+		dst.Close()
+	}
+}
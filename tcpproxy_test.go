@@ -0,0 +1,94 @@
+package main
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// newEchoServer starts a TCP server that answers each connection with
+// name followed by everything the client sends.
+func newEchoServer(t *testing.T, name string) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				io.WriteString(conn, name+":")
+				io.Copy(conn, conn)
+			}()
+		}
+	}()
+	return ln.Addr().String()
+}
+
+// startTCPProxy serves l in TCP mode and returns the address to dial.
+func startTCPProxy(t *testing.T, l *LoadBalancer) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tp := &tcpProxy{lb: l, dialTimeout: time.Second}
+	go tp.Serve(ln)
+	t.Cleanup(func() { tp.Close() })
+	return ln.Addr().String()
+}
+
+// echo sends msg over a new connection to addr and returns the reply.
+func echo(t *testing.T, addr, msg string) string {
+	t.Helper()
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	io.WriteString(conn, msg)
+	conn.(*net.TCPConn).CloseWrite()
+	reply, err := io.ReadAll(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(reply)
+}
+
+func TestTCPProxyEchoes(t *testing.T) {
+	l := newTestLB(t, "http://"+newEchoServer(t, "a"), "http://"+newEchoServer(t, "b"))
+	addr := startTCPProxy(t, l)
+
+	seen := make(map[string]int)
+	for range 4 {
+		seen[echo(t, addr, "ping")]++
+	}
+	if seen["a:ping"] != 2 || seen["b:ping"] != 2 {
+		t.Fatalf("replies = %v, want the bytes echoed by each backend in turn", seen)
+	}
+	for _, b := range l.snapshot() {
+		if n := b.activeConns(); n != 0 {
+			t.Errorf("%s still counts %d open connections", b.url, n)
+		}
+	}
+}
+
+func TestTCPProxyRetriesRefusedDial(t *testing.T) {
+	l := newTestLB(t, deadURL(t), "http://"+newEchoServer(t, "live"))
+	l.maxRetries = 1
+	addr := startTCPProxy(t, l)
+
+	for i := range 4 {
+		if got := echo(t, addr, "ping"); got != "live:ping" {
+			t.Fatalf("connection %d got %q, want it retried on the live backend", i, got)
+		}
+	}
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// writeTestCert writes a self-signed certificate for 127.0.0.1 with
+// common name cn to dir and returns the cert and key paths.
+func writeTestCert(t *testing.T, dir, cn string) (certFile, keyFile string) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: cn},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		DNSNames:     []string{"localhost"},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	certFile = filepath.Join(dir, "cert.pem")
+	keyFile = filepath.Join(dir, "key.pem")
+	if err := os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return certFile, keyFile
+}
+
+// serveTLS serves h over TLS with config and returns the address.
+func serveTLS(t *testing.T, h http.Handler, config *tls.Config) string {
+	t.Helper()
+	ln, err := tls.Listen("tcp", "127.0.0.1:0", config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := &http.Server{Handler: h}
+	go srv.Serve(ln)
+	t.Cleanup(func() { srv.Close() })
+	return ln.Addr().String()
+}
+
+func TestServerTLSConfigMinVersion(t *testing.T) {
+	certs, err := newCertStore(writeTestCert(t, t.TempDir(), "lb"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := serveTLS(t, nameHandler("ok"), serverTLSConfig(certs))
+
+	for _, tc := range []struct {
+		version uint16
+		ok      bool
+	}{
+		{tls.VersionTLS11, false},
+		{tls.VersionTLS12, true},
+		{tls.VersionTLS13, true},
+	} {
+		conn, err := tls.Dial("tcp", addr, &tls.Config{InsecureSkipVerify: true, MinVersion: tc.version, MaxVersion: tc.version})
+		if err == nil {
+			conn.Close()
+		}
+		if (err == nil) != tc.ok {
+			t.Errorf("%s: handshake error %v, want success %v", tls.VersionName(tc.version), err, tc.ok)
+		}
+	}
+}
+
+func TestHTTPSRedirect(t *testing.T) {
+	for _, tc := range []struct {
+		port int
+		want string
+	}{
+		{443, "https://example.com/a?b=c"},
+		{8443, "https://example.com:8443/a?b=c"},
+	} {
+		rec := get(httpsRedirect(tc.port), "http://example.com:8080/a?b=c")
+		if rec.Code != http.StatusMovedPermanently || rec.Header().Get("Location") != tc.want {
+			t.Errorf("port %d: %d to %q, want 301 to %q", tc.port, rec.Code, rec.Header().Get("Location"), tc.want)
+		}
+	}
+}
+
+func TestHTTPSRedirectListener(t *testing.T) {
+	srv := newTestServer(t, httpsRedirect(8443).ServeHTTP)
+	client := &http.Client{
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+
+	resp, err := client.Post(srv.URL+"/orders/7?page=2&sort=asc", "text/plain", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	want := "https://127.0.0.1:8443/orders/7?page=2&sort=asc"
+	if resp.StatusCode != http.StatusMovedPermanently || resp.Header.Get("Location") != want {
+		t.Fatalf("%d to %q, want 301 to %q", resp.StatusCode, resp.Header.Get("Location"), want)
+	}
+}
+
+// handshakeCN dials addr and returns the common name of the certificate
+// the server presented, leaving the connection open.
+func handshakeCN(t *testing.T, addr string) (*tls.Conn, string) {
+	t.Helper()
+	conn, err := tls.Dial("tcp", addr, &tls.Config{InsecureSkipVerify: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn, conn.ConnectionState().PeerCertificates[0].Subject.CommonName
+}
+
+func TestCertStoreReload(t *testing.T) {
+	dir := t.TempDir()
+	certs, err := newCertStore(writeTestCert(t, dir, "old"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := serveTLS(t, nameHandler("ok"), serverTLSConfig(certs))
+
+	existing, cn := handshakeCN(t, addr)
+	if cn != "old" {
+		t.Fatalf("served %q before the reload", cn)
+	}
+
+	writeTestCert(t, dir, "new")
+	if err := certs.load(); err != nil {
+		t.Fatal(err)
+	}
+	if _, cn := handshakeCN(t, addr); cn != "new" {
+		t.Fatalf("new handshake got %q, want the reloaded certificate", cn)
+	}
+	if cn := existing.ConnectionState().PeerCertificates[0].Subject.CommonName; cn != "old" {
+		t.Fatalf("existing connection now reports %q", cn)
+	}
+
+	//A broken file on disk keeps the last good certificate
+	if err := os.WriteFile(filepath.Join(dir, "cert.pem"), []byte("garbage"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := certs.load(); err == nil {
+		t.Fatal("load accepted a broken certificate")
+	}
+	if _, cn := handshakeCN(t, addr); cn != "new" {
+		t.Fatalf("handshake after a failed reload got %q, want the previous certificate", cn)
+	}
+}
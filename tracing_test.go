@@ -0,0 +1,71 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+// recordSpans installs a tracer provider that keeps finished spans in
+// memory for the rest of the test.
+func recordSpans(t *testing.T) *tracetest.InMemoryExporter {
+	t.Helper()
+	exporter := tracetest.NewInMemoryExporter()
+	provider := sdktrace.NewTracerProvider(sdktrace.WithSyncer(exporter))
+	prevProvider, prevPropagator := otel.GetTracerProvider(), otel.GetTextMapPropagator()
+	otel.SetTracerProvider(provider)
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+	t.Cleanup(func() {
+		otel.SetTracerProvider(prevProvider)
+		otel.SetTextMapPropagator(prevPropagator)
+	})
+	return exporter
+}
+
+func TestTracingSpanPerRequest(t *testing.T) {
+	exporter := recordSpans(t)
+	traceparent := make(chan string, 1)
+	srv := newTestServer(t, func(w http.ResponseWriter, r *http.Request) {
+		traceparent <- r.Header.Get("Traceparent")
+	})
+
+	l := newTestLB(t)
+	l.tracing = true
+	l.backendOpts.tracing = true
+	addTestBackends(t, l, srv.URL)
+	get(l, "/orders")
+
+	spans := exporter.GetSpans()
+	if len(spans) != 1 {
+		t.Fatalf("got %d spans, want 1", len(spans))
+	}
+	span := spans[0]
+	attrs := attribute.NewSet(span.Attributes...)
+	if v, _ := attrs.Value("lb.backend"); v.AsString() != srv.URL {
+		t.Errorf("lb.backend = %q, want %q", v.AsString(), srv.URL)
+	}
+	if v, _ := attrs.Value("http.response.status_code"); v.AsInt64() != http.StatusOK {
+		t.Errorf("status attribute = %v, want 200", v.AsInt64())
+	}
+
+	//The backend continues the load balancer's trace
+	tp := <-traceparent
+	if want := span.SpanContext.TraceID().String(); len(tp) < 36 || tp[3:35] != want {
+		t.Errorf("backend got traceparent %q, want trace %s", tp, want)
+	}
+}
+
+func TestTracingDisabled(t *testing.T) {
+	exporter := recordSpans(t)
+	srv := newTestServer(t, nameHandler("ok"))
+	l := newTestLB(t, srv.URL)
+	get(l, "/")
+	if n := len(exporter.GetSpans()); n != 0 {
+		t.Fatalf("got %d spans with tracing off", n)
+	}
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"time"
+
+	"golang.org/x/net/http2"
+)
+
+// transportOptions tunes connection pooling to the backends.
+type transportOptions struct {
+	maxIdleConns        int
+	maxIdleConnsPerHost int
+	idleConnTimeout     time.Duration
+	dialTimeout         time.Duration
+	disableKeepAlives   bool
+}
+
+// newTransport builds the upstream transport shared by all backend
+// proxies and HTTP health checks, so idle connections are pooled
+// across them.
+func newTransport(cfg BackendTLSConfig, opts transportOptions) (*http.Transport, error) {
+	t := http.DefaultTransport.(*http.Transport).Clone()
+	t.MaxIdleConns = opts.maxIdleConns
+	t.MaxIdleConnsPerHost = opts.maxIdleConnsPerHost
+	t.IdleConnTimeout = opts.idleConnTimeout
+	t.DisableKeepAlives = opts.disableKeepAlives
+	t.DialContext = (&net.Dialer{
+		Timeout:   opts.dialTimeout,
+		KeepAlive: 30 * time.Second,
+	}).DialContext
+
+	tlsConfig := &tls.Config{
+		MinVersion:         tls.VersionTLS12,
+		InsecureSkipVerify: cfg.InsecureSkipVerify,
+	}
+
+	if cfg.CAFile != "" {
+		pem, err := os.ReadFile(cfg.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("reading CA bundle %s: %w", cfg.CAFile, err)
+		}
+
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("CA bundle %s contains no PEM certificates", cfg.CAFile)
+		}
+		tlsConfig.RootCAs = pool
+	}
+
+	t.TLSClientConfig = tlsConfig
+	return t, nil
+}
+
+// h2cTransport speaks cleartext HTTP/2 with prior knowledge to http://
+// backends, as gRPC servers expect, and leaves https:// backends to the
+// regular transport, which negotiates HTTP/2 through ALPN.
+type h2cTransport struct {
+	tls *http.Transport
+	h2c *http2.Transport
+}
+
+// newH2CTransport wraps t so requests to http:// backends use h2c. The
+// HTTP/2 connections are dialed with t's dialer.
+func newH2CTransport(t *http.Transport) http.RoundTripper {
+	return &h2cTransport{
+		tls: t,
+		h2c: &http2.Transport{
+			AllowHTTP: true,
+			DialTLSContext: func(ctx context.Context, network, addr string, _ *tls.Config) (net.Conn, error) {
+				return t.DialContext(ctx, network, addr)
+			},
+			IdleConnTimeout: t.IdleConnTimeout,
+		},
+	}
+}
+
+func (t *h2cTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	if r.URL.Scheme == "http" {
+		return t.h2c.RoundTrip(r)
+	}
+	return t.tls.RoundTrip(r)
+}
@@ -0,0 +1,220 @@
+package main
+
+import (
+	"context"
+	"encoding/pem"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/status"
+)
+
+func TestHTTPSBackendWithCustomCA(t *testing.T) {
+	srv := httptest.NewTLSServer(nameHandler("secure"))
+	t.Cleanup(srv.Close)
+
+	caFile := filepath.Join(t.TempDir(), "ca.pem")
+	if err := os.WriteFile(caFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: srv.Certificate().Raw}), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		name string
+		cfg  BackendTLSConfig
+		want int
+	}{
+		{"system roots", BackendTLSConfig{}, http.StatusBadGateway},
+		{"custom CA", BackendTLSConfig{CAFile: caFile}, http.StatusOK},
+		{"insecure", BackendTLSConfig{InsecureSkipVerify: true}, http.StatusOK},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			transport, err := newTransport(tc.cfg, transportOptions{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			l := newTestLB(t)
+			l.backendOpts.transport = transport
+			addTestBackends(t, l, srv.URL)
+
+			if rec := get(l, "/"); rec.Code != tc.want {
+				t.Fatalf("status = %d, want %d", rec.Code, tc.want)
+			}
+		})
+	}
+}
+
+func TestNewTransportRejectsBadCAFile(t *testing.T) {
+	empty := filepath.Join(t.TempDir(), "empty.pem")
+	if err := os.WriteFile(empty, []byte("not a certificate"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	for _, path := range []string{empty, filepath.Join(t.TempDir(), "missing.pem")} {
+		if _, err := newTransport(BackendTLSConfig{CAFile: path}, transportOptions{}); err == nil {
+			t.Errorf("newTransport accepted CA file %s", filepath.Base(path))
+		}
+	}
+}
+
+func TestDisableKeepAlivesOpensConnectionPerRequest(t *testing.T) {
+	var conns atomic.Int64
+	srv := httptest.NewUnstartedServer(nameHandler("ok"))
+	srv.Config.ConnState = func(c net.Conn, s http.ConnState) {
+		if s == http.StateNew {
+			conns.Add(1)
+		}
+	}
+	srv.Start()
+	defer srv.Close()
+
+	for _, tc := range []struct {
+		name       string
+		global     bool
+		perBackend bool
+		want       int64
+	}{
+		{"keep-alive", false, false, 1},
+		{"-disable-backend-keepalive", true, false, 5},
+		{"disable_keepalive", false, true, 5},
+	} {
+		transport, err := newTransport(BackendTLSConfig{}, transportOptions{maxIdleConnsPerHost: 4, dialTimeout: time.Second, disableKeepAlives: tc.global})
+		if err != nil {
+			t.Fatal(err)
+		}
+		l := newTestLB(t)
+		l.backendOpts.transport = transport
+		if err := l.addBackend(newTestBackEnd(t, BackendConfig{URL: srv.URL, DisableKeepAlive: tc.perBackend}, l.backendOpts)); err != nil {
+			t.Fatal(err)
+		}
+
+		conns.Store(0)
+		for range 5 {
+			if rec := get(l, "/"); rec.Code != http.StatusOK {
+				t.Fatalf("%s: status = %d", tc.name, rec.Code)
+			}
+		}
+		if n := conns.Load(); n != tc.want {
+			t.Errorf("%s: backend saw %d connections for 5 requests, want %d", tc.name, n, tc.want)
+		}
+		transport.CloseIdleConnections()
+	}
+}
+
+func TestH2CRejectsDisableKeepAlive(t *testing.T) {
+	transport, err := newTransport(BackendTLSConfig{}, transportOptions{dialTimeout: time.Second})
+	if err != nil {
+		t.Fatal(err)
+	}
+	opts := backendOptions{transport: transport, proxyTransport: newH2CTransport(transport)}
+	if _, err := newBackEnd(BackendConfig{URL: "http://a:80", DisableKeepAlive: true}, opts); err == nil || !strings.Contains(err.Error(), "not supported with -h2c") {
+		t.Fatalf("newBackEnd = %v, want disable_keepalive rejected", err)
+	}
+
+	out, err := runMain(t, "-validate", "-backends", "http://a:80", "-h2c", "-disable-backend-keepalive")
+	if err == nil || !strings.Contains(out, "-disable-backend-keepalive is not supported with -h2c") {
+		t.Fatalf("exit error = %v, want the flags rejected:\n%s", err, out)
+	}
+}
+
+func BenchmarkProxyTransport(b *testing.B) {
+	var conns atomic.Int64
+	//A little upstream latency keeps many requests in flight at once
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(time.Millisecond)
+	}))
+	srv.Config.ConnState = func(c net.Conn, s http.ConnState) {
+		if s == http.StateNew {
+			conns.Add(1)
+		}
+	}
+	srv.Start()
+	defer srv.Close()
+
+	for _, bc := range []struct {
+		name string
+		opts transportOptions
+	}{
+		//http.DefaultTransport keeps 2 idle connections per host
+		{"default", transportOptions{maxIdleConns: 100, maxIdleConnsPerHost: 2, idleConnTimeout: 90 * time.Second, dialTimeout: 5 * time.Second}},
+		{"tuned", transportOptions{maxIdleConns: 256, maxIdleConnsPerHost: 64, idleConnTimeout: 90 * time.Second, dialTimeout: 5 * time.Second}},
+	} {
+		b.Run(bc.name, func(b *testing.B) {
+			transport, err := newTransport(BackendTLSConfig{}, bc.opts)
+			if err != nil {
+				b.Fatal(err)
+			}
+			defer transport.CloseIdleConnections()
+			backend, err := newBackEnd(BackendConfig{URL: srv.URL}, backendOptions{transport: transport})
+			if err != nil {
+				b.Fatal(err)
+			}
+			backend.setAlive(true)
+			l := &LoadBalancer{}
+			l.backends = []*BackEnd{backend}
+
+			b.SetParallelism(16)
+			conns.Store(0)
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				for pb.Next() {
+					if rec := get(l, "/"); rec.Code != http.StatusOK {
+						b.Errorf("status = %d", rec.Code)
+						return
+					}
+				}
+			})
+			//Connections dialled per thousand requests, lower means better reuse
+			b.ReportMetric(float64(conns.Load())*1000/float64(b.N), "dials/kreq")
+		})
+	}
+}
+
+func TestUnaryGRPCThroughH2C(t *testing.T) {
+	hs, backendURL := newGRPCHealthServer(t)
+	hs.SetServingStatus("orders", healthpb.HealthCheckResponse_NOT_SERVING)
+
+	transport, err := newTransport(BackendTLSConfig{}, transportOptions{dialTimeout: time.Second})
+	if err != nil {
+		t.Fatal(err)
+	}
+	l := newTestLB(t)
+	l.backendOpts.proxyTransport = newH2CTransport(transport)
+	addTestBackends(t, l, backendURL)
+	front := httptest.NewServer(h2c.NewHandler(l, &http2.Server{}))
+	defer front.Close()
+
+	conn, err := grpc.NewClient(strings.TrimPrefix(front.URL, "http://"), grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	client := healthpb.NewHealthClient(conn)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	resp, err := client.Check(ctx, &healthpb.HealthCheckRequest{Service: "orders"})
+	if err != nil {
+		t.Fatalf("unary call through the LB: %v", err)
+	}
+	if resp.GetStatus() != healthpb.HealthCheckResponse_NOT_SERVING {
+		t.Fatalf("status = %s, want the backend's NOT_SERVING", resp.GetStatus())
+	}
+
+	//gRPC errors travel in trailers, which must reach the client intact
+	_, err = client.Check(ctx, &healthpb.HealthCheckRequest{Service: "unknown"})
+	if status.Code(err) != codes.NotFound {
+		t.Fatalf("unknown service error = %v, want NotFound from the backend's trailers", err)
+	}
+}
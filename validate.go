@@ -0,0 +1,53 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"maps"
+	"slices"
+	"strings"
+)
+
+// printConfigSummary writes the backends lb would serve to w, used by
+// -validate after the config has been loaded and checked.
+func (l *LoadBalancer) printConfigSummary(w io.Writer) {
+	fmt.Fprintln(w, "config OK")
+	for _, p := range l.allPools() {
+		backends := p.snapshot()
+		if len(backends) == 0 {
+			continue
+		}
+		fmt.Fprintf(w, "pool %s: %d backend(s)\n", p.name, len(backends))
+		printBackends(w, backends)
+	}
+	for _, rt := range l.routes {
+		fmt.Fprintf(w, "route host=%q sni=%q path_prefix=%q methods=%s -> %s\n", rt.host, rt.sni, rt.pathPrefix, strings.Join(rt.methods, ","), rt.pool.name)
+	}
+}
+
+func printBackends(w io.Writer, backends []*BackEnd) {
+	for _, b := range backends {
+		fmt.Fprintf(w, "  %s weight=%d health=%s", b.url.String(), b.weight, b.health.mode)
+		switch b.health.mode {
+		case healthModeHTTP:
+			fmt.Fprintf(w, " path=%s status=%s", b.health.path, b.health.status)
+		case healthModeGRPC:
+			if b.health.service != "" {
+				fmt.Fprintf(w, " service=%s", b.health.service)
+			}
+		}
+		if b.maxConns > 0 {
+			fmt.Fprintf(w, " max_conns=%d", b.maxConns)
+		}
+		if b.keepAliveOff {
+			fmt.Fprint(w, " keepalive=off")
+		}
+		if b.stripPrefix != "" {
+			fmt.Fprintf(w, " strip_prefix=%s", b.stripPrefix)
+		}
+		for _, k := range slices.Sorted(maps.Keys(b.tags)) {
+			fmt.Fprintf(w, " tag:%s=%s", k, b.tags[k])
+		}
+		fmt.Fprintln(w)
+	}
+}
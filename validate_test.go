@@ -0,0 +1,46 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestLoadConfigRejectsInvalidBackends(t *testing.T) {
+	for _, tc := range []struct {
+		name, entry, want string
+	}{
+		{"negative weight", "{url: http://a:80, weight: -1}", "weight must not be negative"},
+		{"no host", "{url: \"http://:80\"}", "no host"},
+		{"negative timeout", "{url: http://a:80, timeout: -1s}", "timeout must not be negative"},
+		{"bad duration", "{url: http://a:80, timeout: soon}", "invalid duration"},
+		{"bad strip prefix", "{url: http://a:80, strip_prefix: api}", "strip_prefix must start with /"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := loadConfig(writeConfig(t, "backends:\n  - "+tc.entry+"\n"))
+			if err == nil || !strings.Contains(err.Error(), tc.want) {
+				t.Fatalf("error = %v, want one containing %q", err, tc.want)
+			}
+		})
+	}
+}
+
+func TestPrintConfigSummary(t *testing.T) {
+	l := newTestLB(t)
+	if err := l.addBackend(newTestBackEnd(t, BackendConfig{URL: "http://a:80", Weight: ptr(3), MaxConns: 5, Tags: map[string]string{"zone": "us-east"}}, l.backendOpts)); err != nil {
+		t.Fatal(err)
+	}
+	addTestBackends(t, l, "http://b:80")
+
+	var out strings.Builder
+	l.printConfigSummary(&out)
+	for _, want := range []string{
+		"config OK\n",
+		"pool default: 2 backend(s)\n",
+		"  http://a:80 weight=3 health=http path=/health status=200-299 max_conns=5 tag:zone=us-east\n",
+		"  http://b:80 weight=1 health=http",
+	} {
+		if !strings.Contains(out.String(), want) {
+			t.Errorf("summary is missing %q:\n%s", want, out.String())
+		}
+	}
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+func TestVersionEndpoint(t *testing.T) {
+	l := newTestLB(t)
+	rec := adminRequest(l, http.MethodGet, "/admin/version", "")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status = %d", rec.Code)
+	}
+	var fields map[string]string
+	if err := json.Unmarshal(rec.Body.Bytes(), &fields); err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{
+		"version":    "dev",
+		"commit":     "dev",
+		"build_date": "dev",
+		"go_version": runtime.Version(),
+	}
+	if len(fields) != len(want) {
+		t.Errorf("fields = %v, want %v", fields, want)
+	}
+	for k, v := range want {
+		if fields[k] != v {
+			t.Errorf("%s = %q, want %q", k, fields[k], v)
+		}
+	}
+}
+
+func TestPrintVersion(t *testing.T) {
+	defer func(v, c, d string) { version, commit, buildDate = v, c, d }(version, commit, buildDate)
+	version, commit, buildDate = "v1.2.0", "abc1234", "2026-01-02T03:04:05Z"
+
+	var out strings.Builder
+	printVersion(&out)
+	for _, s := range []string{"v1.2.0", "abc1234", "2026-01-02T03:04:05Z", runtime.Version()} {
+		if !strings.Contains(out.String(), s) {
+			t.Errorf("printVersion() = %q, missing %q", out.String(), s)
+		}
+	}
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"io"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/net/websocket"
+)
+
+func TestWebSocketEchoThroughLoadBalancer(t *testing.T) {
+	echo := httptest.NewServer(websocket.Handler(func(ws *websocket.Conn) {
+		io.Copy(ws, ws)
+	}))
+	t.Cleanup(echo.Close)
+
+	l := newTestLB(t, echo.URL)
+	l.requestTimeout = 50 * time.Millisecond
+	front := httptest.NewServer(l)
+	t.Cleanup(front.Close)
+
+	ws, err := websocket.Dial("ws"+strings.TrimPrefix(front.URL, "http")+"/echo", "", front.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ws.Close()
+
+	//Outlive the request timeout, which must not apply to upgraded connections
+	for _, msg := range []string{"hello", "world"} {
+		time.Sleep(60 * time.Millisecond)
+		if err := websocket.Message.Send(ws, msg); err != nil {
+			t.Fatal(err)
+		}
+		ws.SetReadDeadline(time.Now().Add(5 * time.Second))
+		var reply string
+		if err := websocket.Message.Receive(ws, &reply); err != nil {
+			t.Fatal(err)
+		}
+		if reply != msg {
+			t.Fatalf("echo = %q, want %q", reply, msg)
+		}
+	}
+}